@@ -0,0 +1,256 @@
+// Package activesync implements Exchange ActiveSync HTTP conventions over NTLM transport: OPTIONS discovery,
+// plain and base64 encoded command query strings and long-running Ping requests on persistent connections.
+// Command bodies are WBXML and left to the caller.
+package activesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// ContentType is the type of WBXML command bodies
+const ContentType = "application/vnd.ms-sync.wbxml"
+
+// commandCodes are codes of commands in base64 encoded query strings
+var commandCodes = map[string]byte{
+	"Sync": 0, "SendMail": 1, "SmartForward": 2, "SmartReply": 3, "GetAttachment": 4,
+	"FolderSync": 9, "FolderCreate": 10, "FolderDelete": 11, "FolderUpdate": 12, "MoveItems": 13,
+	"GetItemEstimate": 14, "MeetingResponse": 15, "Search": 16, "Settings": 17, "Ping": 18,
+	"ItemOperations": 19, "Provision": 20, "ResolveRecipients": 21, "ValidateCert": 22,
+}
+
+// parameterCodes are codes of command parameters in base64 encoded query strings
+var parameterCodes = map[string]byte{
+	"AttachmentName": 0, "CollectionId": 1, "ItemId": 3, "LongId": 4, "Occurrence": 6, "Options": 7, "User": 8,
+}
+
+// NewTransport returns NTLM transport suited for ActiveSync, Ping requests hang for up to
+// the heartbeat interval and the authenticated connection is kept between them
+func NewTransport(domain, user, password string) *httpntlm.NtlmTransport {
+	tr := httpntlm.NewBaseTransport()
+	// Ping response comes at the end of the heartbeat interval
+	tr.ResponseHeaderTimeout = 0
+	tr.IdleConnTimeout = 30 * time.Minute
+
+	return &httpntlm.NtlmTransport{
+		Domain:       domain,
+		User:         user,
+		Password:     password,
+		RoundTripper: tr,
+	}
+}
+
+// Client sends ActiveSync commands on behalf of a device
+type Client struct {
+	// BaseURL is ActiveSync endpoint, e.g. https://mail.example.com/Microsoft-Server-ActiveSync
+	BaseURL string
+	// HTTPClient sends the requests, it's expected to authenticate them
+	HTTPClient *http.Client
+	// User, DeviceID and DeviceType identify the device
+	User       string
+	DeviceID   string
+	DeviceType string
+	// ProtocolVersion is the protocol version commands are sent with, e.g. "14.1"
+	ProtocolVersion string
+	// PolicyKey is the key obtained by Provision command, zero before provisioning
+	PolicyKey uint32
+	// Base64Query makes commands be sent with base64 encoded query strings, supported by protocol versions up to 14.1
+	Base64Query bool
+	// Locale is sent in base64 encoded query strings, 0x0409 (en-US) is used if zero
+	Locale uint16
+}
+
+// New returns client of ActiveSync endpoint at baseURL authenticating through t
+func New(baseURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{BaseURL: baseURL, HTTPClient: &http.Client{Transport: t}}
+}
+
+// Options are protocol versions and commands server supports
+type Options struct {
+	Versions []string
+	Commands []string
+}
+
+// Discover sends OPTIONS request and returns what server supports, ProtocolVersion is set
+// to the highest version server supports if it's not set yet
+func (c *Client) Discover(ctx context.Context) (*Options, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, c.BaseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("activesync: OPTIONS failed: %s", resp.Status)
+	}
+
+	o := &Options{
+		Versions: splitList(resp.Header.Get("MS-ASProtocolVersions")),
+		Commands: splitList(resp.Header.Get("MS-ASProtocolCommands")),
+	}
+	if c.ProtocolVersion == "" && len(o.Versions) > 0 {
+		c.ProtocolVersion = highest(o.Versions)
+	}
+	return o, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func highest(versions []string) string {
+	best, bestValue := "", -1.0
+	for _, v := range versions {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > bestValue {
+			best, bestValue = v, f
+		}
+	}
+	return best
+}
+
+// Command sends command cmd with WBXML body, params are command parameters such as CollectionId or ItemId.
+// Caller is responsible for closing response body.
+func (c *Client) Command(ctx context.Context, cmd string, params map[string]string, body []byte) (*http.Response, error) {
+	query, err := c.query(cmd, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"?"+query, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	if !c.Base64Query {
+		// base64 query carries these itself
+		req.Header.Set("MS-ASProtocolVersion", c.ProtocolVersion)
+		req.Header.Set("X-MS-PolicyKey", strconv.FormatUint(uint64(c.PolicyKey), 10))
+	}
+
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) query(cmd string, params map[string]string) (string, error) {
+	if !c.Base64Query {
+		q := url.Values{}
+		q.Set("Cmd", cmd)
+		q.Set("User", c.User)
+		q.Set("DeviceId", c.DeviceID)
+		q.Set("DeviceType", c.DeviceType)
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		return q.Encode(), nil
+	}
+
+	b, err := c.encodeQuery(cmd, params)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// encodeQuery builds base64 query string content as defined by MS-ASHTTP
+func (c *Client) encodeQuery(cmd string, params map[string]string) ([]byte, error) {
+	code, ok := commandCodes[cmd]
+	if !ok {
+		return nil, errors.New("activesync: unknown command " + cmd)
+	}
+	version, err := strconv.ParseFloat(c.ProtocolVersion, 64)
+	if err != nil {
+		return nil, errors.New("activesync: invalid protocol version " + c.ProtocolVersion)
+	}
+	locale := c.Locale
+	if locale == 0 {
+		locale = 0x0409
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(byte(version*10 + 0.5))
+	b.WriteByte(code)
+	binary.Write(&b, binary.LittleEndian, locale)
+	if err := writeField(&b, []byte(c.DeviceID)); err != nil {
+		return nil, err
+	}
+	if c.PolicyKey == 0 {
+		b.WriteByte(0)
+	} else {
+		b.WriteByte(4)
+		binary.Write(&b, binary.LittleEndian, c.PolicyKey)
+	}
+	if err := writeField(&b, []byte(c.DeviceType)); err != nil {
+		return nil, err
+	}
+
+	// user is a parameter too
+	all := map[string]string{"User": c.User}
+	for k, v := range params {
+		all[k] = v
+	}
+	for _, name := range []string{"AttachmentName", "CollectionId", "ItemId", "LongId", "Occurrence", "Options", "User"} {
+		v, ok := all[name]
+		if !ok || v == "" {
+			continue
+		}
+		b.WriteByte(parameterCodes[name])
+		if err := writeField(&b, []byte(v)); err != nil {
+			return nil, err
+		}
+		delete(all, name)
+	}
+	for name := range all {
+		if all[name] != "" {
+			return nil, errors.New("activesync: parameter " + name + " can't be base64 encoded")
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// writeField writes length prefixed value
+func writeField(b *bytes.Buffer, v []byte) error {
+	if len(v) > 255 {
+		return errors.New("activesync: query value is too long")
+	}
+	b.WriteByte(byte(len(v)))
+	b.Write(v)
+	return nil
+}
+
+// Ping sends Ping command which hangs until something changes in monitored folders or heartbeat interval ends,
+// the request is sent over the same authenticated connection as other commands
+func (c *Client) Ping(ctx context.Context, body []byte) (*http.Response, error) {
+	return c.Command(ctx, "Ping", nil, body)
+}
@@ -0,0 +1,42 @@
+package activesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Discover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("MS-ASProtocolVersions", "2.5,12.0,12.1,14.0,14.1")
+		w.Header().Set("MS-ASProtocolCommands", "Sync,FolderSync,Ping")
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL}
+	o, err := c.Discover(httpntlm.WithoutNTLM(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Commands) != 3 || c.ProtocolVersion != "14.1" {
+		t.Errorf("unexpected options %+v, version %s", o, c.ProtocolVersion)
+	}
+}
+
+func Test_Base64Query(t *testing.T) {
+	c := &Client{User: "u", DeviceID: "d1", DeviceType: "T", ProtocolVersion: "14.1", PolicyKey: 1, Base64Query: true}
+	q, err := c.query("Sync", map[string]string{"CollectionId": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := base64.StdEncoding.DecodeString(q)
+	expected := []byte{141, 0, 0x09, 0x04, 2, 'd', '1', 4, 1, 0, 0, 0, 1, 'T', 1, 1, '5', 8, 1, 'u'}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected %v, got %v", expected, b)
+	}
+}
@@ -0,0 +1,74 @@
+package httpntlm
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// DefaultAffinityCookies are names of sticky session cookies of common load balancers,
+// ARR, F5 BIG-IP, Citrix ADC, AWS ALB, HAProxy and nginx ingress
+var DefaultAffinityCookies = []string{
+	"ARRAffinity", "ARRAffinitySameSite", "BIGipServer*", "NSC_*", "AWSALB", "AWSALBCORS", "SERVERID", "INGRESSCOOKIE",
+}
+
+// affinityJar keeps affinity cookies set by the hosts
+type affinityJar struct {
+	names []string
+	jar   *cookiejar.Jar
+}
+
+// affinityJar returns jar of AffinityCookies, nil if they aren't kept
+func (t *NtlmTransport) affinityJar() *affinityJar {
+	if len(t.AffinityCookies) == 0 || t.Jar != nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.affinity == nil {
+		// jar without public suffix list never fails to be created
+		jar, _ := cookiejar.New(nil)
+		t.affinity = &affinityJar{names: append([]string(nil), t.AffinityCookies...), jar: jar}
+	}
+	return t.affinity
+}
+
+func (j *affinityJar) isAffinity(name string) bool {
+	for _, n := range j.names {
+		if name == n || strings.HasSuffix(n, "*") && strings.HasPrefix(name, strings.TrimSuffix(n, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep stores affinity cookies resp sets
+func (j *affinityJar) keep(u *url.URL, resp *http.Response) {
+	var cookies []*http.Cookie
+	for _, c := range resp.Cookies() {
+		if j.isAffinity(c.Name) {
+			cookies = append(cookies, c)
+		}
+	}
+	if len(cookies) > 0 {
+		j.jar.SetCookies(u, cookies)
+	}
+}
+
+// add returns req carrying affinity cookies of its host, cookies the caller sent are kept
+func (j *affinityJar) add(req *http.Request) *http.Request {
+	cookies := j.jar.Cookies(req.URL)
+	if len(cookies) == 0 {
+		return req
+	}
+
+	r := req.Clone(req.Context())
+	for _, c := range cookies {
+		if _, err := req.Cookie(c.Name); err == http.ErrNoCookie {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
@@ -0,0 +1,86 @@
+package httpntlm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// AuditOutcome is the result of an authentication attempt
+type AuditOutcome string
+
+const (
+	// AuditSuccess means server accepted the credentials
+	AuditSuccess AuditOutcome = "success"
+	// AuditRejected means server rejected the credentials
+	AuditRejected AuditOutcome = "rejected"
+	// AuditError means authentication couldn't be completed, e.g. challenge was refused or connection failed
+	AuditError AuditOutcome = "error"
+)
+
+// AuditRecord describes an authentication attempt, it carries no secrets
+type AuditRecord struct {
+	Time time.Time
+	// Host is the origin host of the request
+	Host string
+	// Proxy is set when authenticating to the proxy
+	Proxy       bool
+	Domain      string
+	User        string
+	Workstation string
+	Outcome     AuditOutcome
+	// StatusCode is the status of response to the authenticate message, zero on error
+	StatusCode int
+	// Err is the error authentication failed with
+	Err error
+	// TLSFingerprint is hex encoded SHA-256 of server certificate, empty for plain http
+	TLSFingerprint string
+	// CorrelationID is ID of the request, see NtlmTransport.CorrelationID
+	CorrelationID string
+}
+
+// AuditSink receives audit records of authentication attempts, it's separate from debug logging
+// and meant for compliance records
+type AuditSink interface {
+	Audit(record AuditRecord)
+}
+
+// AuditSinkFunc adapts ordinary function to AuditSink
+type AuditSinkFunc func(record AuditRecord)
+
+// Audit calls f(record)
+func (f AuditSinkFunc) Audit(record AuditRecord) {
+	f(record)
+}
+
+// audit records authentication attempt of req to target which ended with resp or err
+func (t *NtlmTransport) audit(req *http.Request, target authTarget, resp *http.Response, err error) {
+	if t.AuditSink == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:          time.Now(),
+		Host:          hostKey(req.URL),
+		Proxy:         target.proxy,
+		Domain:        target.creds.Domain,
+		User:          target.creds.User,
+		Workstation:   target.creds.Workstation,
+		Outcome:       AuditError,
+		Err:           err,
+		CorrelationID: correlationIDOf(req.Context()),
+	}
+	if resp != nil {
+		record.StatusCode = resp.StatusCode
+		record.Outcome = AuditSuccess
+		if resp.StatusCode == target.status {
+			record.Outcome = AuditRejected
+		}
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			sum := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+			record.TLSFingerprint = hex.EncodeToString(sum[:])
+		}
+	}
+	t.AuditSink.Audit(record)
+}
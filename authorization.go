@@ -0,0 +1,44 @@
+package httpntlm
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrAuthorizationDenied is matched by AuthorizationError
+var ErrAuthorizationDenied = errors.New("authorization denied")
+
+// AuthorizationError is returned instead of 403 response server sent after it had authenticated the request
+// when NtlmTransport.AuthorizationErrors is set, credentials are valid but the user isn't allowed access
+type AuthorizationError struct {
+	// Scheme is the authentication scheme server accepted, see HandshakeInfo
+	Scheme string
+	// Response is the denial, its body is buffered up to MaxDrainBytes and can be read after the error is returned
+	Response *http.Response
+}
+
+func (e *AuthorizationError) Error() string {
+	return "authorization denied after " + e.Scheme + " authentication"
+}
+
+// Is makes errors.Is(err, ErrAuthorizationDenied) report AuthorizationError
+func (e *AuthorizationError) Is(target error) bool {
+	return target == ErrAuthorizationDenied
+}
+
+// authorizationDenied returns AuthorizationError if resp is 403 to req which was authenticated, nil otherwise
+func (t *NtlmTransport) authorizationDenied(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	info := handshakeInfoOf(req.Context()).get()
+	if info.Scheme == "" {
+		return nil
+	}
+
+	if _, err := t.bufferBody(resp); err != nil {
+		return err
+	}
+	t.log(req.Context(), "authorization denied", "host", hostKey(req.URL), "scheme", info.Scheme)
+	return &AuthorizationError{Scheme: info.Scheme, Response: resp}
+}
@@ -0,0 +1,57 @@
+package httpntlm
+
+import (
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// Backend computes NTLM messages, it lets alternative NTLM implementations or platform security packages
+// such as SSPI replace the go-ntlm dependency, see NtlmTransport.Backend. Challenges are still parsed
+// by the transport for its own checks, e.g. the NTLMv1 downgrade check and TargetPolicy.
+type Backend interface {
+	// NewSession starts a handshake authenticating creds
+	NewSession(creds Credentials) (Session, error)
+}
+
+// Session computes messages of a single handshake, it's discarded once the authenticate message is sent
+type Session interface {
+	// Negotiate returns negotiate message
+	Negotiate() ([]byte, error)
+	// Authenticate returns authenticate message answering challenge message
+	Authenticate(challenge []byte) ([]byte, error)
+}
+
+// backend returns Backend computing the messages, transport's own implementation is used by default
+func (t *NtlmTransport) backend() Backend {
+	if t.Backend != nil {
+		return t.Backend
+	}
+	return transportBackend{t}
+}
+
+// transportBackend computes messages with go-ntlm, or with Crypto if transport has it set
+type transportBackend struct {
+	t *NtlmTransport
+}
+
+func (b transportBackend) NewSession(creds Credentials) (Session, error) {
+	return &transportSession{t: b.t, creds: creds}, nil
+}
+
+type transportSession struct {
+	t     *NtlmTransport
+	creds Credentials
+	// binding is set for origins when ExtendedProtection is
+	binding *channelBinding
+}
+
+func (s *transportSession) Negotiate() ([]byte, error) {
+	return Negotiate(), nil
+}
+
+func (s *transportSession) Authenticate(challenge []byte) ([]byte, error) {
+	c, err := ntlm.ParseChallengeMessage(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return s.t.authenticateMessage(s.creds, c, s.binding)
+}
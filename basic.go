@@ -0,0 +1,54 @@
+package httpntlm
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+)
+
+// basicRoundTrip sends req with Basic credentials, user name is qualified by domain as IIS expects
+func (t *NtlmTransport) basicRoundTrip(client http.Client, req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Header.Set(t.authorizationHeader(), "Basic "+base64.StdEncoding.EncodeToString([]byte(basicUser(t.Domain, t.User)+":"+t.Password)))
+
+	resp, err := t.do(client, withStage(r, StageBasic))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		handshakeInfoOf(req.Context()).update(func(info *HandshakeInfo) {
+			info.Scheme = SchemeBasic
+		})
+	}
+	return resp, nil
+}
+
+// basicUser returns user name qualified by domain unless it's empty
+func basicUser(domain, user string) string {
+	if domain == "" {
+		return user
+	}
+	return domain + `\` + user
+}
+
+// proxyBasic reports whether ProxyCredentials are sent to the proxy with Basic scheme
+func (t *NtlmTransport) proxyBasic() bool {
+	return t.ProxyCredentials != nil && canonicalScheme(t.ProxyScheme) == SchemeBasic
+}
+
+// basicProxy wraps proxy func so that proxy URLs carry creds, http.Transport sends them as Basic
+// Proxy-Authorization with every request to the proxy and CONNECT, leaving Authorization to the origin handshake
+func basicProxy(proxy func(*http.Request) (*url.URL, error), creds Credentials) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil {
+			return u, err
+		}
+		withCreds := *u
+		withCreds.User = url.UserPassword(basicUser(creds.Domain, creds.User), creds.Password)
+		return &withCreds, nil
+	}
+}
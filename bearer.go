@@ -0,0 +1,113 @@
+package httpntlm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TokenSource supplies OAuth bearer tokens, empty token means none is available
+// and the request is authenticated with NTLM
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenSourceFunc adapts ordinary function to TokenSource
+type TokenSourceFunc func(ctx context.Context) (string, error)
+
+// Token calls f(ctx)
+func (f TokenSourceFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// bearerRoundTrip sends request with bearer token, ok is false if NTLM has to be used instead
+func (t *NtlmTransport) bearerRoundTrip(client http.Client, req *http.Request) (resp *http.Response, ok bool, err error) {
+	key := hostKey(req.URL)
+	if t.TokenSource == nil || !t.bearerHost(req.URL, key) {
+		return nil, false, nil
+	}
+
+	token, err := t.TokenSource.Token(req.Context())
+	if err != nil || token == "" {
+		return nil, false, err
+	}
+
+	// request is sent once more with NTLM if the token is rejected
+	r, ok, err := replayRequest(req)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	r.Header.Set(t.authorizationHeader(), "Bearer "+token)
+
+	resp, err = t.do(client, withStage(r, StageBearer))
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		handshakeInfoOf(req.Context()).update(func(info *HandshakeInfo) {
+			info.Scheme = "Bearer"
+		})
+		return resp, true, nil
+	}
+
+	schemes := parseSchemes(resp.Header.Values(t.challengeHeader()))
+	t.rememberBearer(key, schemes)
+	t.log(req.Context(), "bearer token rejected, falling back to NTLM", "schemes", strings.Join(schemes, ","))
+	return nil, false, t.discardBody(resp)
+}
+
+// bearerHost reports whether token may be sent to u with key, it never goes over plain http nor to hosts
+// which neither are configured nor offered Bearer scheme, so it doesn't leak to third parties and redirect targets
+func (t *NtlmTransport) bearerHost(u *url.URL, key string) bool {
+	if !strings.EqualFold(u.Scheme, "https") {
+		return false
+	}
+	info := t.authCache().get(key)
+	if info.noBearer {
+		return false
+	}
+	if info.bearer {
+		return true
+	}
+	for _, host := range t.BearerHosts {
+		if hostMatcher(host)(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// offersBearer reports whether Bearer is one of schemes
+func offersBearer(schemes []string) bool {
+	for _, s := range schemes {
+		if strings.EqualFold(s, "Bearer") {
+			return true
+		}
+	}
+	return false
+}
+
+// learnBearer records that host offered Bearer scheme if any of its challenges does
+func (t *NtlmTransport) learnBearer(key string, challenges []string) {
+	if t.TokenSource == nil || !offersBearer(parseSchemes(challenges)) {
+		return
+	}
+	cache := t.authCache()
+	info := cache.get(key)
+	if !info.bearer || info.noBearer {
+		info.bearer, info.noBearer = true, false
+		cache.set(key, info)
+	}
+}
+
+// rememberBearer records whether host offers Bearer scheme according to schemes of its 401 response
+// to bearer token
+func (t *NtlmTransport) rememberBearer(key string, schemes []string) {
+	offered := offersBearer(schemes)
+
+	cache := t.authCache()
+	info := cache.get(key)
+	info.bearer, info.noBearer = offered, len(schemes) > 0 && !offered
+	cache.set(key, info)
+}
@@ -0,0 +1,61 @@
+package httpntlm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RetryBudget limits how many handshake retries may happen within a time window, it protects
+// domain controllers from retry storms e.g. when credentials are wrong fleet-wide.
+// Budget can be shared by several transports, zero value imposes no limits.
+type RetryBudget struct {
+	// Window is the length of the time window, a minute is used if zero
+	Window time.Duration
+	// Global is the number of retries allowed within the window across all hosts, zero means no limit
+	Global int
+	// PerHost is the number of retries allowed within the window for a single host, zero means no limit
+	PerHost int
+
+	mu      sync.Mutex
+	started time.Time
+	global  int
+	hosts   map[string]int
+}
+
+// allow takes one retry out of the budget, false if the budget is exhausted
+func (b *RetryBudget) allow(host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	window := b.Window
+	if window <= 0 {
+		window = time.Minute
+	}
+	if b.hosts == nil || now.Sub(b.started) >= window {
+		b.started = now
+		b.global = 0
+		b.hosts = map[string]int{}
+	}
+
+	if b.Global > 0 && b.global >= b.Global {
+		return false
+	}
+	if b.PerHost > 0 && b.hosts[host] >= b.PerHost {
+		return false
+	}
+	b.global++
+	b.hosts[host]++
+	return true
+}
+
+// allowRetry reports whether handshake of request to host may be retried
+func (t *NtlmTransport) allowRetry(ctx context.Context, host string) bool {
+	if t.RetryBudget == nil || t.RetryBudget.allow(host, time.Now()) {
+		return true
+	}
+
+	t.log(ctx, "retry budget exhausted", "host", host)
+	t.inc(ctx, MetricRetryBudgetExhausted, map[string]string{"host": host})
+	return false
+}
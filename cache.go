@@ -0,0 +1,141 @@
+package httpntlm
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostInfo is what transport has learned about authentication on a particular host
+type hostInfo struct {
+	// persistentAuth is set when server reported that authentication persists on the connection
+	persistentAuth bool
+	// connectionless is set when server issues challenges in connectionless mode,
+	// otherwise authentication is bound to the connection
+	connectionless bool
+	// ntlmOnly is set when server offered NTLM as the only authentication scheme
+	ntlmOnly bool
+	// bearer is set when server offered Bearer scheme in a challenge
+	bearer bool
+	// noBearer is set when server answered bearer token with 401 not offering Bearer scheme
+	noBearer bool
+	// authenticated is set when server accepted the credentials last time
+	authenticated bool
+	// scheme is the authentication scheme chosen for the host, empty until the host is probed
+	scheme string
+	// learned is when the knowledge was last updated
+	learned time.Time
+}
+
+// authCache keeps per host authentication knowledge
+type authCache struct {
+	mu    sync.Mutex
+	hosts map[string]hostInfo
+	// ttl is how long knowledge is kept, forever if zero
+	ttl time.Duration
+	// store keeps knowledge shared with other transports, nil if there's none
+	store Store
+}
+
+func newAuthCache() *authCache {
+	return &authCache{hosts: map[string]hostInfo{}}
+}
+
+func (c *authCache) get(key string) hostInfo {
+	c.mu.Lock()
+	info, ok := c.hosts[key]
+	if ok && c.expired(info) {
+		delete(c.hosts, key)
+		info, ok = hostInfo{}, false
+	}
+	store := c.store
+	c.mu.Unlock()
+	if ok || store == nil {
+		return info
+	}
+
+	// store is consulted without holding the lock
+	info, ok = loadHostInfo(store, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok || c.expired(info) {
+		return hostInfo{}
+	}
+	if _, learned := c.hosts[key]; !learned {
+		c.hosts[key] = info
+	}
+	return c.hosts[key]
+}
+
+func (c *authCache) set(key string, info hostInfo) {
+	c.mu.Lock()
+	info.learned = time.Now()
+	old, known := c.hosts[key]
+	c.hosts[key] = info
+	store, ttl := c.store, c.ttl
+	c.mu.Unlock()
+
+	if store != nil && (!known || shared(old, info)) {
+		saveHostInfo(store, key, info, ttl)
+	}
+}
+
+// remove forgets hosts with matching keys, they are deleted from store too
+func (c *authCache) remove(match func(key string) bool) {
+	c.mu.Lock()
+	var removed []string
+	for key := range c.hosts {
+		if match(key) {
+			delete(c.hosts, key)
+			removed = append(removed, key)
+		}
+	}
+	store := c.store
+	c.mu.Unlock()
+
+	if store != nil {
+		for _, key := range removed {
+			_ = store.Delete(key)
+		}
+	}
+}
+
+func (c *authCache) expired(info hostInfo) bool {
+	return c.ttl > 0 && time.Since(info.learned) >= c.ttl
+}
+
+// authCache returns transport's per host cache
+func (t *NtlmTransport) authCache() *authCache {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cache == nil {
+		t.cache = newAuthCache()
+	}
+	t.cache.mu.Lock()
+	t.cache.ttl = t.CacheTTL
+	t.cache.store = t.CacheStore
+	t.cache.mu.Unlock()
+	return t.cache
+}
+
+// hostKey returns cache key of the host u points to
+func hostKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+
+	// zone of IPv6 literal is escaped so that the key parses back as URL
+	host := strings.Replace(hostName(u.Hostname()), "%", "%25", 1)
+	return strings.ToLower(u.Scheme) + "://" + net.JoinHostPort(host, port)
+}
+
+// defaultPort returns port of URL scheme which URLs without port point to
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
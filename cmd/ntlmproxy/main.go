@@ -0,0 +1,105 @@
+// Command ntlmproxy is a local HTTP proxy which authenticates requests upstream with NTLM,
+// so tools without NTLM support can point at localhost instead.
+//
+// Plain HTTP requests are authenticated to origin servers and to the upstream proxy, CONNECT tunnels
+// are authenticated to the upstream proxy only since their traffic is opaque. Passwords are read
+// from environment variables to keep them out of process listings.
+//
+//	NTLM_PASSWORD=secret ntlmproxy -domain CORP -user jdoe -proxy http://proxy.corp.example.com:8080
+//	http_proxy=http://127.0.0.1:3128 curl http://intranet.corp.example.com/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:3128", "address to listen on")
+	configFile := flag.String("config", "", "JSON transport configuration as in httpntlm.Config, replaces the origin credential flags")
+	domain := flag.String("domain", "", "domain of the user")
+	user := flag.String("user", "", "user name")
+	workstation := flag.String("workstation", "", "workstation name sent to servers")
+	passwordEnv := flag.String("password-env", "NTLM_PASSWORD", "environment variable holding the password")
+	upstream := flag.String("proxy", "", "upstream proxy URL, e.g. http://proxy.example.com:8080")
+	proxyDomain := flag.String("proxy-domain", "", "domain of the upstream proxy user, origin credentials are used if proxy-user isn't set")
+	proxyUser := flag.String("proxy-user", "", "upstream proxy user name")
+	proxyPasswordEnv := flag.String("proxy-password-env", "NTLM_PROXY_PASSWORD", "environment variable holding the upstream proxy password")
+	maxBody := flag.Int64("max-body", defaultMaxBody, "largest request body in bytes, bodies are buffered to be replayed during the handshake")
+	flag.Parse()
+
+	cfg := httpntlm.Config{
+		Domain:      *domain,
+		User:        *user,
+		Workstation: *workstation,
+		PasswordEnv: *passwordEnv,
+	}
+	if *configFile != "" {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg = httpntlm.Config{}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			log.Fatalf("invalid config %s: %v", *configFile, err)
+		}
+	}
+
+	var proxyCreds *httpntlm.Credentials
+	if *proxyUser != "" {
+		password, ok := os.LookupEnv(*proxyPasswordEnv)
+		if !ok {
+			log.Fatalf("proxy password environment variable %s is not set", *proxyPasswordEnv)
+		}
+		proxyCreds = &httpntlm.Credentials{Domain: *proxyDomain, User: *proxyUser, Password: password, Workstation: cfg.Workstation}
+	}
+
+	// proxy credentials authenticate origin servers too if they're the only ones
+	if cfg.User == "" && proxyCreds != nil {
+		cfg.Domain, cfg.User, cfg.Password, cfg.PasswordEnv = proxyCreds.Domain, proxyCreds.User, proxyCreds.Password, ""
+	}
+
+	p, err := newProxy(cfg, *upstream, proxyCreds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.maxBody = *maxBody
+
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, p))
+}
+
+// newProxy returns proxy authenticating as cfg describes through upstream proxy unless it's empty,
+// origin credentials are used for the upstream proxy if proxyCreds is nil
+func newProxy(cfg httpntlm.Config, upstream string, proxyCreds *httpntlm.Credentials) (*proxy, error) {
+	t, err := httpntlm.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if upstream == "" {
+		return &proxy{transport: t}, nil
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("upstream proxy %q must be an http:// URL", upstream)
+	}
+	if proxyCreds == nil {
+		proxyCreds = &httpntlm.Credentials{Domain: t.Domain, User: t.User, Password: t.Password, Workstation: t.Workstation}
+	}
+	t.ProxyCredentials = proxyCreds
+	base := httpntlm.NewBaseTransport()
+	base.Proxy = http.ProxyURL(u)
+	t.RoundTripper = base
+	return &proxy{transport: t, upstream: u}, nil
+}
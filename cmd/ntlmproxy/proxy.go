@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// hopHeaders are meant for a single connection and aren't forwarded, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// proxy forwards requests of local clients authenticating them with NTLM
+type proxy struct {
+	transport *httpntlm.NtlmTransport
+	// upstream is the proxy requests are sent through, they go straight to origin servers if nil
+	upstream *url.URL
+	// maxBody is the largest request body buffered for replay, defaultMaxBody if zero
+	maxBody int64
+}
+
+// defaultMaxBody is the largest request body buffered by default
+const defaultMaxBody = 10 << 20
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "ntlmproxy: absolute request URL expected, configure ntlmproxy as HTTP proxy", http.StatusBadRequest)
+		return
+	}
+
+	// body is buffered so that it can be replayed during the handshake
+	maxBody := p.maxBody
+	if maxBody == 0 {
+		maxBody = defaultMaxBody
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("ntlmproxy: request body exceeds %d bytes", maxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Close = false
+	removeHopHeaders(out.Header)
+	out.ContentLength = int64(len(body))
+	out.Body = http.NoBody
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if len(body) > 0 {
+		out.Body, _ = out.GetBody()
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "ntlmproxy: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+// removeHopHeaders removes hop-by-hop headers including those listed in Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// tunnel connects client to r.Host, through upstream proxy if there's one
+func (p *proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "ntlmproxy: tunneling isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	var conn net.Conn
+	var err error
+	if p.upstream == nil {
+		conn, err = dialer.DialContext(r.Context(), "tcp", r.Host)
+	} else {
+		conn, err = p.transport.DialTunnel(r.Context(), p.upstream, r.Host)
+	}
+	if err != nil {
+		log.Printf("CONNECT %s: %v", r.Host, err)
+		http.Error(w, "ntlmproxy: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		log.Printf("CONNECT %s: %v", r.Host, err)
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		conn.Close()
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, conn)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	conn.Close()
+	<-done
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// ntlmToken returns type of NTLM message in header h and the message
+func ntlmToken(h string) (byte, []byte) {
+	b, _ := httpntlm.DecBase64(strings.TrimPrefix(h, "NTLM "))
+	if len(b) < 9 {
+		return 0, nil
+	}
+	return b[8], b
+}
+
+func Test_Forward(t *testing.T) {
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch kind, b := ntlmToken(r.Header.Get("Authorization")); kind {
+		case 1:
+			challenge, _ := session.GenerateChallengeMessage()
+			w.Header().Set("WWW-Authenticate", "NTLM "+httpntlm.EncBase64(challenge.Bytes()))
+			w.WriteHeader(http.StatusUnauthorized)
+		case 3:
+			auth, err := ntlm.ParseAuthenticateMessage(b, 2)
+			if err != nil || session.ProcessAuthenticateMessage(auth) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Write(append([]byte("hello "), body...))
+		default:
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer origin.Close()
+
+	p, err := newProxy(httpntlm.Config{Domain: "dt", User: "testuser", Password: "fish"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	proxyURL, _ := url.Parse(ps.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(origin.URL, "text/plain", strings.NewReader("proxy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello proxy" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+}
+
+func Test_ForwardBodyLimit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("oversized body was forwarded")
+	}))
+	defer origin.Close()
+
+	p, err := newProxy(httpntlm.Config{Domain: "dt", User: "testuser", Password: "fish"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.maxBody = 4
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	proxyURL, _ := url.Parse(ps.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(origin.URL, "text/plain", strings.NewReader("proxy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Tunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+		session.SetUserInfo("proxyuser", "secret", "dt", "")
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.Method != http.MethodConnect || req.Host != "origin.example.com:443" {
+				t.Errorf("unexpected request %s %s", req.Method, req.Host)
+				return
+			}
+			switch kind, b := ntlmToken(req.Header.Get("Proxy-Authorization")); kind {
+			case 1:
+				challenge, _ := session.GenerateChallengeMessage()
+				// scheme names are case insensitive
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: ntlm "+
+					httpntlm.EncBase64(challenge.Bytes())+"\r\nContent-Length: 0\r\n\r\n")
+			case 3:
+				auth, err := ntlm.ParseAuthenticateMessage(b, 2)
+				if err != nil || session.ProcessAuthenticateMessage(auth) != nil {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				// echo tunneled bytes
+				io.Copy(conn, br)
+				return
+			default:
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\", ntlm\r\nContent-Length: 0\r\n\r\n")
+			}
+		}
+	}()
+
+	p, err := newProxy(httpntlm.Config{Domain: "dt", User: "testuser", Password: "fish"}, "http://"+l.Addr().String(),
+		&httpntlm.Credentials{Domain: "dt", User: "proxyuser", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", ps.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT origin.example.com:443 HTTP/1.1\r\nHost: origin.example.com:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected CONNECT status %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("expected echo through the tunnel, got %q %v", b, err)
+	}
+}
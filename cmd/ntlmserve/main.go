@@ -0,0 +1,95 @@
+// Command ntlmserve is an HTTP server demanding NTLM authentication, meant for integration tests
+// of NTLM clients in CI pipelines.
+//
+// Users are given with -user flags or a file of DOMAIN\user:password lines, any credentials are accepted
+// with -accept-any. Challenge negotiate flags can be adjusted and failures injected at random:
+//
+//	ntlmserve -listen :8080 -user 'CORP\jdoe:secret' -flags=-key_exchange,+lm_key -reject-rate 0.1
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// userFlags collects repeated -user flags
+type userFlags []string
+
+func (u *userFlags) String() string {
+	return strings.Join(*u, ",")
+}
+
+func (u *userFlags) Set(v string) error {
+	*u = append(*u, v)
+	return nil
+}
+
+func main() {
+	var users userFlags
+	listen := flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	flag.Var(&users, "user", `accepted DOMAIN\user:password, can be repeated`)
+	usersFile := flag.String("users", "", `file of accepted DOMAIN\user:password lines`)
+	acceptAny := flag.Bool("accept-any", false, "accept any credentials")
+	version := flag.Int("version", 2, "NTLM version of the challenges, 1 or 2")
+	flags := flag.String("flags", "", "comma separated negotiate flags to set with + or clear with - prefix, e.g. -key_exchange,+lm_key")
+	persistent := flag.Bool("persistent-auth", false, "keep connections authenticated and send Persistent-Auth header")
+	rejectRate := flag.Float64("reject-rate", 0, "probability of rejecting valid credentials")
+	emptyChallengeRate := flag.Float64("empty-challenge-rate", 0, "probability of answering negotiate message without challenge")
+	closeRate := flag.Float64("close-rate", 0, "probability of closing the connection after sending challenge")
+	certFile := flag.String("cert", "", "TLS certificate file, server uses plain HTTP if not set")
+	keyFile := flag.String("key", "", "TLS key file")
+	flag.Parse()
+
+	s := &server{
+		acceptAny:          *acceptAny,
+		persistent:         *persistent,
+		rejectRate:         *rejectRate,
+		emptyChallengeRate: *emptyChallengeRate,
+		closeRate:          *closeRate,
+	}
+	switch *version {
+	case 1:
+		s.version = ntlm.Version1
+	case 2:
+		s.version = ntlm.Version2
+	default:
+		log.Fatalf("unsupported NTLM version %d", *version)
+	}
+	var err error
+	if s.setFlags, s.clearFlags, err = parseFlags(*flags); err != nil {
+		log.Fatal(err)
+	}
+	if *usersFile != "" {
+		if s.users, err = readUsers(*usersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, u := range users {
+		if err := s.addUser(u); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(s.users) == 0 && !s.acceptAny {
+		log.Fatal("no users, set -user, -users or -accept-any")
+	}
+
+	srv := &http.Server{
+		Addr:    *listen,
+		Handler: s,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				s.forget(conn.RemoteAddr().String())
+			}
+		},
+	}
+	log.Printf("listening on %s", *listen)
+	if *certFile != "" {
+		log.Fatal(srv.ListenAndServeTLS(*certFile, *keyFile))
+	}
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// negotiateFlags are flags -flags adjusts, named like labels of httpntlm.MetricChallengeFlags
+var negotiateFlags = map[string]ntlm.NegotiateFlag{
+	"extended_session_security": ntlm.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY,
+	"target_info":               ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO,
+	"128bit":                    ntlm.NTLMSSP_NEGOTIATE_128,
+	"56bit":                     ntlm.NTLMSSP_NEGOTIATE_56,
+	"key_exchange":              ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH,
+	"signing":                   ntlm.NTLMSSP_NEGOTIATE_SIGN,
+	"sealing":                   ntlm.NTLMSSP_NEGOTIATE_SEAL,
+	"lm_key":                    ntlm.NTLMSSP_NEGOTIATE_LM_KEY,
+	"version":                   ntlm.NTLMSSP_NEGOTIATE_VERSION,
+}
+
+// parseFlags parses comma separated flag names prefixed with + to set or - to clear them
+func parseFlags(s string) (set, clear uint32, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		flag, ok := negotiateFlags[strings.TrimLeft(f, "+-")]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown negotiate flag %q", f)
+		}
+		switch f[0] {
+		case '+':
+			set = flag.Set(set)
+		case '-':
+			clear = flag.Set(clear)
+		default:
+			return 0, 0, fmt.Errorf("negotiate flag %q must be prefixed with + or -", f)
+		}
+	}
+	return set, clear, nil
+}
+
+// server demands NTLM authentication, handshakes are bound to connections
+type server struct {
+	version    ntlm.Version
+	acceptAny  bool
+	persistent bool
+	setFlags   uint32
+	clearFlags uint32
+	// probabilities of injected failures
+	rejectRate         float64
+	emptyChallengeRate float64
+	closeRate          float64
+	// users maps lowercase DOMAIN\user to passwords
+	users map[string]string
+
+	mu            sync.Mutex
+	sessions      map[string]ntlm.ServerSession
+	authenticated map[string]string
+}
+
+// readUsers reads DOMAIN\user:password lines of file, empty lines and lines starting with # are skipped
+func readUsers(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &server{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.addUser(line); err != nil {
+			return nil, err
+		}
+	}
+	return s.users, scanner.Err()
+}
+
+// addUser adds user given as DOMAIN\user:password, domain is optional
+func (s *server) addUser(v string) error {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return fmt.Errorf(`user %q must be DOMAIN\user:password`, v)
+	}
+	if s.users == nil {
+		s.users = map[string]string{}
+	}
+	s.users[userKey(v[:i])] = v[i+1:]
+	return nil
+}
+
+func userKey(user string) string {
+	if !strings.Contains(user, `\`) {
+		user = `\` + user
+	}
+	return strings.ToLower(user)
+}
+
+func (s *server) fail(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// forget drops handshake state of closed connection
+func (s *server) forget(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, addr)
+	delete(s.authenticated, addr)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := r.RemoteAddr
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = map[string]ntlm.ServerSession{}
+		s.authenticated = map[string]string{}
+	}
+	user, authenticated := s.authenticated[conn]
+	session := s.sessions[conn]
+	s.mu.Unlock()
+
+	token, _ := httpntlm.DecBase64(strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")))
+	switch {
+	case len(token) > 8 && token[8] == 1:
+		s.challenge(w, conn)
+	case len(token) > 8 && token[8] == 3 && session != nil:
+		user, ok := s.authenticate(session, token)
+		if !ok {
+			s.forget(conn)
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			http.Error(w, "logon failed", http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		delete(s.sessions, conn)
+		if s.persistent {
+			s.authenticated[conn] = user
+		}
+		s.mu.Unlock()
+		s.serve(w, r, user)
+	case authenticated && s.persistent:
+		s.serve(w, r, user)
+	default:
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// challenge answers negotiate message sent over connection conn
+func (s *server) challenge(w http.ResponseWriter, conn string) {
+	if s.fail(s.emptyChallengeRate) {
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	session, err := ntlm.CreateServerSession(s.version, ntlm.ConnectionlessMode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	challenge, err := session.GenerateChallengeMessage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	challenge.NegotiateFlags = challenge.NegotiateFlags&^s.clearFlags | s.setFlags
+
+	s.mu.Lock()
+	s.sessions[conn] = session
+	s.mu.Unlock()
+	if s.fail(s.closeRate) {
+		w.Header().Set("Connection", "close")
+	}
+	w.Header().Set("WWW-Authenticate", "NTLM "+httpntlm.EncBase64(challenge.Bytes()))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// authenticate verifies authenticate message against session and returns DOMAIN\user it authenticates
+func (s *server) authenticate(session ntlm.ServerSession, token []byte) (string, bool) {
+	am, err := ntlm.ParseAuthenticateMessage(token, int(s.version))
+	if err != nil {
+		return "", false
+	}
+	user := am.DomainName.String() + `\` + am.UserName.String()
+	if s.fail(s.rejectRate) {
+		return "", false
+	}
+	if s.acceptAny {
+		return user, true
+	}
+
+	password, ok := s.users[userKey(user)]
+	if !ok {
+		if password, ok = s.users[userKey(am.UserName.String())]; !ok {
+			return "", false
+		}
+	}
+	session.SetUserInfo(am.UserName.String(), password, am.DomainName.String(), "")
+	if err := session.ProcessAuthenticateMessage(am); err != nil {
+		return "", false
+	}
+	return user, true
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request, user string) {
+	if s.persistent {
+		w.Header().Set("Persistent-Auth", "true")
+	}
+	fmt.Fprintf(w, "authenticated as %s\n", user)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+func get(t *testing.T, url, user, password string) (int, string) {
+	client := &http.Client{Transport: &httpntlm.NtlmTransport{Domain: "dt", User: user, Password: password}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func Test_Users(t *testing.T) {
+	s := &server{version: ntlm.Version2}
+	if err := s.addUser(`DT\testuser:fish`); err != nil {
+		t.Fatal(err)
+	}
+	s.setFlags, s.clearFlags, _ = parseFlags("-key_exchange,+lm_key")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if status, body := get(t, ts.URL, "testuser", "fish"); status != http.StatusOK || body != "authenticated as dt\\testuser\n" {
+		t.Errorf("unexpected response %d %q", status, body)
+	}
+	if status, _ := get(t, ts.URL, "testuser", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be rejected, got %d", status)
+	}
+	if status, _ := get(t, ts.URL, "nobody", "fish"); status != http.StatusUnauthorized {
+		t.Errorf("expected unknown user to be rejected, got %d", status)
+	}
+}
+
+func Test_AcceptAny(t *testing.T) {
+	s := &server{version: ntlm.Version2, acceptAny: true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if status, _ := get(t, ts.URL, "anyone", "anything"); status != http.StatusOK {
+		t.Errorf("expected any credentials to be accepted, got %d", status)
+	}
+	s.rejectRate = 1
+	if status, _ := get(t, ts.URL, "anyone", "anything"); status != http.StatusUnauthorized {
+		t.Errorf("expected injected rejection, got %d", status)
+	}
+}
+
+func Test_ParseFlags(t *testing.T) {
+	set, clear, err := parseFlags("+lm_key, -sealing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set != uint32(ntlm.NTLMSSP_NEGOTIATE_LM_KEY) || clear != uint32(ntlm.NTLMSSP_NEGOTIATE_SEAL) {
+		t.Errorf("unexpected flags %x %x", set, clear)
+	}
+	if _, _, err := parseFlags("lm_key"); err == nil {
+		t.Error("expected error for flag without prefix")
+	}
+	if _, _, err := parseFlags("+unknown"); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+}
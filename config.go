@@ -0,0 +1,231 @@
+package httpntlm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is a serializable transport configuration which can be loaded from JSON or YAML files,
+// use FromConfig to create the transport out of it
+type Config struct {
+	Domain      string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	User        string `json:"user,omitempty" yaml:"user,omitempty"`
+	Workstation string `json:"workstation,omitempty" yaml:"workstation,omitempty"`
+	// Password is the plain text password, prefer PasswordEnv or PasswordFile to keep secrets out of config files
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// PasswordEnv is the name of environment variable holding the password
+	PasswordEnv string `json:"passwordEnv,omitempty" yaml:"passwordEnv,omitempty"`
+	// PasswordFile is the path of a file holding the password, trailing new line is ignored
+	PasswordFile string `json:"passwordFile,omitempty" yaml:"passwordFile,omitempty"`
+	// NTHash is hex encoded NT hash used instead of password, e.g. of machine account, it's as secret as the password
+	NTHash string `json:"ntHash,omitempty" yaml:"ntHash,omitempty"`
+
+	AuthorizationHeader string `json:"authorizationHeader,omitempty" yaml:"authorizationHeader,omitempty"`
+	ChallengeHeader     string `json:"challengeHeader,omitempty" yaml:"challengeHeader,omitempty"`
+	HandshakeUserAgent  string `json:"handshakeUserAgent,omitempty" yaml:"handshakeUserAgent,omitempty"`
+	// AffinityCookies are names of load balancer sticky session cookies, names ending with * match by prefix
+	AffinityCookies []string `json:"affinityCookies,omitempty" yaml:"affinityCookies,omitempty"`
+
+	EmptyChallengeRetries    int      `json:"emptyChallengeRetries,omitempty" yaml:"emptyChallengeRetries,omitempty"`
+	EmptyChallengeRetryDelay Duration `json:"emptyChallengeRetryDelay,omitempty" yaml:"emptyChallengeRetryDelay,omitempty"`
+	MaxRechallenges          int      `json:"maxRechallenges,omitempty" yaml:"maxRechallenges,omitempty"`
+	MaxThrottleRetries       int      `json:"maxThrottleRetries,omitempty" yaml:"maxThrottleRetries,omitempty"`
+	MaxRetryAfter            Duration `json:"maxRetryAfter,omitempty" yaml:"maxRetryAfter,omitempty"`
+	MaxRetries               int      `json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`
+	RetryNonIdempotent       bool     `json:"retryNonIdempotent,omitempty" yaml:"retryNonIdempotent,omitempty"`
+	DisableStaleRetry        bool     `json:"disableStaleRetry,omitempty" yaml:"disableStaleRetry,omitempty"`
+	MaxDownloadResumes       int      `json:"maxDownloadResumes,omitempty" yaml:"maxDownloadResumes,omitempty"`
+	MaxDrainBytes            int64    `json:"maxDrainBytes,omitempty" yaml:"maxDrainBytes,omitempty"`
+	AnnotateRoundTrips       bool     `json:"annotateRoundTrips,omitempty" yaml:"annotateRoundTrips,omitempty"`
+	RejectionErrors          bool     `json:"rejectionErrors,omitempty" yaml:"rejectionErrors,omitempty"`
+	AuthorizationErrors      bool     `json:"authorizationErrors,omitempty" yaml:"authorizationErrors,omitempty"`
+	VerboseErrors            bool     `json:"verboseErrors,omitempty" yaml:"verboseErrors,omitempty"`
+	RenewSessions            bool     `json:"renewSessions,omitempty" yaml:"renewSessions,omitempty"`
+	AddressFailover          bool     `json:"addressFailover,omitempty" yaml:"addressFailover,omitempty"`
+	CacheTTL                 Duration `json:"cacheTTL,omitempty" yaml:"cacheTTL,omitempty"`
+	ClockSkew                Duration `json:"clockSkew,omitempty" yaml:"clockSkew,omitempty"`
+	MaxClockSkew             Duration `json:"maxClockSkew,omitempty" yaml:"maxClockSkew,omitempty"`
+	// HeartbeatInterval enables heartbeats over idle connections, see Heartbeat
+	HeartbeatInterval Duration `json:"heartbeatInterval,omitempty" yaml:"heartbeatInterval,omitempty"`
+	HeartbeatMethod   string   `json:"heartbeatMethod,omitempty" yaml:"heartbeatMethod,omitempty"`
+	HeartbeatPath     string   `json:"heartbeatPath,omitempty" yaml:"heartbeatPath,omitempty"`
+	// Expvar is the name of expvar map the counters are published to, they aren't published if empty
+	Expvar string `json:"expvar,omitempty" yaml:"expvar,omitempty"`
+
+	// MinTLSVersion is the lowest accepted TLS version, e.g. "1.2"
+	MinTLSVersion string `json:"minTLSVersion,omitempty" yaml:"minTLSVersion,omitempty"`
+	// CipherSuites are names of allowed TLS 1.2 and older cipher suites as in crypto/tls
+	CipherSuites []string `json:"cipherSuites,omitempty" yaml:"cipherSuites,omitempty"`
+
+	// NTLMRoutes restrict authentication to matching requests
+	NTLMRoutes []Route `json:"ntlmRoutes,omitempty" yaml:"ntlmRoutes,omitempty"`
+	// Proxies are URLs of forward proxies in the order they are tried
+	Proxies []string `json:"proxies,omitempty" yaml:"proxies,omitempty"`
+	// HostSchemes fix authentication scheme of hosts, other hosts are probed
+	HostSchemes map[string]string `json:"hostSchemes,omitempty" yaml:"hostSchemes,omitempty"`
+	// AllowBasic lets hosts offering only Basic scheme get the password in clear text
+	AllowBasic bool `json:"allowBasic,omitempty" yaml:"allowBasic,omitempty"`
+	// ExtendedProtection binds authentication to the origin's SPN and TLS certificate
+	ExtendedProtection bool `json:"extendedProtection,omitempty" yaml:"extendedProtection,omitempty"`
+	// HostSPNs override service principal names derived from hosts
+	HostSPNs map[string]string `json:"hostSPNs,omitempty" yaml:"hostSPNs,omitempty"`
+	// PrivateResponses marks authenticated responses private for caches wrapping the transport
+	PrivateResponses bool `json:"privateResponses,omitempty" yaml:"privateResponses,omitempty"`
+
+	// timeouts of the underlying http.Transport, http.DefaultTransport settings are used for zero values
+	DialTimeout           Duration `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"`
+	IdleConnTimeout       Duration `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty"`
+}
+
+// Duration is time.Duration which is serialized as a string like "1m30s"
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FromConfig creates transport out of cfg, resulting transport is validated
+func FromConfig(cfg Config) (*NtlmTransport, error) {
+	password, err := cfg.password()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &NtlmTransport{
+		Domain:                   cfg.Domain,
+		User:                     cfg.User,
+		Password:                 password,
+		NTHash:                   cfg.NTHash,
+		Workstation:              cfg.Workstation,
+		AuthorizationHeader:      cfg.AuthorizationHeader,
+		ChallengeHeader:          cfg.ChallengeHeader,
+		HandshakeUserAgent:       cfg.HandshakeUserAgent,
+		EmptyChallengeRetries:    cfg.EmptyChallengeRetries,
+		EmptyChallengeRetryDelay: time.Duration(cfg.EmptyChallengeRetryDelay),
+		MaxRechallenges:          cfg.MaxRechallenges,
+		MaxThrottleRetries:       cfg.MaxThrottleRetries,
+		MaxRetryAfter:            time.Duration(cfg.MaxRetryAfter),
+		MaxRetries:               cfg.MaxRetries,
+		RetryNonIdempotent:       cfg.RetryNonIdempotent,
+		DisableStaleRetry:        cfg.DisableStaleRetry,
+		MaxDownloadResumes:       cfg.MaxDownloadResumes,
+		MaxDrainBytes:            cfg.MaxDrainBytes,
+		AnnotateRoundTrips:       cfg.AnnotateRoundTrips,
+		RejectionErrors:          cfg.RejectionErrors,
+		AuthorizationErrors:      cfg.AuthorizationErrors,
+		VerboseErrors:            cfg.VerboseErrors,
+		RenewSessions:            cfg.RenewSessions,
+		AddressFailover:          cfg.AddressFailover,
+		AffinityCookies:          cfg.AffinityCookies,
+		NTLMRoutes:               cfg.NTLMRoutes,
+		HostSchemes:              cfg.HostSchemes,
+		AllowBasic:               cfg.AllowBasic,
+		ExtendedProtection:       cfg.ExtendedProtection,
+		HostSPNs:                 cfg.HostSPNs,
+		PrivateResponses:         cfg.PrivateResponses,
+		CacheTTL:                 time.Duration(cfg.CacheTTL),
+		ClockSkew:                time.Duration(cfg.ClockSkew),
+		MaxClockSkew:             time.Duration(cfg.MaxClockSkew),
+	}
+
+	if cfg.HeartbeatInterval != 0 {
+		t.Heartbeat = &Heartbeat{
+			Interval: time.Duration(cfg.HeartbeatInterval),
+			Method:   cfg.HeartbeatMethod,
+			Path:     cfg.HeartbeatPath,
+		}
+	}
+
+	if cfg.Expvar != "" {
+		t.Metrics = NewExpvarMetrics(cfg.Expvar)
+	}
+
+	minTLSVersion, err := parseTLSVersion(cfg.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proxy := range cfg.Proxies {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		t.Proxies = append(t.Proxies, u)
+	}
+
+	if cfg.DialTimeout != 0 || cfg.TLSHandshakeTimeout != 0 || cfg.ResponseHeaderTimeout != 0 || cfg.IdleConnTimeout != 0 {
+		tr := cfg.httpTransport()
+		applyTLSPolicy(tr, minTLSVersion, cipherSuites)
+		t.RoundTripper = tr
+	} else {
+		t.MinTLSVersion, t.CipherSuites = minTLSVersion, cipherSuites
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (cfg Config) password() (string, error) {
+	switch {
+	case cfg.PasswordEnv != "":
+		password, ok := os.LookupEnv(cfg.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("password environment variable %s is not set", cfg.PasswordEnv)
+		}
+		return password, nil
+	case cfg.PasswordFile != "":
+		b, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("can't read password file: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	return cfg.Password, nil
+}
+
+func (cfg Config) httpTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.DialTimeout != 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(cfg.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if cfg.TLSHandshakeTimeout != 0 {
+		tr.TLSHandshakeTimeout = time.Duration(cfg.TLSHandshakeTimeout)
+	}
+	if cfg.ResponseHeaderTimeout != 0 {
+		tr.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout)
+	}
+	if cfg.IdleConnTimeout != 0 {
+		tr.IdleConnTimeout = time.Duration(cfg.IdleConnTimeout)
+	}
+
+	return tr
+}
@@ -0,0 +1,249 @@
+package httpntlm
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// connPool hands out transports holding at most one connection per host. All legs of a handshake,
+// as well as later requests relying on authentication of the connection, are sent through the same one.
+type connPool struct {
+	mu      sync.Mutex
+	of      *http.Transport
+	maxIdle int
+	// limits raise maxIdle of hosts warmed up with more connections, see Warmup
+	limits map[string]int
+	idle   map[string][]*http.Transport
+}
+
+func newConnPool(base *http.Transport) *connPool {
+	maxIdle := base.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+
+	return &connPool{
+		of:      base,
+		maxIdle: maxIdle,
+		idle:    map[string][]*http.Transport{},
+	}
+}
+
+// get returns transport for exclusive use, the most recently used one goes first,
+// fresh reports that it doesn't hold any connection yet
+func (p *connPool) get(key string) (tr *http.Transport, fresh bool) {
+	p.mu.Lock()
+	if idle := p.idle[key]; len(idle) > 0 {
+		tr := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		p.mu.Unlock()
+		return tr, false
+	}
+	p.mu.Unlock()
+	return p.fresh(), true
+}
+
+// fresh returns new transport which doesn't hold any connection yet
+func (p *connPool) fresh() *http.Transport {
+	// keep-alives are enabled even if base disables them,
+	// closing the connection would discard its authentication
+	tr := p.of.Clone()
+	tr.DisableKeepAlives = false
+	tr.MaxConnsPerHost = 1
+	tr.MaxIdleConnsPerHost = 1
+	return tr
+}
+
+// oldest returns the least recently used idle transport of host with key, nil if there isn't any
+func (p *connPool) oldest(key string) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.idle[key]
+	if len(idle) == 0 {
+		return nil
+	}
+	tr := idle[0]
+	p.idle[key] = idle[1:]
+	return tr
+}
+
+// idleCounts returns numbers of idle transports per host key
+func (p *connPool) idleCounts() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[string]int, len(p.idle))
+	for key, idle := range p.idle {
+		counts[key] = len(idle)
+	}
+	return counts
+}
+
+// put returns transport obtained by get, transports over the idle limit are closed
+func (p *connPool) put(key string, tr *http.Transport) {
+	p.mu.Lock()
+	if len(p.idle[key]) >= p.limit(key) {
+		p.mu.Unlock()
+		tr.CloseIdleConnections()
+		return
+	}
+	p.idle[key] = append(p.idle[key], tr)
+	p.mu.Unlock()
+}
+
+// limit returns how many idle transports of host with key are kept, p.mu must be held
+func (p *connPool) limit(key string) int {
+	if n := p.limits[key]; n > p.maxIdle {
+		return n
+	}
+	return p.maxIdle
+}
+
+// raiseLimit keeps at least n idle transports of host with key
+func (p *connPool) raiseLimit(key string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n <= p.limit(key) {
+		return
+	}
+	if p.limits == nil {
+		p.limits = map[string]int{}
+	}
+	p.limits[key] = n
+}
+
+// closeHosts closes idle transports of hosts with matching keys
+func (p *connPool) closeHosts(match func(key string) bool) {
+	var closing []*http.Transport
+	p.mu.Lock()
+	for key, transports := range p.idle {
+		if match(key) {
+			closing = append(closing, transports...)
+			delete(p.idle, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, tr := range closing {
+		tr.CloseIdleConnections()
+	}
+}
+
+func (p *connPool) closeIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = map[string][]*http.Transport{}
+	p.mu.Unlock()
+
+	for _, transports := range idle {
+		for _, tr := range transports {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+// connPool returns pool of connections established with base
+func (t *NtlmTransport) connPool(base *http.Transport) *connPool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pool == nil || t.pool.of != base {
+		if t.pool != nil {
+			t.pool.closeIdle()
+		}
+		t.pool = newConnPool(base)
+	}
+	t.startHeartbeat()
+	return t.pool
+}
+
+// keepConnection returns req without Connection: close, closing the connection would discard its authentication
+func keepConnection(req *http.Request) *http.Request {
+	tokens := req.Header.Values("Connection")
+	closing := false
+	for _, v := range tokens {
+		if hasToken(v, "close") {
+			closing = true
+		}
+	}
+	if !req.Close && !closing {
+		return req
+	}
+
+	r := req.Clone(req.Context())
+	r.Close = false
+	r.Header.Del("Connection")
+	for _, v := range tokens {
+		var keep []string
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" && !strings.EqualFold(token, "close") {
+				keep = append(keep, token)
+			}
+		}
+		if len(keep) > 0 {
+			r.Header.Add("Connection", strings.Join(keep, ", "))
+		}
+	}
+
+	return r
+}
+
+// hasToken reports whether comma separated header value contains token
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberConnectionMode records whether challenge of the host was issued in connectionless mode,
+// otherwise authentication is bound to the connection
+func (t *NtlmTransport) rememberConnectionMode(key string, challenge *ntlm.ChallengeMessage) {
+	cache := t.authCache()
+	info := cache.get(key)
+	info.connectionless = ntlm.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(challenge.NegotiateFlags)
+	cache.set(key, info)
+}
+
+// connTrace records connection request was sent over
+type connTrace struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reused bool
+}
+
+// trace returns shallow copy of r recording its connection
+func (c *connTrace) trace(r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			c.conn, c.reused = info.Conn, info.Reused
+			c.mu.Unlock()
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// stale reports whether request failed with err over the connection it reused, the connection was closed
+// while it was idle unless request itself broke it
+func (c *connTrace) stale(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reused && isConnError(err)
+}
+
+// changed reports whether other request was sent over a different connection than c,
+// false if any of them is unknown
+func (c *connTrace) changed(other *connTrace) bool {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	return conn != nil && other.conn != nil && conn != other.conn
+}
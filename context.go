@@ -0,0 +1,68 @@
+package httpntlm
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	skipNTLMKey contextKey = iota
+	probeKey
+	domainKey
+	workstationKey
+	handshakeInfoKey
+	longRunningKey
+	freshConnKey
+	// proxyIndexKey is index in Proxies the request is sent through
+	proxyIndexKey
+	stageKey
+	correlationIDKey
+)
+
+// WithoutNTLM returns a copy of ctx which makes transport send requests with it
+// straight to the underlying RoundTripper without NTLM authentication
+func WithoutNTLM(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipNTLMKey, true)
+}
+
+func skipNTLM(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipNTLMKey).(bool)
+	return skip
+}
+
+// WithDomain returns a copy of ctx which makes transport authenticate requests with it in domain
+// instead of Domain, e.g. in multi-forest environments where the same user exists in several domains
+func WithDomain(ctx context.Context, domain string) context.Context {
+	return context.WithValue(ctx, domainKey, domain)
+}
+
+// WithWorkstation returns a copy of ctx which makes transport send workstation instead of Workstation
+// with requests using it
+func WithWorkstation(ctx context.Context, workstation string) context.Context {
+	return context.WithValue(ctx, workstationKey, workstation)
+}
+
+// WithLongRunning returns a copy of ctx which marks requests with it as long polls or streams staying open
+// for minutes, e.g. EWS streaming subscriptions or change notification channels. Responses of hosts which bind
+// authentication to the connection may come later than ResponseHeaderTimeout of the underlying http.Transport
+// allows, such requests are sent over connections of their own which are closed once they're done.
+// Shutdown doesn't wait for long running requests.
+func WithLongRunning(ctx context.Context) context.Context {
+	return context.WithValue(ctx, longRunningKey, true)
+}
+
+func longRunning(ctx context.Context) bool {
+	v, _ := ctx.Value(longRunningKey).(bool)
+	return v
+}
+
+// withFreshConnection returns a copy of ctx marking request sent over a connection which isn't authenticated yet
+func withFreshConnection(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshConnKey, true)
+}
+
+func freshConnection(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshConnKey).(bool)
+	return fresh
+}
@@ -0,0 +1,105 @@
+package httpntlm
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+
+	"github.com/sematext/go-ntlm/ntlm/md4"
+)
+
+// CryptoProvider supplies primitives NTLMv2 messages are computed with, e.g. backed by a certified module
+// in FIPS constrained environments, see NtlmTransport.Crypto. Transport answers NTLMv2 challenges only,
+// so DES and plain MD5 of NTLMv1 are never needed.
+type CryptoProvider interface {
+	// MD4 returns MD4 digest of data, it hashes the password
+	MD4(data []byte) []byte
+	// HMACMD5 returns HMAC-MD5 of data with key, it derives response keys and proofs
+	HMACMD5(key, data []byte) []byte
+	// RC4 encrypts data with key, it protects the exchanged session key
+	RC4(key, data []byte) ([]byte, error)
+	// Random fills b with cryptographically secure random bytes, e.g. client challenge
+	Random(b []byte) error
+}
+
+// DefaultCrypto implements CryptoProvider with Go standard library
+var DefaultCrypto CryptoProvider = stdCrypto{}
+
+type stdCrypto struct{}
+
+func (stdCrypto) MD4(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (stdCrypto) HMACMD5(key, data []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (stdCrypto) RC4(key, data []byte) ([]byte, error) {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out, nil
+}
+
+func (stdCrypto) Random(b []byte) error {
+	_, err := rand.Read(b)
+	return err
+}
+
+func (t *NtlmTransport) crypto() CryptoProvider {
+	if t.Crypto != nil {
+		return t.Crypto
+	}
+	return DefaultCrypto
+}
+
+// CryptoFuncs implements CryptoProvider with functions, DefaultCrypto is used for nil ones,
+// so that a single primitive blocked by platform policy, usually MD4, can be replaced alone.
+// DES has no hook since it's used by NTLMv1 only.
+type CryptoFuncs struct {
+	MD4Func     func(data []byte) []byte
+	HMACMD5Func func(key, data []byte) []byte
+	RC4Func     func(key, data []byte) ([]byte, error)
+	RandomFunc  func(b []byte) error
+}
+
+// MD4 calls MD4Func
+func (c CryptoFuncs) MD4(data []byte) []byte {
+	if c.MD4Func != nil {
+		return c.MD4Func(data)
+	}
+	return DefaultCrypto.MD4(data)
+}
+
+// HMACMD5 calls HMACMD5Func
+func (c CryptoFuncs) HMACMD5(key, data []byte) []byte {
+	if c.HMACMD5Func != nil {
+		return c.HMACMD5Func(key, data)
+	}
+	return DefaultCrypto.HMACMD5(key, data)
+}
+
+// RC4 calls RC4Func
+func (c CryptoFuncs) RC4(key, data []byte) ([]byte, error) {
+	if c.RC4Func != nil {
+		return c.RC4Func(key, data)
+	}
+	return DefaultCrypto.RC4(key, data)
+}
+
+// Random calls RandomFunc
+func (c CryptoFuncs) Random(b []byte) error {
+	if c.RandomFunc != nil {
+		return c.RandomFunc(b)
+	}
+	return DefaultCrypto.Random(b)
+}
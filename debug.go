@@ -0,0 +1,91 @@
+package httpntlm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DebugEnv is the environment variable which makes transports log handshake legs to standard error when set to 1,
+// meant for troubleshooting in the field. Tokens are logged as decoded message summaries, credentials never are.
+const DebugEnv = "GOHTTPNTLM_DEBUG"
+
+var (
+	debugEnabled, _ = strconv.ParseBool(os.Getenv(DebugEnv))
+	debugLog        = log.New(os.Stderr, "httpntlm: ", log.LstdFlags|log.Lmicroseconds)
+)
+
+// debugRequest logs request sent in stage when debugging is enabled
+func debugRequest(stage Stage, req *http.Request) {
+	if !debugEnabled {
+		return
+	}
+	debugLog.Printf("> %s %s %s%s", stage, req.Method, redactedURL(req),
+		debugHeaders(req.Header, "Authorization", "Proxy-Authorization"))
+}
+
+// debugResponse logs response received in stage when debugging is enabled
+func debugResponse(stage Stage, resp *http.Response, err error) {
+	if !debugEnabled {
+		return
+	}
+	if err != nil {
+		debugLog.Printf("< %s error: %v", stage, err)
+		return
+	}
+	debugLog.Printf("< %s %s%s", stage, resp.Status,
+		debugHeaders(resp.Header, "WWW-Authenticate", "Proxy-Authenticate", "Persistent-Auth", "Connection"))
+}
+
+// debugHeaders formats values of named headers, authentication tokens are summarized
+func debugHeaders(h http.Header, names ...string) string {
+	var b strings.Builder
+	for _, name := range names {
+		for _, v := range h.Values(name) {
+			if strings.HasSuffix(name, "Authorization") || strings.HasSuffix(name, "Authenticate") {
+				v = summarizeAuth(v)
+			}
+			fmt.Fprintf(&b, " %s=[%s]", name, v)
+		}
+	}
+	return b.String()
+}
+
+// summarizeAuth replaces token of authentication header value with its summary,
+// tokens of other schemes than NTLM are redacted
+func summarizeAuth(v string) string {
+	scheme, token := v, ""
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		scheme, token = v[:i], strings.TrimSpace(v[i+1:])
+	}
+	if token == "" {
+		return scheme
+	}
+	if !strings.EqualFold(scheme, "NTLM") {
+		return scheme + " <redacted>"
+	}
+
+	b, err := DecBase64(token)
+	if err != nil || len(b) < 12 {
+		return scheme + " <malformed>"
+	}
+	switch b[8] {
+	case 1:
+		if m, err := ParseNegotiateMessage(b); err == nil {
+			return fmt.Sprintf("NTLM negotiate flags=%s", m.Flags())
+		}
+	case 2:
+		if m, err := ParseChallengeMessage(b); err == nil {
+			return "NTLM challenge " + summarizeChallenge(m)
+		}
+	case 3:
+		if m, err := ParseAuthenticateMessage(b); err == nil {
+			return fmt.Sprintf("NTLM authenticate user=%q workstation=%q ntlmv2=%t flags=%s",
+				m.Domain()+`\`+m.User(), m.Workstation(), m.NTLMv2(), m.Flags())
+		}
+	}
+	return scheme + " <malformed>"
+}
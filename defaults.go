@@ -0,0 +1,38 @@
+package httpntlm
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// DefaultTransport is NTLM transport with safe defaults meant to be cloned, credentials are set on the clone:
+	//
+	//	t := httpntlm.DefaultTransport.Clone()
+	//	t.Domain, t.User, t.Password = "corp", "user", "secret"
+	DefaultTransport = &NtlmTransport{RoundTripper: NewBaseTransport()}
+	// DefaultClient is http client of DefaultTransport, copy it and set the Transport to a configured clone
+	DefaultClient = &http.Client{Transport: DefaultTransport}
+)
+
+// NewBaseTransport returns http.Transport suited to carry NTLM authentication. HTTP/2 is disabled
+// since NTLM authenticates HTTP/1.1 connections, proxies are taken from environment, TLS certificates
+// are verified and connecting, TLS handshake and waiting for response headers are limited in time.
+func NewBaseTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSNextProto:          map[string]func(string, *tls.Conn) http.RoundTripper{},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
@@ -0,0 +1,100 @@
+package httpntlm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Detection describes authentication capabilities of an endpoint found out by Detect
+type Detection struct {
+	// StatusCode is the status of the anonymous request
+	StatusCode int
+	// Schemes are authentication schemes offered to anonymous request
+	Schemes []string
+	// NTLM is set when the endpoint answered negotiate message with NTLM challenge
+	NTLM bool
+	// Flags are negotiate flags of the challenge
+	Flags NegotiateFlags
+	// TargetName is name of server's realm
+	TargetName string
+	// TargetInfo is server information of the challenge
+	TargetInfo TargetInfo
+	// Version is server's version, zero if it wasn't sent
+	Version Version
+	// TLS is set when the endpoint was reached over TLS
+	TLS bool
+	// EPALikely is set when the endpoint is served over TLS by a server supporting Extended Protection,
+	// i.e. its challenge carries timestamp. Whether the server enforces channel binding, which transport
+	// doesn't send, can't be told without credentials.
+	EPALikely bool
+}
+
+// Detect sends anonymous request to url and, if NTLM is offered, negotiate message which challenge is
+// parsed and thrown away, so endpoint's capabilities are reported without sending any credentials.
+// Requests go straight to the underlying RoundTripper, transport's knowledge of the host isn't changed.
+func (t *NtlmTransport) Detect(ctx context.Context, url string) (*Detection, error) {
+	resp, err := t.detectRequest(ctx, url, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := t.discardBody(resp); err != nil {
+		return nil, err
+	}
+
+	d := &Detection{StatusCode: resp.StatusCode, Schemes: t.OfferedSchemes(resp), TLS: resp.TLS != nil}
+	scheme := ""
+	for _, s := range d.Schemes {
+		// IIS accepts raw NTLM tokens under Negotiate scheme
+		if strings.EqualFold(s, "NTLM") || (scheme == "" && strings.EqualFold(s, "Negotiate")) {
+			scheme = s
+		}
+	}
+	if resp.StatusCode != http.StatusUnauthorized || scheme == "" {
+		return d, nil
+	}
+
+	resp, err = t.detectRequest(ctx, url, scheme+" "+EncBase64(Negotiate()))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.discardBody(resp); err != nil {
+		return nil, err
+	}
+	for _, h := range resp.Header.Values(t.challengeHeader()) {
+		if len(h) <= len(scheme) || !strings.EqualFold(h[:len(scheme)], scheme) {
+			continue
+		}
+		b, err := DecBase64(strings.TrimSpace(h[len(scheme):]))
+		if err != nil {
+			continue
+		}
+		challenge, err := ParseChallengeMessage(b)
+		if err != nil {
+			continue
+		}
+		d.NTLM = true
+		d.Flags = challenge.Flags()
+		d.TargetName = challenge.TargetName()
+		d.TargetInfo, _ = challenge.TargetInfo()
+		d.Version, _ = challenge.Version()
+		d.EPALikely = d.TLS && !d.TargetInfo.Timestamp.IsZero()
+		break
+	}
+	return d, nil
+}
+
+// detectRequest sends GET request of Detect with authorization, none if empty
+func (t *NtlmTransport) detectRequest(ctx context.Context, url, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set(t.authorizationHeader(), authorization)
+	}
+	if ua := t.HandshakeUserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	return t.base().RoundTrip(req)
+}
@@ -0,0 +1,38 @@
+package httpntlm
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// Dialer dials connections, it's satisfied by golang.org/x/net/proxy.Dialer
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer dials connections using context, it's satisfied by golang.org/x/net/proxy.ContextDialer.
+// Dialer which implements it is used with request context.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialContext adapts d to http.Transport.DialContext
+func dialContext(d Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cd, ok := d.(ContextDialer); ok {
+		return cd.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.Dial(network, addr)
+	}
+}
+
+// dialerTransport creates http.Transport which establishes connections with d,
+// proxy environment variables are ignored since d is expected to handle proxies itself
+func dialerTransport(d Dialer) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = dialContext(d)
+	return tr
+}
@@ -0,0 +1,52 @@
+package httpntlm
+
+import (
+	"net/http"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// DowngradeError is returned when server's challenge allows NTLMv1 or LM responses only,
+// transport refuses to downgrade and doesn't answer such challenges
+type DowngradeError struct {
+	// Host is the host that issued the challenge
+	Host string
+	// Proxy is set when challenge came from the proxy
+	Proxy bool
+	// Flags are negotiate flags of the challenge
+	Flags uint32
+}
+
+func (e *DowngradeError) Error() string {
+	if e.Proxy {
+		return "proxy for " + e.Host + " accepts NTLMv1 only"
+	}
+	return e.Host + " accepts NTLMv1 only"
+}
+
+// v1Only reports whether challenge can't be answered with NTLMv2 response,
+// it needs target information and LM session keys rule out extended session security
+func v1Only(challenge *ntlm.ChallengeMessage) bool {
+	flags := challenge.NegotiateFlags
+	if ntlm.NTLMSSP_NEGOTIATE_LM_KEY.IsSet(flags) && !ntlm.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(flags) {
+		return true
+	}
+	return !ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(flags) || challenge.TargetInfo == nil || len(challenge.TargetInfo.List) == 0
+}
+
+// checkDowngrade returns DowngradeError if challenge is v1 only, reporting it to logs and metrics
+func (t *NtlmTransport) checkDowngrade(req *http.Request, target authTarget, challenge *ntlm.ChallengeMessage) error {
+	if !v1Only(challenge) {
+		return nil
+	}
+
+	err := &DowngradeError{Host: hostKey(req.URL), Proxy: target.proxy, Flags: challenge.NegotiateFlags}
+	origin := "origin"
+	if target.proxy {
+		origin = "proxy"
+	}
+	t.log(req.Context(), "NTLMv1 only challenge", "host", err.Host, "target", origin, "flags", err.Flags)
+	t.inc(req.Context(), MetricV1Only, map[string]string{"host": err.Host, "target": origin})
+
+	return err
+}
@@ -0,0 +1,97 @@
+package httpntlm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxDownloadResumes is the number of times Download resumes interrupted transfer
+const DefaultMaxDownloadResumes = 3
+
+// Download fetches url into w using Range requests to resume the transfer when connection drops,
+// every resumed request goes through NTLM handshake again if necessary.
+// It returns the number of bytes written.
+func (t *NtlmTransport) Download(ctx context.Context, url string, w io.Writer) (int64, error) {
+	client := &http.Client{Transport: t}
+
+	var written int64
+	var validator string
+	for resumes := 0; ; resumes++ {
+		n, v, err := t.downloadFrom(ctx, client, url, w, written, validator)
+		written += n
+		if v != "" {
+			validator = v
+		}
+		if err == nil || ctx.Err() != nil || resumes >= t.maxDownloadResumes() {
+			return written, err
+		}
+		if _, ok := err.(*downloadError); ok {
+			return written, err
+		}
+	}
+}
+
+func (t *NtlmTransport) maxDownloadResumes() int {
+	if t.MaxDownloadResumes == 0 {
+		return DefaultMaxDownloadResumes
+	}
+	if t.MaxDownloadResumes < 0 {
+		return 0
+	}
+	return t.MaxDownloadResumes
+}
+
+// downloadError is a non-recoverable download failure
+type downloadError struct {
+	msg string
+}
+
+func (e *downloadError) Error() string {
+	return e.msg
+}
+
+// downloadFrom copies content of url starting at offset into w,
+// validator is ETag or Last-Modified value used to make sure the content didn't change
+func (t *NtlmTransport) downloadFrom(ctx context.Context, client *http.Client, url string, w io.Writer, offset int64, validator string) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	// offsets must refer to the bytes as stored on server
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case offset == 0 && resp.StatusCode == http.StatusOK:
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return 0, "", &downloadError{"unexpected Content-Range " + resp.Header.Get("Content-Range")}
+		}
+	case offset > 0 && resp.StatusCode == http.StatusOK:
+		return 0, "", &downloadError{"server doesn't support resuming the download of " + url}
+	default:
+		return 0, "", &downloadError{"download of " + url + " failed: " + resp.Status}
+	}
+
+	validator = resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	return n, validator, err
+}
@@ -0,0 +1,385 @@
+// Package dynamics is a thin client of Dynamics 365 on-premises Web API on top of NTLM transport.
+// It takes care of OData headers, error bodies, paging with @odata.nextLink and FetchXML paging cookies,
+// and $batch requests.
+package dynamics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// Client sends requests to Web API of a single organization
+type Client struct {
+	// BaseURL is Web API root of the organization, e.g. https://crm.example.com/org/api/data/v9.1/
+	BaseURL string
+	// HTTPClient sends the requests, it's expected to authenticate them
+	HTTPClient *http.Client
+	// MaxPageSize is sent as odata.maxpagesize preference, server default is used if zero
+	MaxPageSize int
+}
+
+// New returns client of Web API at baseURL authenticating through t
+func New(baseURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Transport: t},
+	}
+}
+
+// Error is Web API error response
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("dynamics: status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("dynamics: status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// NewRequest returns Web API request of path relative to BaseURL, body other than nil is sent as JSON
+func (c *Client) NewRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req.Header, c.MaxPageSize)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	return req, nil
+}
+
+func (c *Client) resolve(path string) (string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// setHeaders sets OData headers Web API expects, formatted values and paging cookies come as annotations
+func setHeaders(h http.Header, maxPageSize int) {
+	h.Set("Accept", "application/json")
+	h.Set("OData-MaxVersion", "4.0")
+	h.Set("OData-Version", "4.0")
+	h.Set("Prefer", `odata.include-annotations="*"`)
+	if maxPageSize > 0 {
+		h.Add("Prefer", "odata.maxpagesize="+strconv.Itoa(maxPageSize))
+	}
+}
+
+// Do sends req and decodes JSON response into v unless v is nil, error responses are returned as *Error
+func (c *Client) Do(req *http.Request, v interface{}) error {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// checkResponse returns *Error for error responses, body is read in that case
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var body struct {
+		Error Error `json:"error"`
+	}
+	e := &body.Error
+	if err := json.Unmarshal(b, &body); err != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	e.StatusCode = resp.StatusCode
+	return e
+}
+
+// page is a collection response of Web API
+type page struct {
+	Value       []json.RawMessage `json:"value"`
+	NextLink    string            `json:"@odata.nextLink"`
+	MoreRecords bool              `json:"@Microsoft.Dynamics.CRM.morerecords"`
+	Cookie      string            `json:"@Microsoft.Dynamics.CRM.fetchxmlpagingcookie"`
+}
+
+// List calls fn with every record of collection at path, following @odata.nextLink through all pages
+func (c *Client) List(ctx context.Context, path string, fn func(record json.RawMessage) error) error {
+	req, err := c.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var p page
+		if err := c.Do(req, &p); err != nil {
+			return err
+		}
+		for _, record := range p.Value {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		if p.NextLink == "" {
+			return nil
+		}
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.NextLink, nil)
+		if err != nil {
+			return err
+		}
+		setHeaders(req.Header, c.MaxPageSize)
+	}
+}
+
+// FetchXML calls fn with every record FetchXML query over entitySet returns, pages are requested
+// with paging cookies server hands out
+func (c *Client) FetchXML(ctx context.Context, entitySet, fetch string, fn func(record json.RawMessage) error) error {
+	for pageNumber := 1; ; pageNumber++ {
+		req, err := c.NewRequest(ctx, http.MethodGet, entitySet+"?fetchXml="+url.QueryEscape(fetch), nil)
+		if err != nil {
+			return err
+		}
+
+		var p page
+		if err := c.Do(req, &p); err != nil {
+			return err
+		}
+		for _, record := range p.Value {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		if !p.MoreRecords {
+			return nil
+		}
+
+		cookie, err := pagingCookie(p.Cookie)
+		if err != nil {
+			return err
+		}
+		fetch, err = nextPage(fetch, pageNumber+1, cookie)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pagingCookie extracts paging cookie out of fetchxmlpagingcookie annotation,
+// the cookie is encoded twice in pagingcookie attribute
+func pagingCookie(annotation string) (string, error) {
+	if annotation == "" {
+		return "", nil
+	}
+
+	var cookie struct {
+		PagingCookie string `xml:"pagingcookie,attr"`
+	}
+	if err := xml.Unmarshal([]byte(annotation), &cookie); err != nil {
+		return "", fmt.Errorf("dynamics: invalid paging cookie: %w", err)
+	}
+
+	v := cookie.PagingCookie
+	for i := 0; i < 2; i++ {
+		decoded, err := url.QueryUnescape(v)
+		if err != nil {
+			return "", fmt.Errorf("dynamics: invalid paging cookie: %w", err)
+		}
+		v = decoded
+	}
+	return v, nil
+}
+
+// nextPage returns fetch with page and paging-cookie attributes of its root element set
+func nextPage(fetch string, pageNumber int, cookie string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(fetch))
+	var out bytes.Buffer
+	e := xml.NewEncoder(&out)
+	root := true
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("dynamics: invalid FetchXML: %w", err)
+		}
+
+		if start, ok := tok.(xml.StartElement); ok && root {
+			root = false
+			var attrs []xml.Attr
+			for _, a := range start.Attr {
+				if a.Name.Local != "page" && a.Name.Local != "paging-cookie" {
+					attrs = append(attrs, a)
+				}
+			}
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "page"}, Value: strconv.Itoa(pageNumber)})
+			if cookie != "" {
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "paging-cookie"}, Value: cookie})
+			}
+			start.Attr = attrs
+			tok = start
+		}
+		if err := e.EncodeToken(tok); err != nil {
+			return "", err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Batch sends reqs in a single $batch request and returns their responses in the same order,
+// response bodies are buffered. Requests should be created by NewRequest.
+func (c *Client) Batch(ctx context.Context, reqs []*http.Request) ([]*http.Response, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	boundary := "batch_" + w.Boundary()
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for _, r := range reqs {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Write(part); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.NewRequest(ctx, http.MethodPost, "$batch", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+	req.ContentLength = int64(body.Len())
+	b := body.Bytes()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	responses, err := readBatch(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != len(reqs) {
+		return nil, fmt.Errorf("dynamics: batch of %d requests got %d responses", len(reqs), len(responses))
+	}
+	for i, r := range responses {
+		r.Request = reqs[i]
+	}
+	return responses, nil
+}
+
+// readBatch parses multipart batch response, change set responses are flattened
+func readBatch(contentType string, body io.Reader) ([]*http.Response, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("dynamics: unexpected batch response type %q", contentType)
+	}
+
+	var responses []*http.Response
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if ct := part.Header.Get("Content-Type"); strings.HasPrefix(ct, "multipart/") {
+			changeset, err := readBatch(ct, part)
+			if err != nil {
+				return nil, err
+			}
+			responses = append(responses, changeset...)
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		responses = append(responses, resp)
+	}
+}
@@ -0,0 +1,85 @@
+package dynamics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_FetchXMLPaging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("OData-Version") != "4.0" {
+			t.Errorf("missing OData headers")
+		}
+		fetch := r.URL.Query().Get("fetchXml")
+		if !strings.Contains(fetch, `page="2"`) {
+			cookie := url.QueryEscape(url.QueryEscape(`<cookie page="1"><accountid last="{1}" /></cookie>`))
+			fmt.Fprintf(w, `{"value":[{"name":"a"}],"@Microsoft.Dynamics.CRM.morerecords":true,`+
+				`"@Microsoft.Dynamics.CRM.fetchxmlpagingcookie":"<cookie pagenumber=\"2\" pagingcookie=\"%s\" istracking=\"False\" />"}`, cookie)
+			return
+		}
+		if !strings.Contains(fetch, `paging-cookie="&lt;cookie page=&#34;1&#34;&gt;`) {
+			t.Errorf("paging cookie wasn't passed: %s", fetch)
+		}
+		fmt.Fprint(w, `{"value":[{"name":"b"}]}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL + "/org/api/data/v9.1"}
+	var names []string
+	err := c.FetchXML(context.Background(), "accounts", `<fetch count="1"><entity name="account"><attribute name="name"/></entity></fetch>`,
+		func(record json.RawMessage) error {
+			var v struct{ Name string }
+			json.Unmarshal(record, &v)
+			names = append(names, v.Name)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, "") != "ab" {
+		t.Errorf("expected records of both pages, got %v", names)
+	}
+}
+
+func Test_Batch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/$batch") {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Count(string(body), "GET /org/api/data/v9.1/") != 2 {
+			t.Errorf("unexpected batch body %s", body)
+		}
+		w.Header().Set("Content-Type", "multipart/mixed; boundary=batchresponse_1")
+		fmt.Fprint(w, "--batchresponse_1\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\n\r\n"+
+			"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n{\"value\":[]}\r\n"+
+			"--batchresponse_1\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\n\r\n"+
+			"HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\n\r\n{\"error\":{\"code\":\"0x80040217\",\"message\":\"missing\"}}\r\n"+
+			"--batchresponse_1--\r\n")
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL + "/org/api/data/v9.1/"}
+	ctx := context.Background()
+	first, _ := c.NewRequest(ctx, http.MethodGet, "accounts", nil)
+	second, _ := c.NewRequest(ctx, http.MethodGet, "contacts(1)", nil)
+	responses, err := c.Batch(ctx, []*http.Request{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses[0].StatusCode != http.StatusOK || responses[1].StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected statuses %d %d", responses[0].StatusCode, responses[1].StatusCode)
+	}
+	var e *Error
+	if err := checkResponse(responses[1]); !errors.As(err, &e) || e.Code != "0x80040217" {
+		t.Errorf("expected decoded error, got %v", err)
+	}
+}
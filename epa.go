@@ -0,0 +1,92 @@
+package httpntlm
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// channelBinding is what authentication is bound to by Extended Protection for Authentication
+type channelBinding struct {
+	// spn is service principal name of the origin
+	spn string
+	// hash is MD5 of gss_channel_bindings_struct of TLS connection, all zero without TLS
+	hash []byte
+}
+
+// spn returns service principal name of the origin of req, HostSPNs override the one derived from its host,
+// port is included only if it's not the default one of the scheme
+func (t *NtlmTransport) spn(req *http.Request) string {
+	key := hostKey(req.URL)
+	for host, spn := range t.HostSPNs {
+		if hostMatcher(host)(key) {
+			return spn
+		}
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	name := withoutZone(hostName(host))
+	if _, port, err := net.SplitHostPort(host); err == nil && port != "" && port != defaultPort(req.URL.Scheme) {
+		return "HTTP/" + net.JoinHostPort(name, port)
+	}
+	return "HTTP/" + name
+}
+
+// channelBinding returns binding of authentication to origin of req whose challenge came in resp
+func (t *NtlmTransport) channelBinding(req *http.Request, resp *http.Response) *channelBinding {
+	return &channelBinding{spn: t.spn(req), hash: channelBindingHash(resp.TLS)}
+}
+
+// channelBindingHash returns MD5 of gss_channel_bindings_struct (RFC 2744 3.11) with tls-server-end-point
+// application data (RFC 5929), addresses are left empty
+func channelBindingHash(state *tls.ConnectionState) []byte {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return make([]byte, md5.Size)
+	}
+
+	data := append([]byte("tls-server-end-point:"), certificateHash(state.PeerCertificates[0])...)
+	// initiator and acceptor address types and lengths precede application data length
+	b := make([]byte, 20, 20+len(data))
+	put32(b[16:], uint32(len(data)))
+	sum := md5.Sum(append(b, data...))
+	return sum[:]
+}
+
+// certificateHash hashes cert with hash function of its signature, MD5 and SHA-1 are replaced by SHA-256
+func certificateHash(cert *x509.Certificate) []byte {
+	h := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = crypto.SHA512
+	}
+	d := h.New()
+	d.Write(cert.Raw)
+	return d.Sum(nil)
+}
+
+// targetInfo returns target info of the challenge extended with SPN and channel bindings,
+// pairs the client supplies replace ones server may have sent
+func (b *channelBinding) targetInfo(payload []byte) []byte {
+	pairs := &ntlm.AvPairs{}
+	for _, p := range ntlm.ReadAvPairs(payload).List {
+		switch p.AvId {
+		case ntlm.MsvAvEOL, ntlm.MsvAvTargetName, ntlm.MsvChannelBindings:
+			continue
+		}
+		pairs.AddAvPair(p.AvId, p.Value)
+	}
+	pairs.AddAvPair(ntlm.MsvAvTargetName, utf16le(b.spn))
+	pairs.AddAvPair(ntlm.MsvChannelBindings, b.hash)
+	pairs.AddAvPair(ntlm.MsvAvEOL, nil)
+	return pairs.Bytes()
+}
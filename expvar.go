@@ -0,0 +1,49 @@
+package httpntlm
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarMu guards publishing of expvar maps, expvar panics on duplicate names
+var expvarMu sync.Mutex
+
+// ExpvarMetrics publishes counters transport reports via expvar, for services which don't run
+// a metrics system but want basic visibility at /debug/vars. Counters are kept by metric name,
+// labels aren't kept. The map also carries ntlm_cache_hit_ratio, share of requests sent over
+// connections already authenticated.
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics returns metrics published as expvar map of name, transports using the same name
+// share the counters
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarMetrics{m: m}
+	}
+	m := expvar.NewMap(name)
+	m.Set("ntlm_cache_hit_ratio", expvar.Func(func() interface{} {
+		hits, misses := expvarInt(m, MetricCacheHits), expvarInt(m, MetricCacheMisses)
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+	return &ExpvarMetrics{m: m}
+}
+
+// Inc implements Metrics
+func (e *ExpvarMetrics) Inc(name string, labels map[string]string, exemplar string) {
+	e.m.Add(name, 1)
+}
+
+func expvarInt(m *expvar.Map, name string) int64 {
+	if v, ok := m.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
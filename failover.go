@@ -0,0 +1,120 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+)
+
+// lookupHost resolves host names of failover addresses
+var lookupHost = net.DefaultResolver.LookupHost
+
+// addrTrace records address the request was last sent to
+type addrTrace struct {
+	mu   sync.Mutex
+	addr string
+}
+
+func (a *addrTrace) trace(r *http.Request) *http.Request {
+	set := func(addr string) {
+		a.mu.Lock()
+		a.addr = addr
+		a.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			set(addr)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			set(info.Conn.RemoteAddr().String())
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+func (a *addrTrace) ip() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	host, _, err := net.SplitHostPort(a.addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// isConnError reports whether err means the connection couldn't be established or broke
+func isConnError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// failover repeats the whole handshake of req against other addresses of its host after it failed with err
+// over connection to failed address, transport pinned to the address which worked is returned with the response
+func (t *NtlmTransport) failover(pool *connPool, req *http.Request, failed string, err error) (*http.Response, *http.Transport, error) {
+	if !isConnError(err) || req.Context().Err() != nil || ipLiteral(req.URL.Hostname()) {
+		return nil, nil, err
+	}
+	// authenticated request may have reached the server before connection broke
+	if authenticated(req) && !t.idempotent(req) {
+		return nil, nil, err
+	}
+	if pool.of.Proxy != nil {
+		if u, proxyErr := pool.of.Proxy(req); proxyErr != nil || u != nil {
+			return nil, nil, err
+		}
+	}
+	addrs, lookupErr := lookupHost(req.Context(), req.URL.Hostname())
+	if lookupErr != nil {
+		return nil, nil, err
+	}
+
+	for _, addr := range addrs {
+		if addr == failed {
+			continue
+		}
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			return nil, nil, replayErr
+		}
+		if !ok {
+			return nil, nil, err
+		}
+
+		t.log(req.Context(), "failing over", "host", hostKey(req.URL), "addr", addr, "error", err)
+		pinned := pool.fresh()
+		pinned.DialContext = dialAddr(pinned.DialContext, addr)
+		resp, sendErr := t.sendRoundTrip(pinned, r)
+		if sendErr == nil {
+			return resp, pinned, nil
+		}
+		pinned.CloseIdleConnections()
+		if err = sendErr; !isConnError(err) || req.Context().Err() != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+// dialAddr returns dial function connecting to ip instead of the host it's asked for
+func dialAddr(dial func(ctx context.Context, network, addr string) (net.Conn, error), ip string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, net.JoinHostPort(ip, port))
+	}
+}
@@ -0,0 +1,88 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Fault is a failure injected into a handshake stage so applications can test their error handling,
+// see NtlmTransport.Faults
+type Fault int
+
+const (
+	// FaultNone injects nothing
+	FaultNone Fault = iota
+	// FaultDropChallenge removes the challenge header from response
+	FaultDropChallenge
+	// FaultCorruptChallenge replaces NTLM challenge in response with invalid base64
+	FaultCorruptChallenge
+	// FaultCloseConnection makes server close the connection after response, at negotiate stage
+	// the authenticate message has to be sent over a new connection
+	FaultCloseConnection
+	// FaultError fails the request with ErrFaultInjected without sending it
+	FaultError
+)
+
+// ErrFaultInjected is returned by requests of stages with FaultError
+var ErrFaultInjected = errors.New("ntlm fault injected")
+
+func (f Fault) String() string {
+	switch f {
+	case FaultNone:
+		return "none"
+	case FaultDropChallenge:
+		return "drop-challenge"
+	case FaultCorruptChallenge:
+		return "corrupt-challenge"
+	case FaultCloseConnection:
+		return "close-connection"
+	case FaultError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// injectRequest applies fault of stage to request before it's sent
+func (t *NtlmTransport) injectRequest(req *http.Request, stage Stage) (*http.Request, error) {
+	fault := t.Faults[stage]
+	switch fault {
+	case FaultCloseConnection:
+		t.log(req.Context(), "injecting fault", "stage", stage, "fault", fault)
+		r := *req
+		r.Close = true
+		return &r, nil
+	case FaultError:
+		t.log(req.Context(), "injecting fault", "stage", stage, "fault", fault)
+		return nil, ErrFaultInjected
+	}
+	return req, nil
+}
+
+// injectResponse applies fault of stage to response
+func (t *NtlmTransport) injectResponse(ctx context.Context, resp *http.Response, stage Stage) {
+	fault := t.Faults[stage]
+	if fault != FaultDropChallenge && fault != FaultCorruptChallenge {
+		return
+	}
+
+	header := t.challengeHeader()
+	if stage == StageProxyNegotiate || stage == StageProxyAuthenticate {
+		header = "Proxy-Authenticate"
+	}
+	t.log(ctx, "injecting fault", "stage", stage, "fault", fault)
+	if fault == FaultDropChallenge {
+		resp.Header.Del(header)
+		return
+	}
+
+	values := resp.Header.Values(header)
+	resp.Header.Del(header)
+	for _, v := range values {
+		if strings.HasPrefix(v, "NTLM ") {
+			v = "NTLM !corrupted!"
+		}
+		resp.Header.Add(header, v)
+	}
+}
@@ -0,0 +1,44 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// challengeFlags are negotiate flags reported by MetricChallengeFlags, keyed by label
+var challengeFlags = []struct {
+	label string
+	flag  ntlm.NegotiateFlag
+}{
+	{"extended_session_security", ntlm.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY},
+	{"target_info", ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO},
+	{"128bit", ntlm.NTLMSSP_NEGOTIATE_128},
+	{"56bit", ntlm.NTLMSSP_NEGOTIATE_56},
+	{"key_exchange", ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH},
+	{"signing", ntlm.NTLMSSP_NEGOTIATE_SIGN},
+	{"sealing", ntlm.NTLMSSP_NEGOTIATE_SEAL},
+	{"lm_key", ntlm.NTLMSSP_NEGOTIATE_LM_KEY},
+}
+
+// recordChallengeFlags reports which negotiate flags server set in challenge, so it can be audited
+// what hosts negotiate in practice
+func (t *NtlmTransport) recordChallengeFlags(req *http.Request, target authTarget, challenge *ntlm.ChallengeMessage) {
+	if t.Metrics == nil {
+		return
+	}
+
+	labels := map[string]string{
+		"host":   hostKey(req.URL),
+		"target": "origin",
+		"v2":     strconv.FormatBool(!v1Only(challenge)),
+	}
+	if target.proxy {
+		labels["target"] = "proxy"
+	}
+	for _, f := range challengeFlags {
+		labels[f.label] = strconv.FormatBool(f.flag.IsSet(challenge.NegotiateFlags))
+	}
+	t.inc(req.Context(), MetricChallengeFlags, labels)
+}
@@ -1,5 +1,5 @@
-module github.com/sematext/go-http-ntlm
+module github.com/sematext/go-http-ntlm/v2
 
 go 1.14
 
-require github.com/sematext/go-ntlm v0.0.0-20230817113007-b05d65ad37bf // indirect
+require github.com/sematext/go-ntlm v0.0.0-20230817113007-b05d65ad37bf
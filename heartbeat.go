@@ -0,0 +1,98 @@
+package httpntlm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Heartbeat configures requests sent periodically over idle authenticated connections,
+// so that servers and middleboxes don't close them and bursty low-rate workloads don't pay for new handshakes
+type Heartbeat struct {
+	// Interval between heartbeats, it should be shorter than idle timeout of the server, 2 minutes by default in IIS
+	Interval time.Duration
+	// Method of heartbeat requests, defaults to HEAD, OPTIONS is another common choice
+	Method string
+	// Path requested on every host with idle connections, defaults to /
+	Path string
+}
+
+// startHeartbeat starts sending heartbeats until t is closed, t.mu must be held
+func (t *NtlmTransport) startHeartbeat() {
+	if t.Heartbeat == nil || t.Heartbeat.Interval <= 0 || t.beating {
+		return
+	}
+	t.beating = true
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	go t.heartbeat(*t.Heartbeat, t.done)
+}
+
+func (t *NtlmTransport) heartbeat(h Heartbeat, done <-chan struct{}) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		pool := t.pool
+		t.mu.Unlock()
+		if pool != nil {
+			t.beat(pool, h)
+		}
+	}
+}
+
+// beat sends heartbeat over every idle connection of pool once
+func (t *NtlmTransport) beat(pool *connPool, h Heartbeat) {
+	for key, n := range pool.idleCounts() {
+		for i := 0; i < n; i++ {
+			pinned := pool.oldest(key)
+			if pinned == nil {
+				break
+			}
+			t.ping(pinned, key, h)
+			pool.put(key, pinned)
+		}
+	}
+}
+
+// ping sends heartbeat to host with key over pinned transport
+func (t *NtlmTransport) ping(pinned *http.Transport, key string, h Heartbeat) {
+	method, path := h.Method, h.Path
+	if method == "" {
+		method = http.MethodHead
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	ctx, cancel, err := t.begin(context.Background())
+	if err != nil {
+		return
+	}
+	defer cancel()
+	ctx, timeout := context.WithTimeout(ctx, h.Interval)
+	defer timeout()
+
+	req, err := http.NewRequestWithContext(ctx, method, key+path, nil)
+	if err != nil {
+		t.log(ctx, "heartbeat failed", "host", key, "error", err)
+		return
+	}
+	resp, err := t.sendRoundTrip(pinned, req)
+	if err == nil {
+		err = t.discardBody(resp)
+	}
+	if err != nil {
+		t.log(ctx, "heartbeat failed", "host", key, "error", err)
+		return
+	}
+	t.log(ctx, "heartbeat sent", "host", key, "status", resp.StatusCode)
+}
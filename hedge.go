@@ -0,0 +1,186 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var errNoReplicas = errors.New("hedge has no replicas")
+
+// Hedge races latency sensitive reads against replicas of a server farm and returns the first successful
+// response, requests to the other replicas are canceled. Every replica has a clone of the template transport,
+// so handshakes, caches and connections of replicas never mix. Request URL's path and query are sent to
+// every replica, its scheme and host are replaced. Hedge itself is http.RoundTripper.
+type Hedge struct {
+	// Delay is how long the request waits for a replica before it's sent to the next one too,
+	// all replicas are raced at once if zero
+	Delay time.Duration
+
+	replicas   []*url.URL
+	transports []*NtlmTransport
+}
+
+// NewHedge returns hedge of replicas authenticated by clones of template, replicas are URLs
+// of the hosts in the order they are tried, e.g. https://web1.example.com
+func NewHedge(template *NtlmTransport, replicas []string) (*Hedge, error) {
+	h := &Hedge{}
+	for _, replica := range replicas {
+		u, err := url.Parse(replica)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("url " + replica + " has no host")
+		}
+		h.replicas = append(h.replicas, u)
+		h.transports = append(h.transports, template.Clone())
+	}
+	return h, nil
+}
+
+// hedged is outcome of request sent to replica i
+type hedged struct {
+	i    int
+	resp *http.Response
+	err  error
+}
+
+// success reports whether the replica answered, server errors let other replicas win
+func (r hedged) success() bool {
+	return r.err == nil && r.resp.StatusCode < 500
+}
+
+// RoundTrip sends req to the replicas until one of them responds successfully, a replica which fails
+// makes the request go to the next one right away. Requests which aren't idempotent, as retries of the template
+// tell, and requests with bodies which can't be replayed go to the first replica only, so their side effects
+// happen once. If every replica fails the last outcome is returned.
+func (h *Hedge) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(h.replicas) == 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errNoReplicas
+	}
+
+	results := make(chan hedged, len(h.replicas))
+	cancels := make([]context.CancelFunc, len(h.replicas))
+	next, pending, replayable := 0, 0, h.transports[0].idempotent(req)
+	// launch sends request to the next replica, false if there's none or the request can't be replayed
+	launch := func() bool {
+		if next == len(h.replicas) || next > 0 && !replayable {
+			return false
+		}
+		// the first replica gets caller's body, the others get copies
+		r := req.Clone(req.Context())
+		if next > 0 {
+			var err error
+			if r, replayable, err = replayRequest(req); err != nil || !replayable {
+				replayable = false
+				return false
+			}
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		r = r.WithContext(ctx)
+		r.URL.Scheme, r.URL.Host, r.Host = h.replicas[next].Scheme, h.replicas[next].Host, ""
+		go func(i int) {
+			resp, err := h.transports[i].RoundTrip(r)
+			results <- hedged{i: i, resp: resp, err: err}
+		}(next)
+		cancels[next] = cancel
+		next++
+		pending++
+		return true
+	}
+
+	// a single timer hedges the request, it restarts whenever another replica gets it
+	var timer *time.Timer
+	if h.Delay > 0 {
+		timer = time.NewTimer(h.Delay)
+		defer timer.Stop()
+	}
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(h.Delay)
+	}
+
+	launch()
+	var last *hedged
+	for pending > 0 {
+		var hedge <-chan time.Time
+		if timer == nil {
+			for launch() {
+			}
+		} else if next < len(h.replicas) && replayable {
+			hedge = timer.C
+		}
+
+		select {
+		case <-hedge:
+			if launch() {
+				restart()
+			}
+		case result := <-results:
+			pending--
+			if result.success() {
+				for i, cancel := range cancels {
+					if cancel != nil && i != result.i {
+						cancel()
+					}
+				}
+				go discardHedged(results, pending)
+				newReleaseBody(result.resp, cancels[result.i])
+				return result.resp, nil
+			}
+			if last != nil {
+				if last.resp != nil {
+					last.resp.Body.Close()
+				}
+				cancels[last.i]()
+			}
+			last = &result
+			if launch() && timer != nil {
+				restart()
+			}
+		}
+	}
+
+	if last.err != nil {
+		cancels[last.i]()
+		return nil, last.err
+	}
+	newReleaseBody(last.resp, cancels[last.i])
+	return last.resp, nil
+}
+
+// discardHedged closes responses of n requests which lost the race
+func discardHedged(results <-chan hedged, n int) {
+	for ; n > 0; n-- {
+		if result := <-results; result.resp != nil {
+			result.resp.Body.Close()
+		}
+	}
+}
+
+// CloseIdleConnections closes idle connections of all replicas
+func (h *Hedge) CloseIdleConnections() {
+	for _, t := range h.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// Close closes transports of all replicas
+func (h *Hedge) Close() error {
+	for _, t := range h.transports {
+		t.Close()
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package httpntlm
+
+import (
+	"net/http"
+)
+
+// hookRequest passes copy of req to RequestHook, so the hook never changes the caller's request
+func (t *NtlmTransport) hookRequest(req *http.Request, stage Stage) *http.Request {
+	if t.RequestHook == nil {
+		return req
+	}
+
+	r := req.Clone(req.Context())
+	t.RequestHook(stage, r)
+	return r
+}
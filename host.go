@@ -0,0 +1,43 @@
+package httpntlm
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostName returns lower case name of host in host[:port] form without brackets of IPv6 literal
+// and trailing dot of fully qualified name, zone of link-local address is kept
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		// interface names are case sensitive
+		return strings.ToLower(host[:i]) + host[i:]
+	}
+	return strings.ToLower(host)
+}
+
+// withoutZone strips zone of link-local IPv6 address, e.g. fe80::1%eth0
+func withoutZone(host string) string {
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host[:i], ":") {
+		return host[:i]
+	}
+	return host
+}
+
+// ipLiteral reports whether host is IP address rather than a name, IPv6 address may have zone
+func ipLiteral(host string) bool {
+	return net.ParseIP(withoutZone(host)) != nil
+}
+
+// requestHost returns the name server knows itself by, Host header takes precedence over URL
+// as it may name the host URL points to by address
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return hostName(req.Host)
+	}
+	return hostName(req.URL.Host)
+}
@@ -1,11 +1,31 @@
 package httpntlm
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sematext/go-ntlm/ntlm"
 )
@@ -68,3 +88,3840 @@ func Test_AuthenticationSuccess(t *testing.T) {
 	}
 
 }
+
+func Test_CustomHeaders(t *testing.T) {
+	client := http.Client{
+		Transport: &NtlmTransport{
+			Domain:              "dt",
+			User:                "testuser",
+			Password:            "fish",
+			AuthorizationHeader: "X-Upstream-Authorization",
+			ChallengeHeader:     "X-Upstream-Authenticate",
+		},
+	}
+
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("unexpected Authorization header")
+		}
+
+		h := r.Header.Get("X-Upstream-Authorization")
+		if h == "" {
+			w.WriteHeader(401)
+			return
+		}
+
+		authenticateBytes, _ := DecBase64(strings.TrimPrefix(h, "NTLM "))
+		auth, err := ntlm.ParseAuthenticateMessage(authenticateBytes, 2)
+		if err == nil {
+			err = session.ProcessAuthenticateMessage(auth)
+			if err != nil {
+				t.Errorf("Could not process authenticate message: %s\n", err)
+			}
+			return
+		}
+
+		challenge, _ := session.GenerateChallengeMessage()
+		w.Header().Add("X-Upstream-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+		w.WriteHeader(401)
+	}))
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+// ntlmHandler performs server side of NTLM handshake and passes authenticated requests to next,
+// handshake state is kept per connection and authenticated connections don't need to authenticate again
+func ntlmHandler(t *testing.T, next http.HandlerFunc) http.HandlerFunc {
+	return ntlmAuthenticator(http.StatusUnauthorized, "Authorization", "WWW-Authenticate", "testuser", "fish", "dt", next)
+}
+
+// ntlmAuthenticator is ntlmHandler with configurable status code, headers and credentials
+func ntlmAuthenticator(status int, authHeader, challengeHeader, user, password, domain string, next http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	sessions := map[string]ntlm.ServerSession{}
+	authenticated := map[string]bool{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get(authHeader)
+		mu.Lock()
+		persistent := authenticated[r.RemoteAddr]
+		mu.Unlock()
+		if h == "" && persistent {
+			if next != nil {
+				next(w, r)
+			}
+			return
+		}
+
+		if !strings.HasPrefix(h, "NTLM ") {
+			w.Header().Add(challengeHeader, "NTLM")
+			w.WriteHeader(status)
+			return
+		}
+
+		mu.Lock()
+		session, ok := sessions[r.RemoteAddr]
+		if !ok {
+			session, _ = ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+			session.SetUserInfo(user, password, domain, "")
+			sessions[r.RemoteAddr] = session
+		}
+		mu.Unlock()
+
+		msg, _ := DecBase64(strings.TrimPrefix(h, "NTLM "))
+		if auth, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil {
+			// authentication is bound to the connection challenge was issued on
+			if !ok || session.ProcessAuthenticateMessage(auth) != nil {
+				w.WriteHeader(status)
+				return
+			}
+			mu.Lock()
+			authenticated[r.RemoteAddr] = true
+			mu.Unlock()
+			if next != nil {
+				next(w, r)
+			}
+			return
+		}
+
+		challenge, _ := session.GenerateChallengeMessage()
+		// HTTP authentication is connection oriented
+		challenge.NegotiateFlags = ntlm.NTLMSSP_NEGOTIATE_DATAGRAM.Unset(challenge.NegotiateFlags)
+		w.Header().Add(challengeHeader, "NTLM "+EncBase64(challenge.Bytes()))
+		w.WriteHeader(status)
+	}
+}
+
+// rechallengedOnce wraps handler of server keeping authentication on connections, it challenges the first
+// POST relying on that on every connection again, so that the body is replayed for the handshake
+func rechallengedOnce(handler http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	challenged := map[string]bool{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+		mu.Lock()
+		again := r.Method == "POST" && r.Header.Get("Authorization") == "" && !challenged[r.RemoteAddr]
+		if again {
+			challenged[r.RemoteAddr] = true
+		}
+		mu.Unlock()
+		if again {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Add("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func newTestTransport() *NtlmTransport {
+	return &NtlmTransport{
+		Domain:   "dt",
+		User:     "testuser",
+		Password: "fish",
+	}
+}
+
+func Test_EmptyChallengeRetries(t *testing.T) {
+	emptyChallenges := 2
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if emptyChallenges > 0 && r.Header.Get("Authorization") != "" {
+			emptyChallenges--
+			w.Header().Add("WWW-Authenticate", "NTLM")
+			w.WriteHeader(401)
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	if _, err := (&http.Client{Transport: transport}).Get(ts.URL); !errors.Is(err, errEmptyNtlm) {
+		t.Fatalf("expected empty challenge error, got %v", err)
+	}
+
+	emptyChallenges = 2
+	transport.EmptyChallengeRetries = 2
+	transport.EmptyChallengeRetryDelay = time.Millisecond
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Rechallenge(t *testing.T) {
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+
+	rechallenges := 1
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+		if _, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil && rechallenges > 0 {
+			rechallenges--
+			challenge, _ := session.GenerateChallengeMessage()
+			w.Header().Add("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+			w.WriteHeader(401)
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", resp.StatusCode)
+	}
+
+	rechallenges = 1
+	transport.MaxRechallenges = 1
+	resp, err = (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Warmup(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	warmed := newTestTransport()
+	if err := warmed.Warmup(context.Background(), ts.URL, 4); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(ts.URL)
+	if n := warmed.pool.idleCounts()[hostKey(u)]; n != 4 {
+		t.Errorf("expected 4 idle connections over default idle limit, got %d", n)
+	}
+
+	transport := newTestTransport()
+	transport.Password = "wrong"
+	if err := transport.Warmup(context.Background(), ts.URL, 1); err == nil {
+		t.Error("expected warmup error with wrong password")
+	}
+
+	failing := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := newTestTransport().Warmup(context.Background(), failing.URL, 1); err == nil {
+		t.Error("expected warmup error with server error")
+	}
+}
+
+func Test_Close(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	transport := newTestTransport()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected in-flight request to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight request was not aborted")
+	}
+
+	if _, err := (&http.Client{Transport: transport}).Get(ts.URL); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func Test_CloseKeepsDefaultTransport(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	get := func(rt http.RoundTripper) bool {
+		var reused bool
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return reused
+	}
+
+	// connection of another client of the default transport
+	get(http.DefaultTransport)
+	transport := newTestTransport()
+	get(transport)
+	transport.Close()
+	if !get(http.DefaultTransport) {
+		t.Error("expected idle connections of the default transport to be kept")
+	}
+}
+
+func Test_MaxDrainBytes(t *testing.T) {
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+		if _, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil {
+			return
+		}
+
+		challenge, _ := session.GenerateChallengeMessage()
+		w.Header().Add("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+		w.WriteHeader(401)
+		w.Write(make([]byte, 1<<20))
+	}))
+	var mu sync.Mutex
+	conns := 0
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		maxDrainBytes int64
+		conns         int
+	}{{-1, 1}, {1024, 2}} {
+		mu.Lock()
+		conns = 0
+		mu.Unlock()
+
+		transport := newTestTransport()
+		transport.RoundTripper = &http.Transport{}
+		transport.MaxDrainBytes = tc.maxDrainBytes
+
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		mu.Lock()
+		if conns != tc.conns {
+			t.Errorf("MaxDrainBytes %d: expected %d connections, got %d", tc.maxDrainBytes, tc.conns, conns)
+		}
+		mu.Unlock()
+	}
+}
+
+func Test_PersistentAuth(t *testing.T) {
+	var mu sync.Mutex
+	handshakes := 0
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			mu.Lock()
+			handshakes++
+			mu.Unlock()
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.AnnotateRoundTrips = true
+	client := &http.Client{Transport: transport}
+	for i, roundTrips := range []string{"1", "0", "0"} {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get(RoundTripsHeader) != roundTrips {
+			t.Errorf("request %d: expected %s extra round trips, got %s", i, roundTrips, resp.Header.Get(RoundTripsHeader))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// type-1 and type-3 messages of a single handshake
+	if handshakes != 2 {
+		t.Errorf("expected single handshake, got %d authorized legs", handshakes)
+	}
+}
+
+func Test_GzippedUnauthorizedBody(t *testing.T) {
+	var mu sync.Mutex
+	encodings := map[string]bool{}
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("authenticated"))
+		gz.Close()
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		encodings[r.Header.Get("Accept-Encoding")] = true
+		mu.Unlock()
+
+		// 401 bodies are always compressed
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		handler(gw, r)
+		gw.Close()
+	}))
+	defer ts.Close()
+
+	for _, acceptEncoding := range []string{"", "gzip, deflate"} {
+		mu.Lock()
+		encodings = map[string]bool{}
+		mu.Unlock()
+
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := (&http.Client{Transport: newTestTransport()}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		// decompression is up to the caller when Accept-Encoding is set explicitly
+		if acceptEncoding == "" && string(body) != "authenticated" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if acceptEncoding != "" && resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Error("expected compressed response")
+		}
+
+		mu.Lock()
+		if len(encodings) != 1 {
+			t.Errorf("expected the same Accept-Encoding on all legs, got %v", encodings)
+		}
+		mu.Unlock()
+	}
+}
+
+// gzipResponseWriter compresses 401 responses
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+	if w.gz != nil {
+		w.gz.Write([]byte(strings.Repeat("unauthorized ", 100)))
+	}
+}
+
+func (w *gzipResponseWriter) Close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+func Test_Download(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	drops := 1
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if drops > 0 {
+			drops--
+			// send part of the content and drop the connection
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(content[:1000]))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	n, err := newTestTransport().Download(context.Background(), ts.URL, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) || buf.String() != content {
+		t.Errorf("downloaded content mismatch, got %d bytes", n)
+	}
+}
+
+func Test_RetryAfter(t *testing.T) {
+	throttled := 1
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if throttled > 0 {
+			throttled--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.MaxThrottleRetries = 1
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if d, ok := parseRetryAfter("Wed, 21 Oct 2015 07:28:10 GMT", time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)); !ok || d != 10*time.Second {
+		t.Errorf("unexpected Retry-After date delay %v", d)
+	}
+}
+
+// trailerBody sets checksum trailer of request once it's read to the end
+type trailerBody struct {
+	io.Reader
+	req *http.Request
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.req.Trailer.Set("X-Checksum", "abc")
+	}
+	return n, err
+}
+
+func (b *trailerBody) Close() error {
+	return nil
+}
+
+func Test_ReplayTrailers(t *testing.T) {
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+
+	rechallenges := 1
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("expected chunked request, got %v", r.TransferEncoding)
+		}
+		if r.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("expected trailer, got %v", r.Trailer)
+		}
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+		if _, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil && rechallenges > 0 {
+			rechallenges--
+			io.Copy(io.Discard, r.Body)
+			challenge, _ := session.GenerateChallengeMessage()
+			w.Header().Add("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+			w.WriteHeader(401)
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL, nil)
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Trailer = http.Header{"X-Checksum": nil}
+	req.Body = &trailerBody{Reader: strings.NewReader("payload"), req: req}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return &trailerBody{Reader: strings.NewReader("payload"), req: req}, nil
+	}
+
+	transport := newTestTransport()
+	transport.MaxRechallenges = 1
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	if err := newTestTransport().Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, transport := range []*NtlmTransport{
+		{},
+		{User: `dt\testuser`},
+		{User: "testuser", ChallengeHeader: "X Challenge"},
+		{User: "testuser", MaxRechallenges: -1},
+	} {
+		if err := transport.Validate(); err == nil {
+			t.Errorf("expected validation error for %q", transport.User)
+		}
+	}
+}
+
+func Test_RedactedPassword(t *testing.T) {
+	transport := newTestTransport()
+	client := &http.Client{Transport: transport}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, v := range []interface{}{transport, client} {
+			if s := fmt.Sprintf(format, v); strings.Contains(s, transport.Password) {
+				t.Errorf("password leaked with %s: %s", format, s)
+			}
+		}
+	}
+
+	creds := Credentials{Domain: "dt", User: "other", Password: "secret"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, v := range []interface{}{creds, &creds, []Credentials{creds}, struct{ Creds Credentials }{creds}} {
+			if s := fmt.Sprintf(format, v); strings.Contains(s, creds.Password) || !strings.Contains(s, creds.User) {
+				t.Errorf("password leaked with %s: %s", format, s)
+			}
+		}
+	}
+}
+
+func Test_FromConfig(t *testing.T) {
+	os.Setenv("HTTPNTLM_TEST_PASSWORD", "fish")
+	defer os.Unsetenv("HTTPNTLM_TEST_PASSWORD")
+
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"domain": "dt",
+		"user": "testuser",
+		"passwordEnv": "HTTPNTLM_TEST_PASSWORD",
+		"maxRetryAfter": "1m",
+		"dialTimeout": "5s"
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := FromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.Password != "fish" || transport.MaxRetryAfter != time.Minute || transport.RoundTripper == nil {
+		t.Errorf("unexpected transport %#v", transport)
+	}
+
+	cfg.User = ""
+	if _, err := FromConfig(cfg); err == nil {
+		t.Error("expected validation error")
+	}
+}
+
+// countingDialer counts established connections
+type countingDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	d.mu.Unlock()
+	return net.Dial(network, addr)
+}
+
+func Test_Dialer(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	dialer := &countingDialer{}
+	transport := newTestTransport()
+	transport.Dialer = dialer
+	for i := 0; i < 2; i++ {
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if dialer.dials != 1 {
+		t.Errorf("expected single connection established by dialer, got %d", dialer.dials)
+	}
+}
+
+// forwardProxy forwards requests upstream over a single connection
+func forwardProxy(t *testing.T) http.HandlerFunc {
+	upstream := &http.Transport{MaxConnsPerHost: 1}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := upstream.RoundTrip(r)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+func Test_ProxyAndOriginNTLM(t *testing.T) {
+	origin := httptest.NewServer(ntlmHandler(t, nil))
+	defer origin.Close()
+
+	proxy := httptest.NewServer(ntlmAuthenticator(http.StatusProxyAuthRequired, "Proxy-Authorization", "Proxy-Authenticate",
+		"proxyuser", "secret", "pd", forwardProxy(t)))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := newTestTransport()
+	transport.RoundTripper = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	transport.ProxyCredentials = &Credentials{Domain: "pd", User: "proxyuser", Password: "secret"}
+
+	resp, err := (&http.Client{Transport: transport}).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func Test_ConnectionOrientedKeepAlive(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.RoundTripper = &http.Transport{DisableKeepAlives: true}
+	transport.AnnotateRoundTrips = true
+	client := &http.Client{Transport: transport}
+	for i, roundTrips := range []string{"1", "0"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Close = true
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get(RoundTripsHeader) != roundTrips {
+			t.Errorf("request %d: expected %s extra round trips, got %s", i, roundTrips, resp.Header.Get(RoundTripsHeader))
+		}
+	}
+}
+
+func Test_ConcurrentHandshakes(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTestTransport()}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200, got %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_WithoutNTLM(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	req, _ := http.NewRequestWithContext(WithoutNTLM(context.Background()), "GET", ts.URL, nil)
+	resp, err := (&http.Client{Transport: newTestTransport()}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", resp.StatusCode)
+	}
+}
+
+func Test_CorrelationID(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var events [][]interface{}
+	transport := newTestTransport()
+	transport.CorrelationID = CorrelationIDFromHeader("X-Request-Id")
+	transport.Logger = LoggerFunc(func(msg string, keyvals ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, keyvals)
+	})
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		t.Fatal("expected handshake events")
+	}
+	for _, keyvals := range events {
+		n := len(keyvals)
+		if n < 2 || keyvals[n-2] != "correlation_id" || keyvals[n-1] != "req-1" {
+			t.Errorf("event without correlation ID: %v", keyvals)
+		}
+	}
+}
+
+func Test_PreemptiveNegotiate(t *testing.T) {
+	var mu sync.Mutex
+	var legs []string
+	uploads := 0
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		legs = append(legs, r.Method)
+		if string(body) == "payload" {
+			uploads++
+		}
+		mu.Unlock()
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTestTransport()}
+	post := func() []string {
+		mu.Lock()
+		legs, uploads = nil, 0
+		mu.Unlock()
+		resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if uploads != 1 {
+			t.Errorf("expected body to be uploaded once, got %d", uploads)
+		}
+		return legs
+	}
+
+	// the first request learns host offers NTLM only and keeps authentication on the connection
+	if l := post(); strings.Join(l, " ") != "GET POST" {
+		t.Errorf("unexpected legs of the first request %v", l)
+	}
+	if l := post(); strings.Join(l, " ") != "POST" {
+		t.Errorf("expected authenticated connection to be reused, got %v", l)
+	}
+	// fresh connection skips the direct request bound to be challenged
+	client.CloseIdleConnections()
+	if l := post(); strings.Join(l, " ") != "GET POST" {
+		t.Errorf("expected round trip to be saved on fresh connection, got %v", l)
+	}
+}
+
+func Test_OfferedSchemes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("WWW-Authenticate", `Basic realm="a, b", charset="UTF-8", Bearer`)
+		w.Header().Add("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	_, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	var schemeErr *SchemeError
+	if !errors.As(err, &schemeErr) {
+		t.Fatalf("expected scheme error, got %v", err)
+	}
+	if strings.Join(schemeErr.Schemes, " ") != "Basic Bearer Negotiate" {
+		t.Errorf("unexpected schemes %v", schemeErr.Schemes)
+	}
+
+	resp, err := (&http.Client{Transport: transport.RoundTripper}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if schemes := transport.OfferedSchemes(resp); len(schemes) != 3 {
+		t.Errorf("unexpected schemes %v", schemes)
+	}
+}
+
+func Test_DowngradeDetection(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "NTLM ") {
+			w.Header().Add("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+		challenge, _ := session.GenerateChallengeMessage()
+		// legacy server without target information
+		challenge.NegotiateFlags = ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO.Unset(challenge.NegotiateFlags)
+		challenge.TargetInfo = nil
+		challenge.TargetInfoPayloadStruct, _ = ntlm.CreateBytePayload(nil)
+		w.Header().Add("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	transport := newTestTransport()
+	transport.Metrics = MetricsFunc(func(name string, labels map[string]string, exemplar string) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[name]++
+	})
+
+	_, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	var downgradeErr *DowngradeError
+	if !errors.As(err, &downgradeErr) {
+		t.Fatalf("expected downgrade error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts[MetricV1Only] != 1 {
+		t.Errorf("expected single %s, got %d", MetricV1Only, counts[MetricV1Only])
+	}
+}
+
+func Test_RejectionErrors(t *testing.T) {
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ntlm.ParseAuthenticateMessage(ntlmMessage(r.Header.Get("Authorization")), 2); err == nil {
+			w.Header().Set("X-MS-Diagnostics", `4007;reason="Account is locked out"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "401 - Unauthorized")
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.RejectionErrors = true
+	_, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("expected rejection error, got %v", err)
+	}
+	if rejection.State != AccountLocked {
+		t.Errorf("expected locked account, got %s", rejection.State)
+	}
+	if body, _ := io.ReadAll(rejection.Response.Body); string(body) != "401 - Unauthorized" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+// ntlmMessage decodes NTLM message out of authorization header
+func ntlmMessage(h string) []byte {
+	b, _ := DecBase64(strings.TrimPrefix(h, "NTLM "))
+	return b
+}
+
+func Test_UploadProgress(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var reports []Progress
+	transport := newTestTransport()
+	transport.UploadProgress = func(req *http.Request, p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, p)
+	}
+
+	payload := strings.Repeat("x", 100<<10)
+	client := &http.Client{Transport: transport}
+	// second request sends the body with the negotiate message as well
+	for i := 0; i < 2; i++ {
+		mu.Lock()
+		reports = nil
+		mu.Unlock()
+
+		resp, err := client.Post(ts.URL, "text/plain", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+
+		mu.Lock()
+		if len(reports) == 0 {
+			t.Fatalf("request %d: no progress reported", i)
+		}
+		var last int64
+		for _, p := range reports {
+			if p.Sent <= last || p.Sent > p.Total {
+				t.Errorf("request %d: inconsistent progress %+v after %d", i, p, last)
+			}
+			last = p.Sent
+		}
+		if last != int64(len(payload)) {
+			t.Errorf("request %d: expected %d bytes sent, got %d", i, len(payload), last)
+		}
+		mu.Unlock()
+	}
+}
+
+func Test_CloneRequestWithBody(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://localhost/", io.NopCloser(strings.NewReader("payload")))
+	req.Header.Set("X-Test", "a")
+
+	clone, err := CloneRequestWithBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone.Header.Set("X-Test", "b")
+	if req.Header.Get("X-Test") != "a" {
+		t.Error("headers are shared with the clone")
+	}
+
+	for _, r := range []*http.Request{req, clone} {
+		if body, _ := io.ReadAll(r.Body); string(body) != "payload" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if r.GetBody == nil {
+			t.Fatal("GetBody is not installed")
+		}
+		body, _ := r.GetBody()
+		if b, _ := io.ReadAll(body); string(b) != "payload" {
+			t.Errorf("unexpected replayed body %q", b)
+		}
+	}
+}
+
+func Test_SeekableBody(t *testing.T) {
+	var posts int32
+	handler := rechallengedOnce(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("expected payload, got %q", body)
+		}
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	name := t.TempDir() + "/body"
+	if err := os.WriteFile(name, []byte("payload"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: newTestTransport()}
+	// second request is challenged again, so its body is replayed for the handshake
+	for i := 0; i < 2; i++ {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", ts.URL, f)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(&posts); n != 3 {
+		t.Errorf("expected body to be sent 3 times, got %d", n)
+	}
+}
+
+func Test_CommonBodiesReplayed(t *testing.T) {
+	var posts int32
+	handler := rechallengedOnce(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("expected payload, got %q", body)
+		}
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	bodies := map[string]func() io.Reader{
+		"buffer":         func() io.Reader { return bytes.NewBufferString("payload") },
+		"bytes reader":   func() io.Reader { return bytes.NewReader([]byte("payload")) },
+		"strings reader": func() io.Reader { return strings.NewReader("payload") },
+	}
+	for name, body := range bodies {
+		atomic.StoreInt32(&posts, 0)
+		client := &http.Client{Transport: newTestTransport()}
+		// second request is challenged again, so its body is replayed for the handshake
+		for i := 0; i < 2; i++ {
+			u, _ := url.Parse(ts.URL)
+			req := &http.Request{Method: "POST", URL: u, Header: http.Header{}, Body: io.NopCloser(body()), ContentLength: 7}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		if n := atomic.LoadInt32(&posts); n != 3 {
+			t.Errorf("%s: expected body to be sent 3 times, got %d", name, n)
+		}
+	}
+}
+
+func Test_ReplayContentLength(t *testing.T) {
+	var mu sync.Mutex
+	var lengths []string
+	handler := rechallengedOnce(ntlmHandler(t, nil))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			mu.Lock()
+			lengths = append(lengths, fmt.Sprintf("%d%v", r.ContentLength, r.TransferEncoding))
+			mu.Unlock()
+		}
+		io.Copy(io.Discard, r.Body)
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	name := t.TempDir() + "/body"
+	if err := os.WriteFile(name, []byte("payload"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		body     func() io.Reader
+		expected string
+		// bodyless requests carry the negotiate message themselves
+		sent int
+	}{
+		{"nil", func() io.Reader { return nil }, "0[]", 4},
+		{"empty", func() io.Reader { return bytes.NewReader(nil) }, "0[]", 4},
+		{"no body", func() io.Reader { return http.NoBody }, "0[]", 4},
+		{"bytes", func() io.Reader { return strings.NewReader("payload") }, "7[]", 3},
+		{"file", func() io.Reader {
+			f, _ := os.Open(name)
+			return f
+		}, "7[]", 3},
+	}
+	for _, c := range cases {
+		mu.Lock()
+		lengths = nil
+		mu.Unlock()
+
+		client := &http.Client{Transport: newTestTransport()}
+		// second request is challenged again, so its body is replayed for the handshake
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", ts.URL, c.body())
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		mu.Lock()
+		if len(lengths) != c.sent {
+			t.Errorf("%s: expected %d requests with body, got %v", c.name, c.sent, lengths)
+		}
+		for _, l := range lengths {
+			if l != c.expected {
+				t.Errorf("%s: expected Content-Length %s, got %s", c.name, c.expected, l)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func Test_StreamingRequest(t *testing.T) {
+	var posts int32
+	handler := rechallengedOnce(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("expected payload, got %q", body)
+		}
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("expected chunked body, got %v", r.TransferEncoding)
+		}
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTestTransport()}
+	// second request is challenged again, so the stream is regenerated for the handshake
+	for i := 0; i < 2; i++ {
+		req, err := NewStreamingRequest(context.Background(), "POST", ts.URL, func(w io.Writer) error {
+			for _, s := range []string{"pay", "lo", "ad"} {
+				if _, err := io.WriteString(w, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(&posts); n != 3 {
+		t.Errorf("expected stream to be sent 3 times, got %d", n)
+	}
+}
+
+func Test_StreamingBodyReadAfterClose(t *testing.T) {
+	started := make(chan struct{}, 2)
+	req, err := NewStreamingRequest(context.Background(), "POST", "http://localhost", func(w io.Writer) error {
+		started <- struct{}{}
+		_, err := io.WriteString(w, "payload")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := req.Body.Read(make([]byte, 8)); err != http.ErrBodyReadAfterClose {
+		t.Errorf("expected read after close to fail, got %v", err)
+	}
+
+	body, _ := req.GetBody()
+	if b, err := io.ReadAll(io.LimitReader(body, 7)); err != nil || string(b) != "payload" {
+		t.Errorf("expected payload, got %q %v", b, err)
+	}
+	body.Close()
+	if _, err := body.Read(make([]byte, 8)); err != http.ErrBodyReadAfterClose {
+		t.Errorf("expected read after close to fail, got %v", err)
+	}
+	if len(started) != 1 {
+		t.Errorf("expected producer to start only for the body read, got %d", len(started))
+	}
+}
+
+func Test_CompressedUploadReplay(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("payload"))
+	zw.Close()
+	compressed := buf.Bytes()
+
+	var posts int32
+	check := func(r *http.Request) {
+		if ce := r.Header.Values("Content-Encoding"); len(ce) != 1 || ce[0] != "gzip" {
+			t.Errorf("expected single gzip Content-Encoding, got %v", ce)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body isn't gzipped: %v", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		if string(body) != "payload" {
+			t.Errorf("expected payload compressed once, got %q", body)
+		}
+	}
+	handler := rechallengedOnce(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		check(r)
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && atomic.AddInt32(&posts, 1) == 2 {
+			// challenged request on the authenticated connection
+			check(r)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTestTransport()}
+	// second request is challenged again, so its body is replayed for the handshake
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", ts.URL, bytes.NewReader(compressed))
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(&posts); n != 3 {
+		t.Errorf("expected body to be sent 3 times, got %d", n)
+	}
+}
+
+func Test_ConnectionLostDuringHandshake(t *testing.T) {
+	var challenges int32
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := ntlmMessage(r.Header.Get("Authorization"))
+		if _, err := ntlm.ParseAuthenticateMessage(msg, 2); err != nil && len(msg) > 0 && atomic.AddInt32(&challenges, 1) == 1 {
+			// middlebox drops the connection right after the challenge
+			w.Header().Set("Connection", "close")
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	resp, err := (&http.Client{Transport: newTestTransport()}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&challenges); n != 2 {
+		t.Errorf("expected handshake to be repeated once, got %d challenges", n)
+	}
+}
+
+func Test_RetryBudget(t *testing.T) {
+	var negotiations int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.AddInt32(&negotiations, 1)
+		}
+		w.Header().Add("WWW-Authenticate", "NTLM")
+		w.WriteHeader(401)
+	}))
+	defer ts.Close()
+
+	budget := &RetryBudget{Window: time.Hour, PerHost: 4}
+	for i, expected := range []int32{4, 2} {
+		atomic.StoreInt32(&negotiations, 0)
+		transport := newTestTransport()
+		transport.EmptyChallengeRetries = 3
+		transport.RetryBudget = budget
+		if _, err := (&http.Client{Transport: transport}).Get(ts.URL); !errors.Is(err, errEmptyNtlm) {
+			t.Fatalf("expected empty challenge error, got %v", err)
+		}
+		// second transport shares the budget, one retry is left
+		if n := atomic.LoadInt32(&negotiations); n != expected {
+			t.Errorf("request %d: expected %d handshakes, got %d", i, expected, n)
+		}
+	}
+}
+
+func Test_Probe(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	result, err := transport.Probe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || result.Err != nil || result.StatusCode != http.StatusOK {
+		t.Errorf("expected successful probe, got %+v", result)
+	}
+	if len(result.Schemes) != 1 || result.Schemes[0] != "NTLM" {
+		t.Errorf("unexpected schemes %v", result.Schemes)
+	}
+	if !ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(result.Flags) {
+		t.Errorf("expected challenge flags, got %x", result.Flags)
+	}
+	var stages []string
+	for _, leg := range result.Legs {
+		stages = append(stages, string(leg.Stage))
+	}
+	if strings.Join(stages, " ") != "anonymous negotiate authenticate" {
+		t.Errorf("unexpected legs %v", stages)
+	}
+
+	transport.Password = "wrong"
+	result, err = transport.Probe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejection *RejectionError
+	if result.Success || !errors.As(result.Err, &rejection) || result.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected rejected probe, got %+v", result)
+	}
+}
+
+func Test_InvalidateHost(t *testing.T) {
+	var handshakes int32
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.AddInt32(&handshakes, 1)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	transport := newTestTransport()
+	client := &http.Client{Transport: transport}
+	get := func() {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	get()
+	transport.InvalidateHost(u.Host)
+	if transport.authCache().get(hostKey(u)).persistentAuth {
+		t.Error("host knowledge wasn't forgotten")
+	}
+	get()
+	transport.InvalidateAll()
+	get()
+
+	// type-1 and type-3 messages of three handshakes
+	if n := atomic.LoadInt32(&handshakes); n != 6 {
+		t.Errorf("expected 3 handshakes, got %d authorized legs", n)
+	}
+}
+
+func Test_CacheTTL(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.CacheTTL = 50 * time.Millisecond
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	u, _ := url.Parse(ts.URL)
+	if !transport.authCache().get(hostKey(u)).persistentAuth {
+		t.Fatal("expected persistent authentication to be learned")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if transport.authCache().get(hostKey(u)).persistentAuth {
+		t.Error("expected host knowledge to expire")
+	}
+}
+
+func Test_CacheSnapshot(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	data, err := json.Marshal(transport.ExportCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot CacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestTransport()
+	restored.ImportCache(snapshot)
+	u, _ := url.Parse(ts.URL)
+	if info := restored.authCache().get(hostKey(u)); !info.persistentAuth || !info.ntlmOnly {
+		t.Errorf("host knowledge wasn't restored from %s", data)
+	}
+}
+
+func Test_SessionManager(t *testing.T) {
+	first := httptest.NewServer(ntlmHandler(t, nil))
+	defer first.Close()
+	second := httptest.NewServer(ntlmHandler(t, nil))
+	defer second.Close()
+
+	var configured []string
+	m := &SessionManager{
+		Config: Config{Domain: "dt", User: "testuser", Password: "fish"},
+		Configure: func(host string, t *NtlmTransport) {
+			configured = append(configured, host)
+		},
+	}
+	defer m.Close()
+
+	client := &http.Client{Transport: m}
+	for _, u := range []string{first.URL, second.URL, first.URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	if len(configured) != 2 {
+		t.Errorf("expected transport per host, got %v", configured)
+	}
+
+	a, _ := m.Transport(first.URL + "/path")
+	b, _ := m.Transport(first.URL)
+	if a != b {
+		t.Error("expected the same transport for the same host")
+	}
+}
+
+func Test_BearerFallback(t *testing.T) {
+	var bearers, leaked int32
+	ntlmOnly := ntlmHandler(t, nil)
+	hybrid := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer good" {
+			return
+		}
+		w.Header().Add("WWW-Authenticate", "Bearer")
+		ntlmOnly(w, r)
+	}))
+	defer hybrid.Close()
+	legacy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			atomic.AddInt32(&bearers, 1)
+			r.Header.Del("Authorization")
+		}
+		ntlmOnly(w, r)
+	}))
+	defer legacy.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			atomic.AddInt32(&leaked, 1)
+		}
+		w.Header().Add("WWW-Authenticate", "Bearer")
+		ntlmOnly(w, r)
+	}))
+	defer plain.Close()
+
+	token := "good"
+	transport := newTestTransport()
+	transport.AnnotateRoundTrips = true
+	transport.RoundTripper = hybrid.Client().Transport
+	transport.TokenSource = TokenSourceFunc(func(ctx context.Context) (string, error) {
+		return token, nil
+	})
+	client := &http.Client{Transport: transport}
+	get := func(u string) *http.Response {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		return resp
+	}
+
+	// token is sent only once the host offered Bearer
+	if resp := get(hybrid.URL); resp.Header.Get(RoundTripsHeader) == "0" {
+		t.Error("expected NTLM before host offered Bearer")
+	}
+	if resp := get(hybrid.URL); resp.Header.Get(RoundTripsHeader) != "0" {
+		t.Errorf("expected bearer token to be used, got %s extra round trips", resp.Header.Get(RoundTripsHeader))
+	}
+	token = ""
+	if resp := get(hybrid.URL); resp.Header.Get(RoundTripsHeader) != "1" {
+		t.Errorf("expected NTLM without token, got %s extra round trips", resp.Header.Get(RoundTripsHeader))
+	}
+
+	token = "good"
+	get(legacy.URL)
+	if n := atomic.LoadInt32(&bearers); n != 0 {
+		t.Errorf("expected host which didn't offer Bearer not to get the token, got %d", n)
+	}
+	// connection authenticated by NTLM would accept any request
+	transport.CloseIdleConnections()
+	transport.BearerHosts = []string{legacy.URL}
+	get(legacy.URL)
+	get(legacy.URL)
+	if n := atomic.LoadInt32(&bearers); n != 1 {
+		t.Errorf("expected configured host without Bearer to be tried once, got %d", n)
+	}
+
+	get(plain.URL)
+	get(plain.URL)
+	if n := atomic.LoadInt32(&leaked); n != 0 {
+		t.Errorf("expected no token over plain http, got %d", n)
+	}
+}
+
+func Test_TargetPolicy(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	base := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+		},
+	}
+	transport := newTestTransport()
+	transport.RoundTripper = base
+	transport.TargetPolicy = TargetRefuse
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://Synthetics-HTTP-Agent.sematext.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the challenging computer to authenticate, got %d", resp.StatusCode)
+	}
+
+	// neither other hosts of the domain nor hosts named as the computer elsewhere are trusted
+	for _, u := range []string{"http://intranet.example.com/", "http://www.sematext.com/", "http://synthetics-http-agent.evil.com/"} {
+		_, err = client.Get(u)
+		var mismatch *TargetMismatchError
+		if !errors.As(err, &mismatch) || mismatch.ComputerName != "synthetics-http-agent.sematext.com" {
+			t.Fatalf("expected target mismatch of %s, got %v", u, err)
+		}
+	}
+
+	transport.TargetAliases = map[string][]string{"WWW.sematext.com": {"synthetics-http-agent.sematext.com"}}
+	resp, err = client.Get("http://www.sematext.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	transport.TargetPolicy = TargetWarn
+	resp, err = client.Get("http://intranet.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func Test_Clone(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	base := &http.Transport{MaxIdleConnsPerHost: 3}
+	transport := newTestTransport()
+	transport.RoundTripper = base
+	transport.ProxyCredentials = &Credentials{User: "proxyuser"}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	transport.Close()
+
+	clone := transport.Clone()
+	u, _ := url.Parse(ts.URL)
+	if clone.authCache().get(hostKey(u)).persistentAuth {
+		t.Error("clone shares host knowledge")
+	}
+	if tr, ok := clone.RoundTripper.(*http.Transport); !ok || tr == base || tr.MaxIdleConnsPerHost != 3 {
+		t.Errorf("expected cloned base transport, got %#v", clone.RoundTripper)
+	}
+	if clone.ProxyCredentials == transport.ProxyCredentials || clone.ProxyCredentials.User != "proxyuser" {
+		t.Errorf("expected copied proxy credentials, got %+v", clone.ProxyCredentials)
+	}
+
+	resp, err = (&http.Client{Transport: clone}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("clone of closed transport failed with %d", resp.StatusCode)
+	}
+}
+
+func Test_DefaultTransport(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	transport := DefaultTransport.Clone()
+	transport.Domain, transport.User, transport.Password = "dt", "testuser", "fish"
+	client := *DefaultClient
+	client.Transport = transport
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authenticated request, got %d", resp.StatusCode)
+	}
+
+	base := transport.RoundTripper.(*http.Transport)
+	if base == DefaultTransport.RoundTripper || base.TLSNextProto == nil || base.Proxy == nil {
+		t.Errorf("unexpected base transport %#v", base)
+	}
+}
+
+// spec decodes hex dump of MS-NLMP example, whitespace is ignored
+func spec(dump string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(dump), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// MS-NLMP 4.2.1 common values: User, Password, Domain, server challenge 0123456789abcdef
+var specChallenge = spec(`
+	4e544c4d53535000020000000c000c00 3800000033828ae20123456789abcdef
+	00000000000000002400240044000000 060070170000000f5300650072007600
+	6500720002000c0044006f006d006100 69006e0001000c005300650072007600
+	6500720000000000`)
+
+func Test_MSNLMPVectors(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      ntlm.Version
+		authenticate []byte
+		// expected client keys, not checked if empty
+		signingKey, sealingKey string
+	}{
+		{
+			name:    "NTLMv1 4.2.2.3",
+			version: ntlm.Version1,
+			authenticate: spec(`
+				4e544c4d535350000300000018001800 6c00000018001800840000000c000c00
+				48000000080008005400000010001000 5c000000100010009c000000358280e2
+				0501280a0000000f44006f006d006100 69006e00550073006500720043004f00
+				4d005000550054004500520098def7b8 7f88aa5dafe2df779688a172def11c7d
+				5ccdef1367c43011f30298a2ad35ece6 4f16331c44bdbed927841f94518822b1
+				b3f350c8958682ecbb3e3cb7`),
+		},
+		{
+			name:    "NTLMv1 with client challenge 4.2.3.3",
+			version: ntlm.Version1,
+			authenticate: spec(`
+				4e544c4d535350000300000018001800 6c00000018001800840000000c000c00
+				48000000080008005400000010001000 5c000000000000009c00000035820882
+				0501280a0000000f44006f006d006100 69006e00550073006500720043004f00
+				4d0050005500540045005200aaaaaaaa aaaaaaaa000000000000000000000000
+				000000007537f803ae367128ca458204 bde7caf81e97ed2683267232`),
+			signingKey: "60e799be5c72fc92922ae8ebe961fb8d",
+			sealingKey: "04dd7f014d8504d265a25cc86a3a7c06",
+		},
+		{
+			name:    "NTLMv2 4.2.4.3",
+			version: ntlm.Version2,
+			authenticate: spec(`
+				4e544c4d535350000300000018001800 6c00000054005400840000000c000c00
+				48000000080008005400000010001000 5c00000010001000d8000000358288e2
+				0501280a0000000f44006f006d006100 69006e00550073006500720043004f00
+				4d005000550054004500520086c35097 ac9cec102554764a57cccc19aaaaaaaa
+				aaaaaaaa68cd0ab851e51c96aabc927b ebef6a1c010100000000000000000000
+				00000000aaaaaaaaaaaaaaaa00000000 02000c0044006f006d00610069006e00
+				01000c00530065007200760065007200 0000000000000000c5dad2544fc97990
+				94ce1ce90bc9d03e`),
+			signingKey: "4788dc861b4782f35d43fd98fe1a2d39",
+			sealingKey: "59f600973cc4960a25480a7c196e4c58",
+		},
+	}
+
+	challenge, err := ntlm.ParseChallengeMessage(specChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge.NegotiateFlags != 0xe28a8233 || challenge.TargetInfo.StringValue(ntlm.MsvAvNbComputerName) != "Server" {
+		t.Errorf("unexpected challenge %s", challenge)
+	}
+	if v1Only(challenge) {
+		t.Error("NTLMv2 challenge taken for NTLMv1 only one")
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := ntlm.ParseAuthenticateMessage(tt.authenticate, int(tt.version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, _ := ntlm.CreateServerSession(tt.version, ntlm.ConnectionlessMode)
+			session.SetUserInfo("User", "Password", "Domain", "")
+			session.SetServerChallenge(challenge.ServerChallenge)
+			if err := session.ProcessAuthenticateMessage(auth); err != nil {
+				t.Fatalf("specification response rejected: %v", err)
+			}
+
+			data := session.GetSessionData()
+			if tt.signingKey != "" && hex.EncodeToString(data.ClientSigningKey) != tt.signingKey {
+				t.Errorf("expected signing key %s, got %x", tt.signingKey, data.ClientSigningKey)
+			}
+			if tt.sealingKey != "" && hex.EncodeToString(data.ClientSealingKey) != tt.sealingKey {
+				t.Errorf("expected sealing key %s, got %x", tt.sealingKey, data.ClientSealingKey)
+			}
+		})
+	}
+}
+
+func Test_NegotiateMessage(t *testing.T) {
+	expected := spec(`
+		4e544c4d5353500001000000078208e2
+		00000000000000000000000028000000 0601b11d0000000f`)
+	if b := Negotiate(); !bytes.Equal(b, expected) {
+		t.Errorf("expected negotiate message %x, got %x", expected, b)
+	}
+}
+
+func Test_Faults(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	get := func(faults map[Stage]Fault) (*http.Response, error) {
+		transport := newTestTransport()
+		transport.Faults = faults
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get(map[Stage]Fault{StageNegotiate: FaultDropChallenge}); err == nil {
+		t.Error("expected error for dropped challenge")
+	}
+	if _, err := get(map[Stage]Fault{StageNegotiate: FaultCorruptChallenge}); err == nil {
+		t.Error("expected error for corrupted challenge")
+	}
+	if _, err := get(map[Stage]Fault{StageAuthenticate: FaultError}); !errors.Is(err, ErrFaultInjected) {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	// every challenge is bound to a closed connection
+	resp, err := get(map[Stage]Fault{StageNegotiate: FaultCloseConnection})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 when connection is closed after negotiate, got %d", resp.StatusCode)
+	}
+}
+
+func Test_IdentityPool(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	pool := NewIdentityPool(newTestTransport(), []Credentials{
+		{Domain: "dt", User: "testuser", Password: "fish"},
+		{Domain: "dt", User: "testuser", Password: "wrong"},
+	})
+	defer pool.Close()
+	client := &http.Client{Transport: pool}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := pool.Stats()
+	if stats[0].Requests != 2 || stats[0].Failures != 0 || stats[0].Handshakes != 1 || stats[0].HandshakeTime <= 0 {
+		t.Errorf("unexpected stats of valid identity %+v", stats[0])
+	}
+	if stats[1].Requests != 2 || stats[1].Failures != 2 || stats[1].Handshakes != 2 {
+		t.Errorf("unexpected stats of rejected identity %+v", stats[1])
+	}
+}
+
+func Test_HandshakeLimiter(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.HandshakeLimiter = &HandshakeLimiter{Rate: 20, Burst: 2}
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// two handshakes of the burst start at once, the others wait 50ms each
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("handshakes weren't limited, took %s", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	transport.HandshakeLimiter.Rate = 0.1
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected wait to end with context, got %v", err)
+	}
+}
+
+func Test_ExpvarMetrics(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	transport, err := FromConfig(Config{Domain: "dt", User: "testuser", Password: "fish", Expvar: "ntlm_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(expvar.Get("ntlm_test").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars[MetricHandshakes] != 1.0 || vars[MetricCacheHits] != 2.0 || vars[MetricCacheMisses] != 1.0 || vars[MetricHandshakeFailures] != nil {
+		t.Errorf("unexpected counters %v", vars)
+	}
+	if ratio := vars["ntlm_cache_hit_ratio"].(float64); ratio < 0.66 || ratio > 0.67 {
+		t.Errorf("unexpected cache hit ratio %v", ratio)
+	}
+	if NewExpvarMetrics("ntlm_test").m != transport.Metrics.(*ExpvarMetrics).m {
+		t.Error("expected existing expvar map to be reused")
+	}
+}
+
+func Test_ChallengeFlagTelemetry(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var flags []map[string]string
+	transport := newTestTransport()
+	transport.Metrics = MetricsFunc(func(name string, labels map[string]string, exemplar string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if name == MetricChallengeFlags {
+			flags = append(flags, labels)
+		}
+	})
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flags) != 1 {
+		t.Fatalf("expected single challenge, got %v", flags)
+	}
+	if f := flags[0]; f["v2"] != "true" || f["target_info"] != "true" || f["target"] != "origin" || f["lm_key"] != "false" {
+		t.Errorf("unexpected challenge flags %v", f)
+	}
+}
+
+func Test_TLSPolicy(t *testing.T) {
+	suite := "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	transport, err := FromConfig(Config{User: "testuser", MinTLSVersion: "1.2", CipherSuites: []string{suite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := transport.base().(*http.Transport).TLSClientConfig
+	if tlsConfig.MinVersion != tls.VersionTLS12 || len(tlsConfig.CipherSuites) != 1 || tls.CipherSuiteName(tlsConfig.CipherSuites[0]) != suite {
+		t.Errorf("unexpected TLS config %+v", tlsConfig)
+	}
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.CipherSuites != nil {
+		t.Error("default transport was modified")
+	}
+
+	transport, err = FromConfig(Config{User: "testuser", MinTLSVersion: "1.3", DialTimeout: Duration(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := transport.RoundTripper.(*http.Transport).TLSClientConfig.MinVersion; v != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 minimum, got %x", v)
+	}
+
+	if _, err := FromConfig(Config{User: "testuser", CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}); err == nil {
+		t.Error("expected insecure cipher suite to be refused")
+	}
+	invalid := &NtlmTransport{User: "testuser", MinTLSVersion: tls.VersionTLS12, RoundTripper: &http.Transport{}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("expected TLS policy with RoundTripper to be invalid")
+	}
+}
+
+// specCrypto returns MS-NLMP example client challenge and session key instead of random bytes
+type specCrypto struct {
+	CryptoProvider
+}
+
+func (specCrypto) Random(b []byte) error {
+	fill := byte(0xaa)
+	if len(b) == 16 {
+		fill = 0x55
+	}
+	for i := range b {
+		b[i] = fill
+	}
+	return nil
+}
+
+func Test_CryptoProvider(t *testing.T) {
+	challenge, _ := ntlm.ParseChallengeMessage(specChallenge)
+	msg, err := ntlmv2Authenticate(specCrypto{DefaultCrypto}, Credentials{Domain: "Domain", User: "User", Password: "Password", Workstation: "COMPUTER"},
+		challenge, time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := ntlm.ParseAuthenticateMessage(msg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MS-NLMP 4.2.4.2
+	if nt := hex.EncodeToString(auth.NtChallengeResponseFields.Payload[:16]); nt != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("unexpected NTProofStr %s", nt)
+	}
+	if lm := hex.EncodeToString(auth.LmChallengeResponse.Payload); lm != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("unexpected LMv2 response %s", lm)
+	}
+	if key := hex.EncodeToString(auth.EncryptedRandomSessionKey.Payload); key != "c5dad2544fc9799094ce1ce90bc9d03e" {
+		t.Errorf("unexpected encrypted session key %s", key)
+	}
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("User", "Password", "Domain", "")
+	session.SetServerChallenge(challenge.ServerChallenge)
+	if err := session.ProcessAuthenticateMessage(auth); err != nil {
+		t.Errorf("authenticate message rejected: %v", err)
+	}
+
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+	transport := newTestTransport()
+	transport.Crypto = DefaultCrypto
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authentication with crypto provider, got %d", resp.StatusCode)
+	}
+}
+
+func Test_AuditSink(t *testing.T) {
+	ts := httptest.NewTLSServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	var records []AuditRecord
+	get := func(password string) {
+		transport := newTestTransport()
+		transport.Password = password
+		transport.RoundTripper = ts.Client().Transport
+		transport.AuditSink = AuditSinkFunc(func(record AuditRecord) {
+			records = append(records, record)
+		})
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get("fish")
+	get("wrong")
+	if len(records) != 2 {
+		t.Fatalf("expected record of every handshake, got %+v", records)
+	}
+	sum := sha256.Sum256(ts.Certificate().Raw)
+	if r := records[0]; r.Outcome != AuditSuccess || r.User != "testuser" || r.Domain != "dt" ||
+		r.StatusCode != http.StatusOK || r.TLSFingerprint != hex.EncodeToString(sum[:]) || r.Time.IsZero() {
+		t.Errorf("unexpected record of successful handshake %+v", r)
+	}
+	if r := records[1]; r.Outcome != AuditRejected || r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected record of rejected handshake %+v", r)
+	}
+}
+
+func Test_ClockSkew(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "NTLM ") {
+			session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+			challenge, _ := session.GenerateChallengeMessage()
+			if msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")); len(msg) > 8 && msg[8] == 1 {
+				// server clock is an hour ahead
+				pairs := &ntlm.AvPairs{}
+				for _, p := range challenge.TargetInfo.List {
+					if p.AvId != ntlm.MsvAvEOL {
+						pairs.AddAvPair(p.AvId, p.Value)
+					}
+				}
+				pairs.AddAvPair(ntlm.MsvAvTimestamp, fileTime(time.Now().Add(time.Hour)))
+				pairs.AddAvPair(ntlm.MsvAvEOL, nil)
+				challenge.TargetInfo = pairs
+				challenge.TargetInfoPayloadStruct, _ = ntlm.CreateBytePayload(pairs.Bytes())
+
+				w.Header().Set("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	get := func(skew time.Duration) (*http.Response, error) {
+		transport := newTestTransport()
+		transport.MaxClockSkew = 5 * time.Minute
+		transport.ClockSkew = skew
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	var skewErr *ClockSkewError
+	if _, err := get(0); !errors.As(err, &skewErr) || skewErr.Skew < 59*time.Minute || skewErr.Skew > 61*time.Minute {
+		t.Errorf("expected clock skew error, got %v", err)
+	}
+	resp, err := get(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected rejection when clock is adjusted, got %d", resp.StatusCode)
+	}
+}
+
+// countingBackend counts messages computed by the transport's own backend
+type countingBackend struct {
+	next          Backend
+	users         []string
+	negotiates    int
+	authenticates int
+}
+
+func (b *countingBackend) NewSession(creds Credentials) (Session, error) {
+	b.users = append(b.users, creds.User)
+	s, err := b.next.NewSession(creds)
+	return &countingSession{s, b}, err
+}
+
+type countingSession struct {
+	Session
+	b *countingBackend
+}
+
+func (s *countingSession) Negotiate() ([]byte, error) {
+	s.b.negotiates++
+	return s.Session.Negotiate()
+}
+
+func (s *countingSession) Authenticate(challenge []byte) ([]byte, error) {
+	s.b.authenticates++
+	return s.Session.Authenticate(challenge)
+}
+
+func Test_Backend(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	backend := &countingBackend{next: transport.backend()}
+	transport.Backend = backend
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected backend messages to authenticate, got %d", resp.StatusCode)
+	}
+	if backend.negotiates != 1 || backend.authenticates != 1 || len(backend.users) != 1 || backend.users[0] != "testuser" {
+		t.Errorf("unexpected backend use %+v", backend)
+	}
+}
+
+func Test_CryptoFuncs(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	var hashed int
+	transport := newTestTransport()
+	transport.Crypto = CryptoFuncs{MD4Func: func(data []byte) []byte {
+		hashed++
+		return DefaultCrypto.MD4(data)
+	}}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || hashed != 1 {
+		t.Errorf("expected authentication with replaced MD4, got %d after %d hashes", resp.StatusCode, hashed)
+	}
+}
+
+func Test_ParseMessages(t *testing.T) {
+	negotiate, err := ParseNegotiateMessage(Negotiate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := negotiate.Version(); !negotiate.Flags().Has(FlagNTLM|FlagKeyExch) || !ok || v.String() != "6.1.7601 rev 15" {
+		t.Errorf("unexpected negotiate message %s %v", negotiate.Flags(), v)
+	}
+
+	// MS-NLMP 4.2.4.3
+	challenge, err := ParseChallengeMessage(specChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := challenge.TargetInfo()
+	if !ok || info.NbDomainName != "Domain" || info.NbComputerName != "Server" || !info.Timestamp.IsZero() {
+		t.Errorf("unexpected target info %+v", info)
+	}
+	if challenge.TargetName() != "Server" || !challenge.Flags().Has(FlagTargetInfo) || len(challenge.ServerChallenge()) != 8 {
+		t.Errorf("unexpected challenge %q %s", challenge.TargetName(), challenge.Flags())
+	}
+	if _, err := ParseChallengeMessage(Negotiate()); err == nil {
+		t.Error("expected error for negotiate message parsed as challenge")
+	}
+
+	msg, err := newTestTransport().authenticateMessage(Credentials{Domain: "dt", User: "testuser", Password: "fish", Workstation: "WS"}, challenge.m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := ParseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticate.User() != "testuser" || authenticate.Domain() != "dt" || authenticate.Workstation() != "WS" || !authenticate.NTLMv2() {
+		t.Errorf("unexpected authenticate message %s %s %s", authenticate.Domain(), authenticate.User(), authenticate.Workstation())
+	}
+}
+
+func Test_RenewSessions(t *testing.T) {
+	var recycled int32
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+		// app pool recycle loses the challenge
+		if len(msg) > 8 && msg[8] == 3 && atomic.CompareAndSwapInt32(&recycled, 1, 0) {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	get := func(transport *NtlmTransport) int {
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	transport := newTestTransport()
+	renewals := 0
+	transport.Metrics = MetricsFunc(func(name string, labels map[string]string, exemplar string) {
+		if name == MetricSessionRenewals {
+			renewals++
+		}
+	})
+	get(transport)
+	atomic.StoreInt32(&recycled, 1)
+	if status := get(transport); status != http.StatusUnauthorized || renewals != 0 {
+		t.Errorf("expected rejection to be returned without RenewSessions, got %d after %d renewals", status, renewals)
+	}
+
+	transport.RenewSessions = true
+	get(transport)
+	atomic.StoreInt32(&recycled, 1)
+	if status := get(transport); status != http.StatusOK || renewals != 1 {
+		t.Errorf("expected renewed session, got %d after %d renewals", status, renewals)
+	}
+
+	// credentials rejected for good aren't retried
+	transport.Password = "wrong"
+	if status := get(transport); status != http.StatusUnauthorized || renewals != 2 {
+		t.Errorf("expected single renewal of rejected credentials, got %d after %d renewals", status, renewals)
+	}
+	if status := get(transport); status != http.StatusUnauthorized || renewals != 2 {
+		t.Errorf("expected no renewal after rejection, got %d after %d renewals", status, renewals)
+	}
+}
+
+func Test_HandshakeUserAgent(t *testing.T) {
+	var negotiateUA []string
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")); len(msg) > 8 && msg[8] == 1 {
+			negotiateUA = append(negotiateUA, r.UserAgent())
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	get := func(transport *NtlmTransport) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("User-Agent", "legacy-app/1.0")
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get(newTestTransport())
+	transport := newTestTransport()
+	transport.HandshakeUserAgent = "probe/2.0"
+	get(transport)
+	if len(negotiateUA) != 2 || negotiateUA[0] != "legacy-app/1.0" || negotiateUA[1] != "probe/2.0" {
+		t.Errorf("unexpected negotiate User-Agents %v", negotiateUA)
+	}
+}
+
+func Test_DebugEnv(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	enabled, logger := debugEnabled, debugLog
+	debugEnabled, debugLog = true, log.New(&out, "", 0)
+	defer func() {
+		debugEnabled, debugLog = enabled, logger
+	}()
+
+	resp, err := (&http.Client{Transport: newTestTransport()}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	s := out.String()
+	for _, expected := range []string{"> negotiate GET", "NTLM negotiate flags=", "NTLM challenge flags=", `computer="synthetics-http-agent.sematext.com"`,
+		`NTLM authenticate user="dt\\testuser"`, "ntlmv2=true", "< authenticate 200 OK"} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("expected %q in debug log:\n%s", expected, s)
+		}
+	}
+	if strings.Contains(s, "TlRMTVNTUA") {
+		t.Errorf("raw tokens logged:\n%s", s)
+	}
+	if summarizeAuth("Bearer secret") != "Bearer <redacted>" {
+		t.Error("expected bearer token to be redacted")
+	}
+}
+
+func Test_As(t *testing.T) {
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	handler := ntlmAuthenticator(http.StatusUnauthorized, "Authorization", "WWW-Authenticate", "other", "secret", "dt", nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	view := transport.As(Credentials{Domain: "dt", User: "other", Password: "secret"})
+	if view != transport.As(Credentials{Domain: "dt", User: "other", Password: "secret"}) {
+		t.Error("expected view to be reused for the same credentials")
+	}
+	if transport.User != "testuser" || view.User != "other" {
+		t.Errorf("unexpected users %s %s", transport.User, view.User)
+	}
+
+	get := func(rt http.RoundTripper) int {
+		resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get(view); status != http.StatusOK {
+		t.Errorf("expected view to authenticate, got %d", status)
+	}
+	if status := get(transport); status != http.StatusUnauthorized {
+		t.Errorf("expected own credentials to be rejected, got %d", status)
+	}
+	if len(conns) != 2 {
+		t.Errorf("expected separate connections, got %d", len(conns))
+	}
+
+	if transport.As(Credentials{Domain: "dt", User: "other", Password: "changed"}) == view {
+		t.Error("expected view to be replaced once password changed")
+	}
+	view = transport.As(Credentials{Domain: "dt", User: "other", Password: "secret"})
+	transport.MaxViews = 2
+	transport.As(Credentials{Domain: "dt", User: "second", Password: "secret"})
+	transport.As(Credentials{Domain: "dt", User: "third", Password: "secret"})
+	if n := len(transport.views.all()); n != 2 {
+		t.Errorf("expected 2 views to be kept, got %d", n)
+	}
+	if transport.As(Credentials{Domain: "dt", User: "other", Password: "secret"}) == view {
+		t.Error("expected least recently used view to be evicted")
+	}
+	view = transport.As(Credentials{Domain: "dt", User: "other", Password: "secret"})
+
+	transport.Close()
+	if _, err := view.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL, nil)); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected view to be closed, got %v", err)
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	var stats []RequestStats
+	transport := newTestTransport()
+	transport.Stats = func(req *http.Request, s RequestStats) {
+		stats = append(stats, s)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(stats) != 1 {
+		t.Fatalf("expected stats of a single request, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Requests != 2 || s.Legs[StageNegotiate] <= 0 || s.Legs[StageAuthenticate] < 20*time.Millisecond ||
+		s.Total < s.Legs[StageNegotiate]+s.Legs[StageAuthenticate] || s.Overhead < s.Legs[StageNegotiate] || s.Overhead >= s.Total || s.Err != nil {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func Test_AddressFailover(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// host resolves to an address nobody listens on first
+	lookup := lookupHost
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+	defer func() {
+		lookupHost = lookup
+	}()
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "ntlm.test:"+port {
+			addr = "127.0.0.2:" + port
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	get := func(failover bool) (int, error) {
+		transport := newTestTransport()
+		transport.RoundTripper = base
+		transport.AddressFailover = failover
+		resp, err := (&http.Client{Transport: transport}).Get("http://ntlm.test:" + port)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if _, err := get(false); err == nil {
+		t.Error("expected connection to be refused without failover")
+	}
+	status, err := get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("expected authentication over the other address, got %d", status)
+	}
+}
+
+func Test_Proxies(t *testing.T) {
+	origin := httptest.NewServer(ntlmHandler(t, nil))
+	defer origin.Close()
+
+	proxy := httptest.NewServer(ntlmAuthenticator(http.StatusProxyAuthRequired, "Proxy-Authorization", "Proxy-Authenticate",
+		"proxyuser", "secret", "pd", forwardProxy(t)))
+	defer proxy.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+
+	failovers := 0
+	transport := newTestTransport()
+	primary, _ := url.Parse(proxy.URL)
+	transport.Proxies = []*url.URL{down, primary}
+	transport.ProxyCredentials = &Credentials{Domain: "pd", User: "proxyuser", Password: "secret"}
+	transport.Metrics = MetricsFunc(func(name string, labels map[string]string, exemplar string) {
+		if name == MetricProxyFailovers && labels["proxy"] == down.Host {
+			failovers++
+		}
+	})
+	if err := transport.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	if failovers != 1 {
+		t.Errorf("expected unreachable proxy to be skipped after the first failover, got %d failovers", failovers)
+	}
+
+	transport.RoundTripper = newTestTransport()
+	if err := transport.Validate(); err == nil {
+		t.Error("expected Proxies to require *http.Transport")
+	}
+}
+
+func Test_AffinityCookies(t *testing.T) {
+	var mu sync.Mutex
+	next := 0
+	nodes := map[string]http.HandlerFunc{}
+	for _, node := range []string{"a", "b"} {
+		nodes[node] = ntlmAuthenticator(http.StatusUnauthorized, "Authorization", "WWW-Authenticate", "testuser", "fish", "dt", nil)
+	}
+	// load balancer sends requests without affinity cookie to the nodes in turns
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := ""
+		if c, err := r.Cookie("ARRAffinity"); err == nil {
+			node = c.Value
+		} else {
+			mu.Lock()
+			node = []string{"a", "b"}[next%2]
+			next++
+			mu.Unlock()
+			http.SetCookie(w, &http.Cookie{Name: "ARRAffinity", Value: node})
+		}
+		nodes[node](w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected handshake spread over nodes to fail, got %d", resp.StatusCode)
+	}
+
+	transport = newTestTransport()
+	transport.AffinityCookies = DefaultAffinityCookies
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+}
+
+func Test_Heartbeat(t *testing.T) {
+	var mu sync.Mutex
+	heartbeats, conns := 0, 0
+	ts := httptest.NewUnstartedServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.URL.Path == "/ping" {
+			mu.Lock()
+			heartbeats++
+			mu.Unlock()
+		}
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.Heartbeat = &Heartbeat{Interval: 20 * time.Millisecond, Method: http.MethodOptions, Path: "ping"}
+	defer transport.Close()
+	if err := transport.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := heartbeats
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if heartbeats < 2 {
+		t.Errorf("expected heartbeats, got %d", heartbeats)
+	}
+	if conns != 1 {
+		t.Errorf("expected heartbeats over the authenticated connection, got %d connections", conns)
+	}
+
+	transport.Heartbeat.Interval = 0
+	if err := transport.Validate(); err == nil {
+		t.Error("expected zero Interval to be rejected")
+	}
+}
+
+func Test_Shutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+		fmt.Fprint(w, "done")
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	client := &http.Client{Transport: transport}
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		errs <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- transport.Shutdown(context.Background())
+	}()
+	for {
+		transport.mu.Lock()
+		draining := transport.draining
+		transport.mu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.Get(ts.URL); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected new request to be refused, got %v", err)
+	}
+
+	close(block)
+	if err := <-errs; err != nil {
+		t.Errorf("expected in-flight request to complete, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+
+	// requests still in flight at the deadline are aborted
+	hang := make(chan struct{})
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+	transport = newTestTransport()
+	go func() {
+		_, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := transport.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if err := <-errs; err == nil {
+		t.Error("expected in-flight request to be aborted")
+	}
+}
+
+func Test_WithDomain(t *testing.T) {
+	var mu sync.Mutex
+	var identities []string
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+		if auth, err := ParseAuthenticateMessage(msg); err == nil {
+			mu.Lock()
+			identities = append(identities, auth.Domain()+"/"+auth.Workstation())
+			mu.Unlock()
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	for _, ctx := range []context.Context{
+		context.Background(),
+		WithWorkstation(WithDomain(context.Background(), "other"), "ws2"),
+	} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(identities, ",") != "dt/,other/ws2" {
+		t.Errorf("expected domain and workstation to be overridden, got %v", identities)
+	}
+	if n := len(transport.views.all()); n != 0 {
+		t.Errorf("expected overriding requests not to keep views, got %d", n)
+	}
+}
+
+type unreadableBody struct {
+	closed bool
+}
+
+func (b *unreadableBody) Read([]byte) (int, error) {
+	return 0, errors.New("bodiless response read")
+}
+
+func (b *unreadableBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func Test_DiscardBodiless(t *testing.T) {
+	transport := newTestTransport()
+	for _, resp := range []*http.Response{
+		{ContentLength: 0},
+		{ContentLength: -1, Request: &http.Request{Method: http.MethodHead}},
+	} {
+		body := &unreadableBody{}
+		resp.Body = body
+		if err := transport.discardBody(resp); err != nil {
+			t.Error(err)
+		}
+		if !body.closed {
+			t.Error("expected body to be closed")
+		}
+	}
+
+	conns := 0
+	var mu sync.Mutex
+	ts := httptest.NewUnstartedServer(ntlmHandler(t, nil))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Head(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("expected connection to be reused, got %d connections", conns)
+	}
+}
+
+func Test_HandshakeInfo(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTestTransport()}
+	var infos []HandshakeInfo
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		info, ok := HandshakeInfoOf(resp)
+		if !ok {
+			t.Fatal("expected handshake info")
+		}
+		infos = append(infos, info)
+	}
+
+	if first := infos[0]; first.Scheme != "NTLM" || first.Cached || first.Handshakes != 1 || !first.Flags.Has(FlagNTLM) {
+		t.Errorf("unexpected info of the first request %+v", first)
+	}
+	if second := infos[1]; second.Scheme != "NTLM" || !second.Cached || second.Handshakes != 0 {
+		t.Errorf("unexpected info of the cached request %+v", second)
+	}
+
+	if _, ok := HandshakeInfoOf(&http.Response{Request: httptest.NewRequest(http.MethodGet, "/", nil)}); ok {
+		t.Error("expected no info of foreign response")
+	}
+}
+
+func Test_AuthorizationErrors(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "no access")
+	}))
+	defer ts.Close()
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer public.Close()
+
+	transport := newTestTransport()
+	transport.AuthorizationErrors = true
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(ts.URL)
+	var denied *AuthorizationError
+	if !errors.Is(err, ErrAuthorizationDenied) || !errors.As(err, &denied) {
+		t.Fatalf("expected authorization error, got %v", err)
+	}
+	if b, _ := io.ReadAll(denied.Response.Body); string(b) != "no access" || denied.Scheme != "NTLM" {
+		t.Errorf("unexpected denial %q %s", b, denied.Scheme)
+	}
+
+	// 403 without authentication is returned as is
+	resp, err := client.Get(public.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", resp.StatusCode)
+	}
+}
+
+func Test_NTLMRoutes(t *testing.T) {
+	var mu sync.Mutex
+	authenticated := map[string]bool{}
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			mu.Lock()
+			authenticated[r.URL.Path] = true
+			mu.Unlock()
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.NTLMRoutes = []Route{{HostSuffix: "127.0.0.1", PathPrefix: "/corp"}}
+	client := &http.Client{Transport: transport}
+	for _, path := range []string{"/corp/reports", "/public"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !authenticated["/corp/reports"] || authenticated["/public"] {
+		t.Errorf("expected only routed requests to be authenticated, got %v", authenticated)
+	}
+
+	route := Route{HostSuffix: ".Example.com"}
+	for host, match := range map[string]bool{"example.com": true, "intranet.example.com": true, "badexample.com": false} {
+		if route.Match(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)) != match {
+			t.Errorf("unexpected match of %s", host)
+		}
+	}
+}
+
+func Test_LongRunning(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/poll" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.RoundTripper = &http.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	if _, err := client.Get(ts.URL + "/poll"); err == nil {
+		t.Fatal("expected response header timeout")
+	}
+
+	req, _ := http.NewRequestWithContext(WithLongRunning(context.Background()), http.MethodGet, ts.URL+"/poll", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header timeout is lifted only for the long running request
+	if _, err := client.Get(ts.URL + "/poll"); err == nil {
+		t.Error("expected response header timeout of request sent along long running one")
+	}
+	if err := transport.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected Shutdown not to wait for long running request, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func Test_MaxRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.Method]++
+		first := calls[r.Method] == 1
+		mu.Unlock()
+		if first {
+			// connection breaks once the request was authenticated
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	send := func(method string, header http.Header) (int, error) {
+		transport := newTestTransport()
+		transport.MaxRetries = 1
+		req, _ := http.NewRequest(method, ts.URL, strings.NewReader("payload"))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if status, err := send(http.MethodPut, nil); err != nil || status != http.StatusOK {
+		t.Errorf("expected idempotent request to be retried, got %d %v", status, err)
+	}
+	if _, err := send(http.MethodPost, nil); err == nil {
+		t.Error("expected non-idempotent request to fail")
+	}
+	mu.Lock()
+	posts := calls[http.MethodPost]
+	calls[http.MethodPost] = 0
+	mu.Unlock()
+	if posts != 1 {
+		t.Errorf("expected non-idempotent request to be sent once, got %d", posts)
+	}
+	if status, err := send(http.MethodPost, http.Header{IdempotencyKeyHeader: {"1"}}); err != nil || status != http.StatusOK {
+		t.Errorf("expected request with idempotency key to be retried, got %d %v", status, err)
+	}
+}
+
+func Test_StaleConnectionRetry(t *testing.T) {
+	var drop int32
+	handler := ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" && atomic.CompareAndSwapInt32(&drop, 1, 0) {
+			// server dropped authenticated connection while it was idle
+			io.Copy(io.Discard, r.Body)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	send := func(transport *NtlmTransport) error {
+		atomic.StoreInt32(&drop, 0)
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodPut, ts.URL, strings.NewReader("payload"))
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200, got %d", resp.StatusCode)
+			}
+			atomic.StoreInt32(&drop, 1)
+		}
+		return nil
+	}
+
+	if err := send(newTestTransport()); err != nil {
+		t.Errorf("expected request to be repeated over new connection, got %v", err)
+	}
+	transport := newTestTransport()
+	transport.DisableStaleRetry = true
+	if err := send(transport); err == nil {
+		t.Error("expected request over dropped connection to fail")
+	}
+}
+
+func Test_RequestHook(t *testing.T) {
+	var mu sync.Mutex
+	var tenants []string
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tenants = append(tenants, r.Header.Get("X-Tenant"))
+		mu.Unlock()
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	var stages []Stage
+	transport := newTestTransport()
+	transport.RequestHook = func(stage Stage, req *http.Request) {
+		stages = append(stages, stage)
+		req.Header.Set("X-Tenant", "contoso")
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authentication to succeed, got %d", resp.StatusCode)
+	}
+
+	if len(stages) != 2 || stages[0] != StageNegotiate || stages[1] != StageAuthenticate {
+		t.Errorf("expected hook to see negotiate and authenticate requests, got %v", stages)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tenants) != 2 || tenants[0] != "contoso" || tenants[1] != "contoso" {
+		t.Errorf("expected header on every leg, got %v", tenants)
+	}
+	if req.Header.Get("X-Tenant") != "" {
+		t.Error("caller's request was modified")
+	}
+}
+
+func Test_ResponseHook(t *testing.T) {
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// middlebox renames the challenge header
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		for k, v := range rec.Header() {
+			if k == "Www-Authenticate" {
+				k = "X-Authenticate"
+			}
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer ts.Close()
+
+	var stages []Stage
+	transport := newTestTransport()
+	transport.ResponseHook = func(stage Stage, resp *http.Response) {
+		stages = append(stages, stage)
+		if v := resp.Header.Values("X-Authenticate"); len(v) > 0 {
+			resp.Header["Www-Authenticate"] = v
+		}
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authentication to succeed, got %d", resp.StatusCode)
+	}
+	if len(stages) != 2 || stages[0] != StageNegotiate || stages[1] != StageAuthenticate {
+		t.Errorf("expected hook to see negotiate and authenticate responses, got %v", stages)
+	}
+}
+
+// mapStore is Store keeping values in memory
+type mapStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *mapStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, ErrNotStored
+	}
+	return v, nil
+}
+
+func (s *mapStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *mapStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func Test_CacheStore(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+	}))
+	defer ts.Close()
+
+	store := &mapStore{values: map[string][]byte{}}
+	transport := newTestTransport()
+	transport.CacheStore = store
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// other process shares what the first one discovered
+	other := newTestTransport()
+	other.CacheStore = store
+	u, _ := url.Parse(ts.URL)
+	if info := other.authCache().get(hostKey(u)); !info.persistentAuth || !info.ntlmOnly {
+		t.Errorf("host knowledge wasn't loaded from store %q", store.values)
+	}
+
+	transport.InvalidateHost(u.Host)
+	if _, err := store.Get(hostKey(u)); err != ErrNotStored {
+		t.Errorf("expected invalidated host to be deleted from store, got %v", err)
+	}
+}
+
+func Test_MachineAccount(t *testing.T) {
+	var user string
+	ts := httptest.NewServer(ntlmAuthenticator(http.StatusUnauthorized, "Authorization", "WWW-Authenticate", "WEB01$", "machine secret", "dt",
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	creds := MachineAccount("dt", "web01", NTHash("machine secret"))
+	if creds.User != "web01$" || creds.Workstation != "WEB01" || MachineAccount("dt", "web01$", "").User != "web01$" {
+		t.Errorf("unexpected credentials %v", creds)
+	}
+	transport := newTestTransport().As(creds)
+	if err := transport.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	transport.RequestHook = func(stage Stage, req *http.Request) {
+		if stage != StageAuthenticate {
+			return
+		}
+		msg, _ := DecBase64(strings.TrimPrefix(req.Header.Get("Authorization"), "NTLM "))
+		if auth, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil {
+			user = auth.UserName.String()
+		}
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected machine account to authenticate with NT hash, got %d", resp.StatusCode)
+	}
+	if user != "web01$" {
+		t.Errorf("expected account name with trailing $, got %q", user)
+	}
+
+	transport.NTHash = "fish"
+	if err := transport.Validate(); err == nil {
+		t.Error("expected invalid hash to be rejected")
+	}
+}
+
+func Test_Detect(t *testing.T) {
+	handler := ntlmHandler(t, nil)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if msg, err := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")); err == nil && len(msg) > 8 && msg[8] != 1 {
+			t.Errorf("unexpected message type %d", msg[8])
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.RoundTripper = ts.Client().Transport
+	d, err := transport.Detect(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.StatusCode != http.StatusUnauthorized || len(d.Schemes) != 1 || d.Schemes[0] != "NTLM" {
+		t.Errorf("unexpected anonymous response %+v", d)
+	}
+	if !d.NTLM || !d.Flags.Has(FlagNTLM) || !d.TLS {
+		t.Errorf("expected NTLM challenge over TLS, got %+v", d)
+	}
+	u, _ := url.Parse(ts.URL)
+	if info := transport.authCache().get(hostKey(u)); info.ntlmOnly {
+		t.Error("detection changed host knowledge")
+	}
+}
+
+func Test_HostSchemes(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	handler := ntlmHandler(t, nil)
+	negotiateOnly := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		mu.Lock()
+		sent = append(sent, strings.SplitN(h, " ", 2)[0])
+		mu.Unlock()
+		if !strings.HasPrefix(h, "Negotiate ") {
+			w.Header().Set("WWW-Authenticate", "Negotiate")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// server accepts NTLM tokens wrapped in Negotiate
+		r.Header.Set("Authorization", "NTLM "+strings.TrimPrefix(h, "Negotiate "))
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		for _, c := range rec.Header().Values("WWW-Authenticate") {
+			w.Header().Add("WWW-Authenticate", strings.Replace(c, "NTLM", "Negotiate", 1))
+		}
+		w.WriteHeader(rec.Code)
+	}))
+	defer negotiateOnly.Close()
+
+	transport := newTestTransport()
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(negotiateOnly.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected authentication with Negotiate scheme, got %d", resp.StatusCode)
+		}
+		transport.CloseIdleConnections()
+	}
+	mu.Lock()
+	// host is probed by the first handshake only
+	if strings.Join(sent, " ") != "NTLM Negotiate Negotiate Negotiate Negotiate" {
+		t.Errorf("unexpected schemes sent %v", sent)
+	}
+	mu.Unlock()
+
+	basicOnly := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != `dt\testuser` || password != "fish" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="corp"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer basicOnly.Close()
+
+	transport = newTestTransport()
+	var schemeErr *SchemeError
+	if _, err := (&http.Client{Transport: transport}).Get(basicOnly.URL); !errors.As(err, &schemeErr) {
+		t.Errorf("expected Basic to require AllowBasic, got %v", err)
+	}
+	transport.AllowBasic = true
+	resp, err := (&http.Client{Transport: transport}).Get(basicOnly.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(basicOnly.URL)
+	if resp.StatusCode != http.StatusOK || transport.authCache().get(hostKey(u)).scheme != SchemeBasic {
+		t.Errorf("expected Basic to be chosen, got %d", resp.StatusCode)
+	}
+
+	// decision is re-evaluated once the credentials are rejected
+	transport.Password = "wrong"
+	resp, err = (&http.Client{Transport: transport}).Get(basicOnly.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || transport.authCache().get(hostKey(u)).scheme != "" {
+		t.Errorf("expected decision to be forgotten, got %d", resp.StatusCode)
+	}
+
+	configured := newTestTransport()
+	configured.HostSchemes = map[string]string{u.Host: "basic"}
+	if err := configured.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	configured.Faults = map[Stage]Fault{StageNegotiate: FaultError}
+	resp, err = (&http.Client{Transport: configured}).Get(basicOnly.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected configured scheme to be used without probing, got %d", resp.StatusCode)
+	}
+}
+
+func Test_ConditionalRequests(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	conditional := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}
+	authenticated := httptest.NewServer(ntlmHandler(t, conditional))
+	defer authenticated.Close()
+	anonymous := httptest.NewServer(http.HandlerFunc(conditional))
+	defer anonymous.Close()
+
+	transport := newTestTransport()
+	client := &http.Client{Transport: transport}
+	for _, ts := range []*httptest.Server{authenticated, anonymous} {
+		for _, header := range []http.Header{
+			{"If-None-Match": {`"v1"`}},
+			{"If-Modified-Since": {modified.Format(http.TimeFormat)}},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header = header
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// body of 304 response is left unclosed
+			if resp.StatusCode != http.StatusNotModified {
+				t.Errorf("expected 304 for %v, got %d", header, resp.StatusCode)
+			}
+			if b, _ := io.ReadAll(resp.Body); len(b) != 0 {
+				t.Errorf("unexpected body of 304 response %q", b)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := transport.Shutdown(ctx); err != nil {
+		t.Errorf("expected requests with 304 responses to be finished, got %v", err)
+	}
+}
+
+func Test_PrivateResponses(t *testing.T) {
+	ts := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60, s-maxage=600")
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.PrivateResponses = true
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cc := resp.Header.Get("Cache-Control"); cc != "private, max-age=60" {
+		t.Errorf("expected authenticated response to be private, got %q", cc)
+	}
+
+	// cache underneath the transport serves handshake responses
+	cached := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-From-Cache", "1")
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer cached.Close()
+	if _, err := (&http.Client{Transport: transport}).Get(cached.URL); !errors.Is(err, ErrCachedHandshake) {
+		t.Errorf("expected cached handshake to fail, got %v", err)
+	}
+}
+
+func Test_Hedge(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fast")
+	}))
+	defer fast.Close()
+	broken := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	hedge, err := NewHedge(newTestTransport(), []string{slow.URL, fast.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hedge.Close()
+	resp, err := (&http.Client{Transport: hedge}).Get("http://farm.test/page?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "fast" {
+		t.Errorf("expected the fast replica to win, got %q", b)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("expected request to the slow replica to be canceled")
+	}
+
+	// failing replica makes request go to the next one without waiting for the delay
+	hedge, _ = NewHedge(newTestTransport(), []string{broken.URL, fast.URL})
+	hedge.Delay = time.Minute
+	defer hedge.Close()
+	resp, err = (&http.Client{Transport: hedge}).Get("http://farm.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the healthy replica to answer, got %d", resp.StatusCode)
+	}
+
+	if _, err := NewHedge(newTestTransport(), []string{"farm.test"}); err == nil {
+		t.Error("expected replica without host to be rejected")
+	}
+}
+
+func Test_IPv6Literal(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	}
+	ts := httptest.NewUnstartedServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Persistent-Auth", "true")
+		if !strings.HasPrefix(r.Host, "[::1]:") {
+			t.Errorf("unexpected Host header %s", r.Host)
+		}
+	}))
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.TargetPolicy = TargetRefuse
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(ts.URL)
+	if info, _ := HandshakeInfoOf(resp); info.SPN != "HTTP/[::1]:"+u.Port() || info.Handshakes != 1 {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	key := hostKey(u)
+	if key != "http://[::1]:"+u.Port() || !transport.authCache().get(key).persistentAuth {
+		t.Fatalf("unexpected knowledge of %s", key)
+	}
+	for _, host := range []string{"::1", "[::1]", "[::1]:" + u.Port(), ts.URL} {
+		if !hostMatcher(host)(key) {
+			t.Errorf("%s doesn't match %s", host, key)
+		}
+	}
+	transport.InvalidateHost("::1")
+	if transport.authCache().get(key).persistentAuth {
+		t.Error("host knowledge wasn't forgotten")
+	}
+
+	zoned, _ := url.Parse("https://[FE80::1%25eth0]:5986/wsman")
+	key = hostKey(zoned)
+	if key != "https://[fe80::1%25eth0]:5986" {
+		t.Errorf("unexpected key %s", key)
+	}
+	if _, err := url.Parse(key); err != nil || !hostMatcher("fe80::1%eth0")(key) || hostMatcher("fe80::1%eth1")(key) {
+		t.Errorf("zoned key %s doesn't round trip", key)
+	}
+	req := httptest.NewRequest(http.MethodGet, zoned.String(), nil)
+	if s := transport.spn(req); s != "HTTP/[fe80::1]:5986" {
+		t.Errorf("unexpected SPN %s", s)
+	}
+	req.Host = "WinRM.example.com:5986"
+	if s := transport.spn(req); s != "HTTP/winrm.example.com:5986" {
+		t.Errorf("unexpected SPN of Host header %s", s)
+	}
+}
+
+func Test_ExtendedProtection(t *testing.T) {
+	handler := ntlmHandler(t, nil)
+	var pairs *ntlm.AvPairs
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if msg, err := DecBase64(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")); err == nil && len(msg) > 8 && msg[8] == 3 {
+			if auth, err := ntlm.ParseAuthenticateMessage(msg, 2); err == nil {
+				// target info follows proof, response type, reserved bytes, timestamp and client challenge
+				pairs = ntlm.ReadAvPairs(auth.NtChallengeResponseFields.Payload[16+28:])
+			}
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.RoundTripper = ts.Client().Transport
+	transport.ExtendedProtection = true
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected authentication with channel bindings, got %d", resp.StatusCode)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	spn := "HTTP/" + u.Host
+	if info, _ := HandshakeInfoOf(resp); info.SPN != spn {
+		t.Errorf("unexpected SPN %s", info.SPN)
+	}
+	if pairs == nil {
+		t.Fatal("authenticate message wasn't seen")
+	}
+	if p := pairs.Find(ntlm.MsvAvTargetName); p == nil || p.UnicodeStringValue() != spn {
+		t.Errorf("unexpected target name %v", p)
+	}
+	expected := channelBindingHash(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{ts.Certificate()}})
+	if p := pairs.Find(ntlm.MsvChannelBindings); p == nil || !bytes.Equal(p.Value, expected) || bytes.Equal(expected, make([]byte, 16)) {
+		t.Errorf("unexpected channel bindings %v", p)
+	}
+
+	transport.HostSPNs = map[string]string{u.Hostname(): "HTTP/web.example.com"}
+	if s := transport.spn(httptest.NewRequest(http.MethodGet, ts.URL, nil)); s != "HTTP/web.example.com" {
+		t.Errorf("expected SPN override, got %s", s)
+	}
+	if s := newTestTransport().spn(httptest.NewRequest(http.MethodGet, "https://web.example.com:443/", nil)); s != "HTTP/web.example.com" {
+		t.Errorf("expected SPN without default port, got %s", s)
+	}
+	transport.HostSPNs = map[string]string{"web": "web.example.com"}
+	if err := transport.Validate(); err == nil {
+		t.Error("expected error for SPN without service class")
+	}
+}
+
+func Test_BasicProxyNTLMOrigin(t *testing.T) {
+	origin := httptest.NewServer(ntlmHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("proxy credentials reached the origin")
+		}
+	}))
+	defer origin.Close()
+
+	var legs, rejected int32
+	forward := forwardProxy(t)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&legs, 1)
+		if user, password, ok := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth(); !ok ||
+			user != `pd\proxyuser` || password != "secret" {
+			atomic.AddInt32(&rejected, 1)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="squid"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		forward(w, r)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := newTestTransport()
+	transport.RoundTripper = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	transport.ProxyCredentials = &Credentials{Domain: "pd", User: "proxyuser", Password: "secret"}
+	transport.ProxyScheme = SchemeBasic
+	if err := transport.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if info, _ := HandshakeInfoOf(resp); info.Scheme != SchemeNTLM || info.Handshakes != 1 || info.ProxyHandshakes != 0 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if n, total := atomic.LoadInt32(&rejected), atomic.LoadInt32(&legs); n != 0 || total < 2 {
+		t.Errorf("expected every leg to carry proxy credentials, %d of %d rejected", n, total)
+	}
+
+	transport.ProxyScheme = "Digest"
+	if err := transport.Validate(); err == nil {
+		t.Error("expected error for unsupported proxy scheme")
+	}
+}
+
+func Test_VerboseErrors(t *testing.T) {
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "NTLM ") {
+			w.Header().Add("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+		challenge, _ := session.GenerateChallengeMessage()
+		challenge.NegotiateFlags = ntlm.NTLMSSP_NEGOTIATE_TARGET_INFO.Unset(challenge.NegotiateFlags)
+		challenge.TargetInfo = nil
+		challenge.TargetInfoPayloadStruct, _ = ntlm.CreateBytePayload(nil)
+		w.Header().Add("WWW-Authenticate", "NTLM "+EncBase64(challenge.Bytes()))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer legacy.Close()
+	ts := httptest.NewServer(ntlmHandler(t, nil))
+	defer ts.Close()
+
+	transport := newTestTransport()
+	transport.VerboseErrors = true
+	transport.RejectionErrors = true
+	client := &http.Client{Transport: transport}
+
+	_, err := client.Get(legacy.URL)
+	var handshakeErr *HandshakeError
+	var downgradeErr *DowngradeError
+	if !errors.As(err, &handshakeErr) || !errors.As(err, &downgradeErr) {
+		t.Fatalf("expected verbose downgrade error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "origin challenge ntlmv2=false flags=") || !strings.Contains(err.Error(), "tls=false") {
+		t.Errorf("unexpected summary %v", err)
+	}
+
+	transport.Password = "wrong"
+	_, err = client.Get(ts.URL)
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) || !errors.As(err, &handshakeErr) {
+		t.Fatalf("expected verbose rejection, got %v", err)
+	}
+	if s := handshakeErr.Challenge; !strings.Contains(s, "ntlmv2=true") || !strings.Contains(s, `computer="synthetics-http-agent.sematext.com"`) {
+		t.Errorf("unexpected summary %s", s)
+	}
+
+	transport.VerboseErrors = false
+	var plain *HandshakeError
+	if _, err = client.Get(ts.URL); !errors.As(err, &rejection) || errors.As(err, &plain) {
+		t.Errorf("expected plain rejection, got %v", err)
+	}
+}
+
+func Test_HedgeNonIdempotent(t *testing.T) {
+	var posts int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&posts, 1)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	first := httptest.NewServer(ntlmHandler(t, handler))
+	defer first.Close()
+	second := httptest.NewServer(ntlmHandler(t, handler))
+	defer second.Close()
+
+	hedge, _ := NewHedge(newTestTransport(), []string{first.URL, second.URL})
+	defer hedge.Close()
+	resp, err := (&http.Client{Transport: hedge}).Post("http://farm.test/orders", "text/plain", strings.NewReader("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Errorf("expected POST to reach exactly one replica, got %d", n)
+	}
+}
+
+func Test_SchemeChallengeCase(t *testing.T) {
+	for _, tc := range []struct {
+		headers   []string
+		challenge string
+		found     bool
+	}{
+		{[]string{"NTLM TlRMTVNTUAAC"}, "TlRMTVNTUAAC", true},
+		{[]string{"Basic realm=\"x\"", "ntlm TlRMTVNTUAAC"}, "TlRMTVNTUAAC", true},
+		{[]string{"Ntlm"}, "", true},
+		{[]string{"NTLMv2 TlRMTVNTUAAC"}, "", false},
+	} {
+		challenge, found := ntlmChallenge(tc.headers)
+		if challenge != tc.challenge || found != tc.found {
+			t.Errorf("%v: unexpected challenge %q %v", tc.headers, challenge, found)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package httpntlm
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdentityPool authenticates requests as identities taken round-robin, e.g. to simulate many Windows users
+// in load tests. Every identity has its own transport, so sessions, caches and connections are isolated.
+type IdentityPool struct {
+	transports []*NtlmTransport
+	stats      []*identityStats
+	next       uint32
+}
+
+var errNoIdentities = errors.New("identity pool is empty")
+
+// IdentityStats are handshake statistics of an identity
+type IdentityStats struct {
+	Domain string
+	User   string
+	// Requests is the number of caller's requests sent as the identity
+	Requests int64
+	// Handshakes is the number of negotiate messages sent
+	Handshakes int64
+	// Failures is the number of requests which failed or were rejected with 401 status
+	Failures int64
+	// HandshakeTime is the total time negotiate and authenticate legs took
+	HandshakeTime time.Duration
+}
+
+type identityStats struct {
+	mu sync.Mutex
+	IdentityStats
+}
+
+// NewIdentityPool returns pool of identities authenticated by clones of template, template credentials are ignored
+func NewIdentityPool(template *NtlmTransport, identities []Credentials) *IdentityPool {
+	p := &IdentityPool{}
+	for _, id := range identities {
+		stats := &identityStats{IdentityStats: IdentityStats{Domain: id.Domain, User: id.User}}
+		t := template.Clone()
+		t.Domain, t.User, t.Password, t.Workstation, t.NTHash = id.Domain, id.User, id.Password, id.Workstation, id.NTHash
+		t.onLeg = stats.leg
+		p.transports = append(p.transports, t)
+		p.stats = append(p.stats, stats)
+	}
+	return p
+}
+
+// RoundTrip sends req authenticated as the next identity
+func (p *IdentityPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(p.transports) == 0 {
+		return nil, errNoIdentities
+	}
+
+	i := int((atomic.AddUint32(&p.next, 1) - 1) % uint32(len(p.transports)))
+	resp, err := p.transports[i].RoundTrip(req)
+
+	stats := p.stats[i]
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.Requests++
+	if err != nil || resp.StatusCode == http.StatusUnauthorized {
+		stats.Failures++
+	}
+	return resp, err
+}
+
+// Stats returns statistics of identities in the order they were given
+func (p *IdentityPool) Stats() []IdentityStats {
+	stats := make([]IdentityStats, len(p.stats))
+	for i, s := range p.stats {
+		s.mu.Lock()
+		stats[i] = s.IdentityStats
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// CloseIdleConnections closes idle connections of all identities
+func (p *IdentityPool) CloseIdleConnections() {
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// Close closes transports of all identities
+func (p *IdentityPool) Close() error {
+	for _, t := range p.transports {
+		t.Close()
+	}
+	return nil
+}
+
+func (s *identityStats) leg(stage Stage, d time.Duration) {
+	if stage != StageNegotiate && stage != StageAuthenticate {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stage == StageNegotiate {
+		s.Handshakes++
+	}
+	s.HandshakeTime += d
+}
@@ -0,0 +1,167 @@
+package httpntlm
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+)
+
+// DefaultMaxViews is the number of views As keeps by default
+const DefaultMaxViews = 64
+
+// viewKey identifies view by identity it authenticates as, secrets are never kept as keys
+type viewKey struct {
+	domain, user, workstation string
+}
+
+// viewEntry is element of views list
+type viewEntry struct {
+	key  viewKey
+	view *NtlmTransport
+}
+
+// views keeps transports returned by As, the most recently used first
+type views struct {
+	byKey map[viewKey]*list.Element
+	order *list.List
+}
+
+// As returns transport with t's configuration authenticating as creds, e.g. for gateways acting on behalf
+// of their users. Views are kept per user, domain and workstation, so requests of the same user share
+// connections while requests of different users never do, a view whose user changed password is replaced.
+// At most MaxViews views are kept, idle connections of the least recently used ones are closed when
+// others are added and they aren't closed along with t anymore. Views kept are closed along with t.
+func (t *NtlmTransport) As(creds Credentials) *NtlmTransport {
+	key := viewKey{domain: creds.Domain, user: creds.User, workstation: creds.Workstation}
+	t.mu.Lock()
+	v := t.views.get(key, creds)
+	t.mu.Unlock()
+	if v != nil {
+		return v
+	}
+
+	v = t.view(creds)
+	t.mu.Lock()
+	if existing := t.views.get(key, creds); existing != nil {
+		t.mu.Unlock()
+		return existing
+	}
+	if t.views == nil {
+		t.views = &views{byKey: map[viewKey]*list.Element{}, order: list.New()}
+	}
+	evicted := t.views.add(key, v, t.maxViews())
+	if t.closed {
+		v.Close()
+	}
+	t.mu.Unlock()
+
+	// evicted views may still be in use by callers, only their idle connections go
+	for _, e := range evicted {
+		e.CloseIdleConnections()
+	}
+	return v
+}
+
+// maxViews returns number of views As keeps
+func (t *NtlmTransport) maxViews() int {
+	if t.MaxViews <= 0 {
+		return DefaultMaxViews
+	}
+	return t.MaxViews
+}
+
+// view returns new transport with t's configuration authenticating as creds, connections aren't shared with t
+func (t *NtlmTransport) view(creds Credentials) *NtlmTransport {
+	v := t.Clone()
+	v.Domain, v.User, v.Password, v.Workstation, v.NTHash = creds.Domain, creds.User, creds.Password, creds.Workstation, creds.NTHash
+	// connections of the default and internal transports must not be shared either
+	if tr, ok := t.base().(*http.Transport); ok && t.RoundTripper == nil {
+		v.RoundTripper = tr.Clone()
+		v.Dialer, v.MinTLSVersion, v.CipherSuites = nil, 0, nil
+	}
+	return v
+}
+
+// get returns view kept for key and marks it used, nil if there is none or it has other secrets than creds
+func (vs *views) get(key viewKey, creds Credentials) *NtlmTransport {
+	if vs == nil {
+		return nil
+	}
+	e, ok := vs.byKey[key]
+	if !ok {
+		return nil
+	}
+	v := e.Value.(*viewEntry).view
+	if v.Password != creds.Password || v.NTHash != creds.NTHash {
+		return nil
+	}
+	vs.order.MoveToFront(e)
+	return v
+}
+
+// add keeps view v for key, it returns views replaced or evicted to keep at most max of them
+func (vs *views) add(key viewKey, v *NtlmTransport, max int) []*NtlmTransport {
+	var evicted []*NtlmTransport
+	if e, ok := vs.byKey[key]; ok {
+		evicted = append(evicted, vs.order.Remove(e).(*viewEntry).view)
+	}
+	vs.byKey[key] = vs.order.PushFront(&viewEntry{key: key, view: v})
+	for vs.order.Len() > max {
+		entry := vs.order.Remove(vs.order.Back()).(*viewEntry)
+		delete(vs.byKey, entry.key)
+		evicted = append(evicted, entry.view)
+	}
+	return evicted
+}
+
+// all returns views kept
+func (vs *views) all() []*NtlmTransport {
+	if vs == nil {
+		return nil
+	}
+	all := make([]*NtlmTransport, 0, vs.order.Len())
+	for e := vs.order.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*viewEntry).view)
+	}
+	return all
+}
+
+// overridden returns new view of t authenticating requests with ctx in domain or workstation set by WithDomain
+// or WithWorkstation, nil if ctx doesn't override them. The view isn't kept, it's owned by the request.
+func (t *NtlmTransport) overridden(ctx context.Context) *NtlmTransport {
+	creds := Credentials{Domain: t.Domain, User: t.User, Password: t.Password, Workstation: t.Workstation, NTHash: t.NTHash}
+	if domain, ok := ctx.Value(domainKey).(string); ok {
+		creds.Domain = domain
+	}
+	if workstation, ok := ctx.Value(workstationKey).(string); ok {
+		creds.Workstation = workstation
+	}
+	if creds.Domain == t.Domain && creds.Workstation == t.Workstation {
+		return nil
+	}
+	return t.view(creds)
+}
+
+// overriddenRoundTrip sends req by view v returned by overridden, v is released with the response,
+// its connections are closed unless they belong to RoundTripper shared with t
+func (t *NtlmTransport) overriddenRoundTrip(v *NtlmTransport, req *http.Request) (*http.Response, error) {
+	ctx, cancel, err := t.begin(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	release := cancel
+	if _, owned := v.RoundTripper.(*http.Transport); owned {
+		release = func() {
+			v.CloseIdleConnections()
+			cancel()
+		}
+	}
+	res, err := v.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	newReleaseBody(res, release)
+	return res, nil
+}
@@ -0,0 +1,74 @@
+package httpntlm
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// HandshakeInfo describes how the request was authenticated, see HandshakeInfoOf
+type HandshakeInfo struct {
+	// Scheme is the authentication scheme the final request was sent with, NTLM, Negotiate, Basic or Bearer,
+	// empty if the host didn't require authentication
+	Scheme string
+	// Cached is set when the request rode on connection authenticated before without a handshake
+	Cached bool
+	// Handshakes is the number of NTLM handshakes performed with the origin
+	Handshakes int
+	// Flags are negotiate flags of the last origin challenge, zero if there was no handshake
+	Flags NegotiateFlags
+	// SPN is service principal name of the origin, e.g. HTTP/intranet.example.com, names the host
+	// from Host header or URL without zone and with port unless it's the default one, see HostSPNs.
+	// It's empty if there was no handshake.
+	SPN string
+	// ProxyHandshakes is the number of NTLM handshakes performed with the proxy
+	ProxyHandshakes int
+}
+
+// handshakeInfo collects HandshakeInfo of a single request
+type handshakeInfo struct {
+	mu   sync.Mutex
+	info HandshakeInfo
+	// challenge summarizes the last challenge for HandshakeError
+	challenge string
+}
+
+func (h *handshakeInfo) update(f func(info *HandshakeInfo)) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f(&h.info)
+}
+
+func (h *handshakeInfo) get() HandshakeInfo {
+	if h == nil {
+		return HandshakeInfo{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.info
+}
+
+func withHandshakeInfo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, handshakeInfoKey, &handshakeInfo{})
+}
+
+func handshakeInfoOf(ctx context.Context) *handshakeInfo {
+	h, _ := ctx.Value(handshakeInfoKey).(*handshakeInfo)
+	return h
+}
+
+// HandshakeInfoOf returns how request of resp returned by NtlmTransport was authenticated,
+// ok is false for other responses
+func HandshakeInfoOf(resp *http.Response) (info HandshakeInfo, ok bool) {
+	if resp == nil || resp.Request == nil {
+		return HandshakeInfo{}, false
+	}
+	h := handshakeInfoOf(resp.Request.Context())
+	if h == nil {
+		return HandshakeInfo{}, false
+	}
+	return h.get(), true
+}
@@ -0,0 +1,122 @@
+//go:build integration
+// +build integration
+
+package httpntlm
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Integration tests run against real servers, see testdata/integration for containerized Samba domain
+// with Apache. Servers are configured with environment variables:
+//
+//	NTLM_TEST_URL       resource behind NTLM authentication, tests are skipped if not set
+//	NTLM_TEST_DOMAIN    domain, NTLMTEST by default
+//	NTLM_TEST_USER      user, testuser by default
+//	NTLM_TEST_PASSWORD  password, Passw0rd-test by default
+//	NTLM_TEST_V1_URL    resource of server offering NTLMv1 only, e.g. Samba with ntlm auth = ntlmv1-permitted
+//	NTLM_TEST_EPA_URL   https resource of IIS requiring Extended Protection for Authentication
+
+func integrationEnv(t *testing.T, name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	if fallback == "" {
+		t.Skip(name + " is not set")
+	}
+	return fallback
+}
+
+func integrationTransport(t *testing.T) *NtlmTransport {
+	return &NtlmTransport{
+		Domain:   integrationEnv(t, "NTLM_TEST_DOMAIN", "NTLMTEST"),
+		User:     integrationEnv(t, "NTLM_TEST_USER", "testuser"),
+		Password: integrationEnv(t, "NTLM_TEST_PASSWORD", "Passw0rd-test"),
+	}
+}
+
+func Test_IntegrationNTLMv2(t *testing.T) {
+	url := integrationEnv(t, "NTLM_TEST_URL", "")
+	client := &http.Client{Transport: integrationTransport(t)}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authenticated request, got %d", resp.StatusCode)
+	}
+}
+
+func Test_IntegrationConnectionOriented(t *testing.T) {
+	url := integrationEnv(t, "NTLM_TEST_URL", "")
+	transport := integrationTransport(t)
+	transport.AnnotateRoundTrips = true
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Post(url, "text/plain", strings.NewReader("integration"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("request %d failed with %d", i, resp.StatusCode)
+		}
+		if i > 0 && resp.Header.Get(RoundTripsHeader) != "0" {
+			t.Errorf("request %d wasn't sent over authenticated connection, extra round trips %s", i, resp.Header.Get(RoundTripsHeader))
+		}
+	}
+}
+
+func Test_IntegrationWrongPassword(t *testing.T) {
+	url := integrationEnv(t, "NTLM_TEST_URL", "")
+	transport := integrationTransport(t)
+	transport.Password = "wrong"
+	transport.RejectionErrors = true
+
+	_, err := (&http.Client{Transport: transport}).Get(url)
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) {
+		t.Errorf("expected rejection error, got %v", err)
+	}
+}
+
+func Test_IntegrationNTLMv1(t *testing.T) {
+	url := integrationEnv(t, "NTLM_TEST_V1_URL", "")
+
+	_, err := (&http.Client{Transport: integrationTransport(t)}).Get(url)
+	var downgrade *DowngradeError
+	if !errors.As(err, &downgrade) {
+		t.Errorf("expected NTLMv1 only server to be refused, got %v", err)
+	}
+}
+
+func Test_IntegrationEPA(t *testing.T) {
+	url := integrationEnv(t, "NTLM_TEST_EPA_URL", "")
+
+	transport := integrationTransport(t)
+	transport.ExtendedProtection = true
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected request bound to TLS channel to be authenticated, got %d", resp.StatusCode)
+	}
+
+	// without Extended Protection no channel bindings are sent, so server requiring them rejects the credentials
+	transport = integrationTransport(t)
+	transport.RejectionErrors = true
+	_, err = (&http.Client{Transport: transport}).Get(url)
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) {
+		t.Errorf("expected rejection by server requiring Extended Protection, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package httpntlm
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// InvalidateHost forgets everything transport learned about authentication on host and closes its
+// authenticated idle connections, so that the next request authenticates again, e.g. after password change
+// or server failover. host is either host name with optional port, which matches any scheme, or URL.
+func (t *NtlmTransport) InvalidateHost(host string) {
+	match := hostMatcher(host)
+	t.authCache().remove(match)
+
+	t.mu.Lock()
+	pool := t.pool
+	t.mu.Unlock()
+	if pool != nil {
+		pool.closeHosts(match)
+	}
+}
+
+// InvalidateAll forgets authentication knowledge of all hosts and closes idle connections
+func (t *NtlmTransport) InvalidateAll() {
+	t.authCache().remove(func(string) bool {
+		return true
+	})
+	t.CloseIdleConnections()
+}
+
+// hostMatcher returns func matching cache keys of host
+func hostMatcher(host string) func(key string) bool {
+	if strings.Contains(host, "://") {
+		if u, err := url.Parse(host); err == nil {
+			key := hostKey(u)
+			return func(k string) bool {
+				return k == key
+			}
+		}
+	}
+
+	// bare IPv6 literal doesn't split, with or without brackets
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		port = ""
+	}
+	name := hostName(host)
+	return func(key string) bool {
+		u, err := url.Parse(key)
+		return err == nil && u.Hostname() == name && (port == "" || u.Port() == port)
+	}
+}
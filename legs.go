@@ -0,0 +1,89 @@
+package httpntlm
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// legTransport sends requests on behalf of a single caller's request
+type legTransport struct {
+	t  *NtlmTransport
+	rt http.RoundTripper
+	n  int32
+	// progress reports uploads of request bodies, nil if not needed
+	progress *uploadProgress
+	// stats collects request timings, nil if not needed
+	stats *legStats
+}
+
+func (l *legTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&l.n, 1)
+
+	ctx := req.Context()
+	stage := stageOf(ctx)
+	l.t.log(ctx, "sending request", "stage", stage, "method", req.Method, "url", redactedURL(req))
+
+	start := time.Now()
+	req, err := l.t.injectRequest(req, stage)
+	affinity := l.t.affinityJar()
+	var resp *http.Response
+	if err == nil {
+		req = l.t.hookRequest(req, stage)
+		if affinity != nil {
+			req = affinity.add(req)
+		}
+		debugRequest(stage, req)
+		resp, err = l.rt.RoundTrip(l.progress.track(req))
+		debugResponse(stage, resp, err)
+	}
+	if l.t.onLeg != nil {
+		l.t.onLeg(stage, time.Since(start))
+	}
+	l.stats.leg(stage, time.Since(start))
+	p := probeOf(ctx)
+	if err != nil {
+		l.t.log(ctx, "request failed", "stage", stage, "error", err, "duration", time.Since(start))
+		if p != nil {
+			p.leg(ProbeLeg{Stage: stage, Duration: time.Since(start), Err: err})
+		}
+		return nil, err
+	}
+
+	if cachedHandshake(stage, resp) {
+		resp.Body.Close()
+		return nil, ErrCachedHandshake
+	}
+	if affinity != nil {
+		affinity.keep(req.URL, resp)
+	}
+	l.t.injectResponse(ctx, resp, stage)
+	if l.t.ResponseHook != nil {
+		l.t.ResponseHook(stage, resp)
+	}
+	l.t.log(ctx, "response received", "stage", stage, "status", resp.StatusCode, "duration", time.Since(start))
+	if p != nil {
+		p.leg(ProbeLeg{Stage: stage, StatusCode: resp.StatusCode, Duration: time.Since(start)})
+	}
+	return resp, nil
+}
+
+// extra returns number of requests made in addition to the caller's one
+func (l *legTransport) extra() int {
+	n := int(atomic.LoadInt32(&l.n)) - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// redactedURL returns request URL without user info
+func redactedURL(req *http.Request) string {
+	if req.URL.User == nil {
+		return req.URL.String()
+	}
+
+	u := *req.URL
+	u.User = nil
+	return u.String()
+}
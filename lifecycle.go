@@ -0,0 +1,258 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ErrClosed is returned by RoundTrip once the transport is closed
+var ErrClosed = errors.New("ntlm transport closed")
+
+// Close aborts in-flight requests including outstanding handshake legs, closes idle connections
+// and makes all subsequent requests fail with ErrClosed
+func (t *NtlmTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	close(t.done)
+	views := t.views.all()
+	t.mu.Unlock()
+
+	for _, v := range views {
+		v.Close()
+	}
+	t.CloseIdleConnections()
+	return nil
+}
+
+// Shutdown gracefully closes the transport, it refuses new requests with ErrClosed right away and waits
+// for in-flight ones including reading of their response bodies, then it closes the transport.
+// Requests marked by WithLongRunning aren't waited for.
+// If ctx is done first, remaining requests are aborted and ctx error is returned.
+func (t *NtlmTransport) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.drained == nil {
+		t.drained = make(chan struct{})
+		if t.inflight == 0 {
+			close(t.drained)
+		}
+	}
+	drained := t.drained
+	t.mu.Unlock()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	t.Close()
+	return err
+}
+
+// Clone returns a new transport with the same configuration, its caches and connections are independent
+// and it's open even if t is closed. RoundTripper is cloned if it's *http.Transport, other RoundTrippers,
+// hooks, HandshakeLimiter and RetryBudget are shared.
+func (t *NtlmTransport) Clone() *NtlmTransport {
+	c := &NtlmTransport{
+		Domain:                   t.Domain,
+		User:                     t.User,
+		Password:                 t.Password,
+		NTHash:                   t.NTHash,
+		Workstation:              t.Workstation,
+		RoundTripper:             t.RoundTripper,
+		Jar:                      t.Jar,
+		AffinityCookies:          append([]string(nil), t.AffinityCookies...),
+		AuthorizationHeader:      t.AuthorizationHeader,
+		ChallengeHeader:          t.ChallengeHeader,
+		HandshakeUserAgent:       t.HandshakeUserAgent,
+		EmptyChallengeRetries:    t.EmptyChallengeRetries,
+		EmptyChallengeRetryDelay: t.EmptyChallengeRetryDelay,
+		MaxRechallenges:          t.MaxRechallenges,
+		MaxDrainBytes:            t.MaxDrainBytes,
+		MaxDownloadResumes:       t.MaxDownloadResumes,
+		MaxViews:                 t.MaxViews,
+		MaxThrottleRetries:       t.MaxThrottleRetries,
+		MaxRetryAfter:            t.MaxRetryAfter,
+		MaxRetries:               t.MaxRetries,
+		RetryNonIdempotent:       t.RetryNonIdempotent,
+		DisableStaleRetry:        t.DisableStaleRetry,
+		AnnotateRoundTrips:       t.AnnotateRoundTrips,
+		UploadProgress:           t.UploadProgress,
+		Stats:                    t.Stats,
+		RequestHook:              t.RequestHook,
+		ResponseHook:             t.ResponseHook,
+		AddressFailover:          t.AddressFailover,
+		RejectionErrors:          t.RejectionErrors,
+		AuthorizationErrors:      t.AuthorizationErrors,
+		VerboseErrors:            t.VerboseErrors,
+		RenewSessions:            t.RenewSessions,
+		Dialer:                   t.Dialer,
+		Proxies:                  append([]*url.URL(nil), t.Proxies...),
+		ProxyScheme:              t.ProxyScheme,
+		NTLMRoutes:               append([]Route(nil), t.NTLMRoutes...),
+		MinTLSVersion:            t.MinTLSVersion,
+		CipherSuites:             append([]uint16(nil), t.CipherSuites...),
+		Logger:                   t.Logger,
+		AuditSink:                t.AuditSink,
+		CorrelationID:            t.CorrelationID,
+		CacheTTL:                 t.CacheTTL,
+		CacheStore:               t.CacheStore,
+		TargetPolicy:             t.TargetPolicy,
+		TokenSource:              t.TokenSource,
+		BearerHosts:              append([]string(nil), t.BearerHosts...),
+		AllowBasic:               t.AllowBasic,
+		ExtendedProtection:       t.ExtendedProtection,
+		PrivateResponses:         t.PrivateResponses,
+		HandshakeLimiter:         t.HandshakeLimiter,
+		RetryBudget:              t.RetryBudget,
+		Crypto:                   t.Crypto,
+		Backend:                  t.Backend,
+		ClockSkew:                t.ClockSkew,
+		MaxClockSkew:             t.MaxClockSkew,
+		Metrics:                  t.Metrics,
+	}
+	if t.Faults != nil {
+		c.Faults = make(map[Stage]Fault, len(t.Faults))
+		for stage, fault := range t.Faults {
+			c.Faults[stage] = fault
+		}
+	}
+	if t.HostSchemes != nil {
+		c.HostSchemes = make(map[string]string, len(t.HostSchemes))
+		for host, scheme := range t.HostSchemes {
+			c.HostSchemes[host] = scheme
+		}
+	}
+	if t.TargetAliases != nil {
+		c.TargetAliases = make(map[string][]string, len(t.TargetAliases))
+		for host, aliases := range t.TargetAliases {
+			c.TargetAliases[host] = append([]string(nil), aliases...)
+		}
+	}
+	if t.HostSPNs != nil {
+		c.HostSPNs = make(map[string]string, len(t.HostSPNs))
+		for host, spn := range t.HostSPNs {
+			c.HostSPNs[host] = spn
+		}
+	}
+	if tr, ok := t.RoundTripper.(*http.Transport); ok {
+		c.RoundTripper = tr.Clone()
+	}
+	if t.Heartbeat != nil {
+		h := *t.Heartbeat
+		c.Heartbeat = &h
+	}
+	if t.ProxyCredentials != nil {
+		creds := *t.ProxyCredentials
+		c.ProxyCredentials = &creds
+	}
+	return c
+}
+
+// CloseIdleConnections closes idle connections of the underlying RoundTripper unless it is the shared
+// http.DefaultTransport, connections the transport pinned are closed either way
+func (t *NtlmTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+
+	// default transport is shared with the rest of the process, connections pinned by t are in the pool
+	if base := t.base(); base != http.DefaultTransport {
+		if c, ok := base.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+
+	t.mu.Lock()
+	pool := t.pool
+	views := t.views.all()
+	t.mu.Unlock()
+	if pool != nil {
+		pool.closeIdle()
+	}
+	for _, v := range views {
+		v.CloseIdleConnections()
+	}
+}
+
+// begin registers a new request, returned context is canceled when transport is closed,
+// cancel func must be called once request is done
+func (t *NtlmTransport) begin(parent context.Context) (context.Context, context.CancelFunc, error) {
+	t.mu.Lock()
+	if t.closed || t.draining {
+		t.mu.Unlock()
+		return nil, nil, ErrClosed
+	}
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	done := t.done
+	// Shutdown doesn't wait for long polls and streams
+	counted := !longRunning(parent)
+	if counted {
+		t.inflight++
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if !counted {
+		return ctx, cancel, nil
+	}
+	var once sync.Once
+	return ctx, func() {
+		cancel()
+		once.Do(t.end)
+	}, nil
+}
+
+// end unregisters request registered by begin
+func (t *NtlmTransport) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight--
+	if t.inflight == 0 && t.drained != nil {
+		close(t.drained)
+	}
+}
+
+// releaseBody releases request resources once response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func newReleaseBody(resp *http.Response, release func()) {
+	// responses without body, e.g. 304 ones, are often left unclosed
+	if resp.Body == http.NoBody {
+		release()
+		return
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+}
@@ -0,0 +1,90 @@
+package httpntlm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HandshakeLimiter limits how fast handshakes with a host start, bursts of cold connections queue
+// instead of overwhelming authentication pipeline of the host. Each host has a token bucket refilled
+// at Rate. Limiter can be shared by several transports, zero value imposes no limits.
+type HandshakeLimiter struct {
+	// Rate is the number of handshakes per second allowed for a host, zero means no limit
+	Rate float64
+	// Burst is the number of handshakes which may start at once, 1 is used if zero
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token of host and returns how long to wait for it, tokens are handed out
+// in the order they are reserved
+func (l *HandshakeLimiter) reserve(host string, now time.Time) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[host] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.Rate * float64(time.Second))
+}
+
+// cancel returns token of host reserved by a handshake which didn't wait for it
+func (l *HandshakeLimiter) cancel(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[host]; ok {
+		b.tokens++
+	}
+}
+
+// waitHandshake waits until handshake with host may start or ctx is done
+func (t *NtlmTransport) waitHandshake(ctx context.Context, host string) error {
+	if t.HandshakeLimiter == nil {
+		return nil
+	}
+	wait := t.HandshakeLimiter.reserve(host, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	t.log(ctx, "waiting for handshake rate limit", "host", host, "wait", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		t.HandshakeLimiter.cancel(host)
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+package httpntlm
+
+import (
+	"context"
+	"net/http"
+)
+
+// Logger receives debug events, keyvals are alternating keys and values describing the event
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+// LoggerFunc is an adapter allowing ordinary functions to be used as Logger
+type LoggerFunc func(msg string, keyvals ...interface{})
+
+// Log calls f(msg, keyvals...)
+func (f LoggerFunc) Log(msg string, keyvals ...interface{}) {
+	f(msg, keyvals...)
+}
+
+// Stage identifies request sent on behalf of the caller's request
+type Stage string
+
+const (
+	// StageNegotiate is the request carrying NTLM negotiate message
+	StageNegotiate Stage = "negotiate"
+	// StageAuthenticate is the caller's request carrying NTLM authenticate message
+	StageAuthenticate Stage = "authenticate"
+	// StageDirect is the caller's request sent without handshake over already authenticated connection
+	StageDirect Stage = "direct"
+	// StageProxyNegotiate is the request carrying NTLM negotiate message for the proxy
+	StageProxyNegotiate Stage = "proxy-negotiate"
+	// StageProxyAuthenticate is the request carrying NTLM authenticate message for the proxy
+	StageProxyAuthenticate Stage = "proxy-authenticate"
+	// StageBearer is the caller's request carrying OAuth bearer token, see NtlmTransport.TokenSource
+	StageBearer Stage = "bearer"
+	// StageBasic is the caller's request carrying Basic credentials, see NtlmTransport.AllowBasic
+	StageBasic Stage = "basic"
+	// StageAnonymous is the request sent without authentication to find out offered schemes, see Probe
+	StageAnonymous Stage = "anonymous"
+)
+
+// withStage returns shallow copy of req marked with the handshake stage
+func withStage(req *http.Request, stage Stage) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), stageKey, stage))
+}
+
+func stageOf(ctx context.Context) Stage {
+	stage, _ := ctx.Value(stageKey).(Stage)
+	return stage
+}
+
+// WithCorrelationID returns a copy of ctx carrying ID of the request,
+// it's included in all events emitted during the handshake
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+// CorrelationIDFromHeader returns correlation ID extractor reading ID from the request header,
+// e.g. X-Request-Id
+func CorrelationIDFromHeader(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return WithCorrelationID(ctx, id)
+}
+
+func correlationIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+func (t *NtlmTransport) correlationID(req *http.Request) string {
+	if t.CorrelationID != nil {
+		return t.CorrelationID(req)
+	}
+	return correlationIDOf(req.Context())
+}
+
+// log emits debug event of the request ctx belongs to
+func (t *NtlmTransport) log(ctx context.Context, msg string, keyvals ...interface{}) {
+	if t.Logger == nil {
+		return
+	}
+
+	if id := correlationIDOf(ctx); id != "" {
+		keyvals = append(keyvals, "correlation_id", id)
+	}
+	t.Logger.Log(msg, keyvals...)
+}
@@ -0,0 +1,8 @@
+module github.com/sematext/go-http-ntlm/logrusadapter
+
+go 1.14
+
+require (
+	github.com/sematext/go-http-ntlm/v2 v2.0.0
+	github.com/sirupsen/logrus v1.9.3
+)
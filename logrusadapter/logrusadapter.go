@@ -0,0 +1,30 @@
+// Package logrusadapter plugs logrus loggers into NTLM transport logging hook.
+// It's a separate module so the transport doesn't depend on logrus.
+package logrusadapter
+
+import (
+	"fmt"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// New returns Logger emitting transport events at debug level of l, keyvals become fields
+func New(l logrus.FieldLogger) httpntlm.Logger {
+	return httpntlm.LoggerFunc(func(msg string, keyvals ...interface{}) {
+		l.WithFields(fields(keyvals)).Debug(msg)
+	})
+}
+
+func fields(keyvals []interface{}) logrus.Fields {
+	f := make(logrus.Fields, len(keyvals)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if i+1 == len(keyvals) {
+			f[key] = nil
+			break
+		}
+		f[key] = keyvals[i+1]
+	}
+	return f
+}
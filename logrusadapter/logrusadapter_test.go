@@ -0,0 +1,23 @@
+package logrusadapter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_New(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetLevel(logrus.DebugLevel)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+
+	New(l).Log("sending request", "stage", "negotiate", "status", 401)
+	out := buf.String()
+	if !strings.Contains(out, `msg="sending request"`) || !strings.Contains(out, "stage=negotiate") || !strings.Contains(out, "status=401") {
+		t.Errorf("unexpected log entry %q", out)
+	}
+}
@@ -0,0 +1,42 @@
+package httpntlm
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// MachineAccount returns credentials of computer account name in domain, e.g. for service to service
+// integrations authenticating as the host they run on. Account name gets trailing $ unless it has one
+// and computer name without it becomes the workstation. ntHash is hex encoded NT hash of machine password.
+func MachineAccount(domain, name, ntHash string) Credentials {
+	computer := strings.TrimSuffix(name, "$")
+	return Credentials{
+		Domain:      domain,
+		User:        computer + "$",
+		Workstation: strings.ToUpper(computer),
+		NTHash:      ntHash,
+	}
+}
+
+// NTHash returns hex encoded NT hash of password, i.e. MD4 of its UTF-16LE encoding
+func NTHash(password string) string {
+	return hex.EncodeToString(DefaultCrypto.MD4(utf16le(password)))
+}
+
+// ntHash returns NT hash of creds, NTHash takes precedence over Password
+func ntHash(c CryptoProvider, creds Credentials) ([]byte, error) {
+	if creds.NTHash == "" {
+		return c.MD4(utf16le(creds.Password)), nil
+	}
+
+	return decodeNTHash(creds.NTHash)
+}
+
+func decodeNTHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 16 {
+		return nil, errors.New("NTHash must be 32 hex digits")
+	}
+	return hash, nil
+}
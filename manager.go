@@ -0,0 +1,118 @@
+package httpntlm
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// SessionManager derives transports for many hosts from one shared configuration, every host gets
+// a transport of its own with its own cache and connections. SessionManager itself is http.RoundTripper
+// sending requests through transport of the request's host. Config must be set before first use.
+type SessionManager struct {
+	// Config is the configuration shared by all hosts
+	Config Config
+	// Configure adjusts transport of host right after it's created out of Config, e.g. to set Logger,
+	// Metrics or host specific policies. host is in scheme://host:port form.
+	Configure func(host string, t *NtlmTransport)
+
+	mu         sync.Mutex
+	closed     bool
+	transports map[string]*NtlmTransport
+}
+
+// Transport returns transport of the host rawurl points to, creating it on first use
+func (m *SessionManager) Transport(rawurl string) (*NtlmTransport, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("url " + rawurl + " has no host")
+	}
+	return m.transport(u)
+}
+
+// Client returns http.Client using transport of the host rawurl points to
+func (m *SessionManager) Client(rawurl string) (*http.Client, error) {
+	t, err := m.Transport(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// RoundTrip sends req through transport of its host
+func (m *SessionManager) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := m.transport(req.URL)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.RoundTrip(req)
+}
+
+func (m *SessionManager) transport(u *url.URL) (*NtlmTransport, error) {
+	key := hostKey(u)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if t, ok := m.transports[key]; ok {
+		return t, nil
+	}
+
+	t, err := FromConfig(m.Config)
+	if err != nil {
+		return nil, err
+	}
+	if m.Configure != nil {
+		m.Configure(key, t)
+	}
+	if m.transports == nil {
+		m.transports = map[string]*NtlmTransport{}
+	}
+	m.transports[key] = t
+	return t, nil
+}
+
+// InvalidateAll forgets authentication knowledge of all hosts, see NtlmTransport.InvalidateAll
+func (m *SessionManager) InvalidateAll() {
+	for _, t := range m.all() {
+		t.InvalidateAll()
+	}
+}
+
+// CloseIdleConnections closes idle connections of all hosts
+func (m *SessionManager) CloseIdleConnections() {
+	for _, t := range m.all() {
+		t.CloseIdleConnections()
+	}
+}
+
+// Close closes transports of all hosts, subsequent requests fail with ErrClosed
+func (m *SessionManager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	for _, t := range m.all() {
+		t.Close()
+	}
+	return nil
+}
+
+func (m *SessionManager) all() []*NtlmTransport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	transports := make([]*NtlmTransport, 0, len(m.transports))
+	for _, t := range m.transports {
+		transports = append(transports, t)
+	}
+	return transports
+}
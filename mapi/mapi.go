@@ -0,0 +1,233 @@
+// Package mapi implements MAPI over HTTP transport conventions used by Outlook to talk to Exchange:
+// request type headers, session context cookies, chunked PROCESSING/PENDING/DONE responses
+// and hanging NotificationWait requests. ROP buffers in request and response bodies are left to the caller.
+package mapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// ContentType is the type of request and response bodies
+const ContentType = "application/mapi-http"
+
+// endpoints of mailbox and address book requests
+const (
+	EndpointEMSMDB = "emsmdb"
+	EndpointNSPI   = "nspi"
+)
+
+// request types of mailbox endpoint, address book endpoint has its own ones such as Bind, Unbind or GetMatches
+const (
+	RequestConnect          = "Connect"
+	RequestExecute          = "Execute"
+	RequestDisconnect       = "Disconnect"
+	RequestNotificationWait = "NotificationWait"
+	RequestPing             = "PING"
+)
+
+// NewTransport returns NTLM transport suited for MAPI over HTTP, NotificationWait requests hang for minutes
+// and go over their own authenticated connection next to the one of Execute requests
+func NewTransport(domain, user, password string) *httpntlm.NtlmTransport {
+	tr := httpntlm.NewBaseTransport()
+	// final response of NotificationWait comes when there is an event or the wait times out
+	tr.ResponseHeaderTimeout = 0
+	tr.IdleConnTimeout = 15 * time.Minute
+	// both endpoints plus the notification channel
+	tr.MaxIdleConnsPerHost = 4
+
+	return &httpntlm.NtlmTransport{
+		Domain:       domain,
+		User:         user,
+		Password:     password,
+		RoundTripper: tr,
+	}
+}
+
+// Client sends MAPI over HTTP requests of a single session
+type Client struct {
+	// BaseURL is MAPI virtual directory, e.g. https://mail.example.com/mapi
+	BaseURL string
+	// MailboxID identifies the mailbox, it's the mailbox GUID and domain returned by Autodiscover,
+	// e.g. 1f6ba8a0-8e48-4d2f-a0e4-5a1a872f2f2b@example.com
+	MailboxID string
+	// HTTPClient sends the requests, it's expected to authenticate them and keep session cookies
+	HTTPClient *http.Client
+	// ClientApplication is sent in X-ClientApplication header, e.g. Outlook/16.0.4266.1001
+	ClientApplication string
+
+	once       sync.Once
+	clientInfo string
+	sequence   uint64
+}
+
+// New returns client of MAPI virtual directory at baseURL authenticating through t,
+// session context cookies server hands out are kept by the client
+func New(baseURL, mailboxID string, t *httpntlm.NtlmTransport) *Client {
+	// jar without public suffix list never fails to be created
+	jar, _ := cookiejar.New(nil)
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		MailboxID:  mailboxID,
+		HTTPClient: &http.Client{Transport: t, Jar: jar},
+	}
+}
+
+// Error is returned when server reports failure in X-ResponseCode
+type Error struct {
+	Code int
+	// Message is the response body, servers describe failures in plain text
+	Message string
+}
+
+var responseCodeNames = map[int]string{
+	1: "unknown failure", 2: "invalid verb", 3: "invalid path", 4: "invalid header", 5: "invalid request type",
+	6: "invalid context cookie", 7: "missing header", 8: "anonymous not allowed", 9: "too large",
+	10: "context not found", 11: "no privilege", 12: "invalid request body", 13: "missing cookie",
+	15: "invalid sequence", 16: "endpoint disabled", 17: "invalid response", 18: "endpoint shutting down",
+}
+
+func (e *Error) Error() string {
+	name, ok := responseCodeNames[e.Code]
+	if !ok {
+		name = "response code " + strconv.Itoa(e.Code)
+	}
+	if e.Message == "" {
+		return "mapi: " + name
+	}
+	return "mapi: " + name + ": " + e.Message
+}
+
+// Response is the final part of MAPI over HTTP response
+type Response struct {
+	// Header holds headers following DONE meta-tag, such as X-ElapsedTime and X-StartTime
+	Header http.Header
+	// Body is the response body, e.g. ROP output buffer of Execute
+	Body []byte
+}
+
+// Do sends request of requestType to endpoint with body and waits for the final response,
+// PROCESSING and PENDING meta-tags server sends in the meantime are skipped
+func (c *Client) Do(ctx context.Context, endpoint, requestType string, body []byte) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.BaseURL+"/"+endpoint+"/?MailboxId="+url.QueryEscape(c.MailboxID), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("X-RequestType", requestType)
+	req.Header.Set("X-ClientInfo", c.info())
+	req.Header.Set("X-RequestId", c.info()+":"+strconv.FormatUint(atomic.AddUint64(&c.sequence, 1), 10))
+	if c.ClientApplication != "" {
+		req.Header.Set("X-ClientApplication", c.ClientApplication)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if code := resp.Header.Get("X-ResponseCode"); code != "" && code != "0" || resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	return readResponse(resp.Body)
+}
+
+// Connect establishes mailbox session, body is EcDoConnectEx request
+func (c *Client) Connect(ctx context.Context, body []byte) (*Response, error) {
+	return c.Do(ctx, EndpointEMSMDB, RequestConnect, body)
+}
+
+// Execute sends ROP request buffer of body
+func (c *Client) Execute(ctx context.Context, body []byte) (*Response, error) {
+	return c.Do(ctx, EndpointEMSMDB, RequestExecute, body)
+}
+
+// Disconnect ends mailbox session
+func (c *Client) Disconnect(ctx context.Context, body []byte) (*Response, error) {
+	return c.Do(ctx, EndpointEMSMDB, RequestDisconnect, body)
+}
+
+// NotificationWait hangs until there are pending notifications of the session or server's wait times out,
+// the request is meant to be repeated in a loop from its own goroutine, transport keeps its connection
+// authenticated next to the one used by other requests
+func (c *Client) NotificationWait(ctx context.Context, body []byte) (*Response, error) {
+	return c.Do(ctx, EndpointEMSMDB, RequestNotificationWait, body)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// info returns X-ClientInfo identifying the client session
+func (c *Client) info() string {
+	c.once.Do(func() {
+		var b [16]byte
+		rand.Read(b[:])
+		c.clientInfo = fmt.Sprintf("{%X-%X-%X-%X-%X}-1", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	})
+	return c.clientInfo
+}
+
+// responseError returns Error of failed response
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	code, err := strconv.Atoi(resp.Header.Get("X-ResponseCode"))
+	if err != nil {
+		return fmt.Errorf("mapi: %s", resp.Status)
+	}
+	return &Error{Code: code, Message: strings.TrimSpace(string(b))}
+}
+
+// readResponse reads meta-tags until DONE and the final response following it
+func readResponse(body io.Reader) (*Response, error) {
+	r := textproto.NewReader(bufio.NewReader(body))
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("mapi: incomplete response: %w", err)
+		}
+		if line == "DONE" {
+			break
+		}
+		if line != "PROCESSING" && line != "PENDING" {
+			return nil, fmt.Errorf("mapi: unexpected meta-tag %q", line)
+		}
+	}
+
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("mapi: invalid response headers: %w", err)
+	}
+	if code := header.Get("X-ResponseCode"); code != "" && code != "0" {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, fmt.Errorf("mapi: invalid response code %q", code)
+		}
+		return nil, &Error{Code: n}
+	}
+	b, err := io.ReadAll(r.R)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Header: http.Header(header), Body: b}, nil
+}
@@ -0,0 +1,70 @@
+package mapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Session(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mapi/emsmdb/" || r.URL.Query().Get("MailboxId") != "box@example.com" {
+			t.Errorf("unexpected URL %s", r.URL)
+		}
+		if r.Header.Get("Content-Type") != ContentType || !strings.HasSuffix(r.Header.Get("X-RequestId"), ":"+map[string]string{
+			RequestConnect: "1", RequestExecute: "2", RequestNotificationWait: "3"}[r.Header.Get("X-RequestType")]) {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		switch r.Header.Get("X-RequestType") {
+		case RequestConnect:
+			http.SetCookie(w, &http.Cookie{Name: "MapiContext", Value: "ctx1", Path: "/mapi/emsmdb/"})
+		case RequestExecute:
+			if c, err := r.Cookie("MapiContext"); err != nil || c.Value != "ctx1" {
+				t.Errorf("expected context cookie, got %v", r.Header.Values("Cookie"))
+			}
+		default:
+			w.Header().Set("X-ResponseCode", "10")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "context not found")
+			return
+		}
+		w.Header().Set("X-ResponseCode", "0")
+		fmt.Fprint(w, "PROCESSING\r\nPENDING\r\nDONE\r\nX-ResponseCode: 0\r\nX-ElapsedTime: 3\r\n\r\n\x01\x02")
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL+"/mapi/", "box@example.com", NewTransport("dt", "testuser", "fish"))
+	ctx := httpntlm.WithoutNTLM(context.Background())
+	if _, err := c.Connect(ctx, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Execute(ctx, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "\x01\x02" || resp.Header.Get("X-ElapsedTime") != "3" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	var e *Error
+	if _, err := c.NotificationWait(ctx, nil); !errors.As(err, &e) || e.Code != 10 || e.Message != "context not found" {
+		t.Errorf("expected context not found error, got %v", err)
+	}
+}
+
+func Test_ReadResponse(t *testing.T) {
+	if _, err := readResponse(strings.NewReader("PROCESSING\r\n")); err == nil {
+		t.Error("expected incomplete response error")
+	}
+	var e *Error
+	if _, err := readResponse(strings.NewReader("DONE\r\nX-ResponseCode: 6\r\n\r\n")); !errors.As(err, &e) || e.Code != 6 {
+		t.Errorf("expected invalid context cookie error, got %v", err)
+	}
+}
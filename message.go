@@ -0,0 +1,291 @@
+package httpntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// NegotiateFlags are NTLMSSP negotiate flags, see MS-NLMP 2.2.2.5
+type NegotiateFlags uint32
+
+// commonly inspected negotiate flags
+const (
+	FlagUnicode                 NegotiateFlags = negotiateUnicode
+	FlagOEM                     NegotiateFlags = negotiateOEM
+	FlagRequestTarget           NegotiateFlags = requestTarget
+	FlagSign                    NegotiateFlags = negotiateSign
+	FlagSeal                    NegotiateFlags = negotiateSeal
+	FlagLMKey                   NegotiateFlags = negotiateLMKey
+	FlagNTLM                    NegotiateFlags = negotiateNTLM
+	FlagAlwaysSign              NegotiateFlags = negotiateAlwaysSign
+	FlagExtendedSessionSecurity NegotiateFlags = negotiateExtendedSessionSecurity
+	FlagTargetInfo              NegotiateFlags = 0x800000
+	FlagVersion                 NegotiateFlags = negotiateVersion
+	Flag128                     NegotiateFlags = negotiate128
+	FlagKeyExch                 NegotiateFlags = negotiateKeyExch
+	Flag56                      NegotiateFlags = negotiate56
+)
+
+var flagNames = []struct {
+	flag NegotiateFlags
+	name string
+}{
+	{FlagUnicode, "unicode"},
+	{FlagOEM, "oem"},
+	{FlagRequestTarget, "request_target"},
+	{FlagSign, "sign"},
+	{FlagSeal, "seal"},
+	{FlagLMKey, "lm_key"},
+	{FlagNTLM, "ntlm"},
+	{FlagAlwaysSign, "always_sign"},
+	{FlagExtendedSessionSecurity, "extended_session_security"},
+	{FlagTargetInfo, "target_info"},
+	{FlagVersion, "version"},
+	{Flag128, "128bit"},
+	{FlagKeyExch, "key_exchange"},
+	{Flag56, "56bit"},
+}
+
+// Has reports whether all of flag are set
+func (f NegotiateFlags) Has(flag NegotiateFlags) bool {
+	return f&flag == flag
+}
+
+// String lists names of flags which are set, e.g. "unicode|ntlm|128bit", unnamed ones are given in hex
+func (f NegotiateFlags) String() string {
+	var names []string
+	for _, n := range flagNames {
+		if f.Has(n.flag) {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(f)))
+	}
+	return strings.Join(names, "|")
+}
+
+// Version is Windows version and NTLM revision message was sent with, see MS-NLMP 2.2.2.10
+type Version struct {
+	Major    uint8
+	Minor    uint8
+	Build    uint16
+	Revision uint8
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d rev %d", v.Major, v.Minor, v.Build, v.Revision)
+}
+
+func versionOf(v *ntlm.VersionStruct) (Version, bool) {
+	if v == nil {
+		return Version{}, false
+	}
+	return Version{Major: v.ProductMajorVersion, Minor: v.ProductMinorVersion, Build: v.ProductBuild, Revision: v.NTLMRevisionCurrent}, true
+}
+
+// TargetInfo is server information challenge carries, see MS-NLMP 2.2.2.1
+type TargetInfo struct {
+	NbComputerName  string
+	NbDomainName    string
+	DNSComputerName string
+	DNSDomainName   string
+	DNSTreeName     string
+	// Timestamp is server time, zero if server didn't send it
+	Timestamp time.Time
+}
+
+// NegotiateMessage is parsed NTLM negotiate message
+type NegotiateMessage struct {
+	flags       NegotiateFlags
+	domain      string
+	workstation string
+	version     *ntlm.VersionStruct
+}
+
+// ParseNegotiateMessage parses NTLM negotiate message b
+func ParseNegotiateMessage(b []byte) (*NegotiateMessage, error) {
+	if err := checkMessage(b, 1, 32); err != nil {
+		return nil, err
+	}
+
+	m := &NegotiateMessage{flags: NegotiateFlags(binary.LittleEndian.Uint32(b[12:]))}
+	m.domain = string(payload(b, 16))
+	m.workstation = string(payload(b, 24))
+	if m.flags.Has(FlagVersion) && len(b) >= 40 {
+		m.version, _ = ntlm.ReadVersionStruct(b[32:40])
+	}
+	return m, nil
+}
+
+// Flags returns negotiate flags client requested
+func (m *NegotiateMessage) Flags() NegotiateFlags {
+	return m.flags
+}
+
+// Domain returns OEM domain name client supplied
+func (m *NegotiateMessage) Domain() string {
+	return m.domain
+}
+
+// Workstation returns OEM workstation name client supplied
+func (m *NegotiateMessage) Workstation() string {
+	return m.workstation
+}
+
+// Version returns client's version, ok is false if it wasn't sent
+func (m *NegotiateMessage) Version() (v Version, ok bool) {
+	return versionOf(m.version)
+}
+
+// ChallengeMessage is parsed NTLM challenge message
+type ChallengeMessage struct {
+	m *ntlm.ChallengeMessage
+}
+
+// ParseChallengeMessage parses NTLM challenge message b
+func ParseChallengeMessage(b []byte) (*ChallengeMessage, error) {
+	if err := checkMessage(b, 2, 32); err != nil {
+		return nil, err
+	}
+	m, err := ntlm.ParseChallengeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ChallengeMessage{m: m}, nil
+}
+
+// Flags returns negotiate flags server selected
+func (c *ChallengeMessage) Flags() NegotiateFlags {
+	return NegotiateFlags(c.m.NegotiateFlags)
+}
+
+// ServerChallenge returns server's 8 byte nonce
+func (c *ChallengeMessage) ServerChallenge() []byte {
+	return append([]byte(nil), c.m.ServerChallenge...)
+}
+
+// TargetName returns name of server's realm
+func (c *ChallengeMessage) TargetName() string {
+	if c.m.TargetName == nil {
+		return ""
+	}
+	if c.Flags().Has(FlagUnicode) {
+		return fromUTF16LE(c.m.TargetName.Payload)
+	}
+	return string(c.m.TargetName.Payload)
+}
+
+// TargetInfo returns server information of the challenge, ok is false if server sent none
+func (c *ChallengeMessage) TargetInfo() (info TargetInfo, ok bool) {
+	if c.m.TargetInfo == nil {
+		return TargetInfo{}, false
+	}
+	pairs := c.m.TargetInfo
+	info = TargetInfo{
+		NbComputerName:  pairs.StringValue(ntlm.MsvAvNbComputerName),
+		NbDomainName:    pairs.StringValue(ntlm.MsvAvNbDomainName),
+		DNSComputerName: pairs.StringValue(ntlm.MsvAvDnsComputerName),
+		DNSDomainName:   pairs.StringValue(ntlm.MsvAvDnsDomainName),
+		DNSTreeName:     pairs.StringValue(ntlm.MsvAvDnsTreeName),
+	}
+	info.Timestamp, _ = challengeTime(c.m)
+	return info, true
+}
+
+// Version returns server's version, ok is false if it wasn't sent
+func (c *ChallengeMessage) Version() (v Version, ok bool) {
+	return versionOf(c.m.Version)
+}
+
+// AuthenticateMessage is parsed NTLM authenticate message
+type AuthenticateMessage struct {
+	m  *ntlm.AuthenticateMessage
+	v2 bool
+}
+
+// ParseAuthenticateMessage parses NTLM authenticate message b, NTLMv1 and NTLMv2 responses are recognized by length
+func ParseAuthenticateMessage(b []byte) (*AuthenticateMessage, error) {
+	if err := checkMessage(b, 3, 64); err != nil {
+		return nil, err
+	}
+	v2 := binary.LittleEndian.Uint16(b[20:]) > 24
+	version := 1
+	if v2 {
+		version = 2
+	}
+	m, err := ntlm.ParseAuthenticateMessage(b, version)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthenticateMessage{m: m, v2: v2}, nil
+}
+
+// Flags returns negotiate flags client agreed to
+func (a *AuthenticateMessage) Flags() NegotiateFlags {
+	return NegotiateFlags(a.m.NegotiateFlags)
+}
+
+// Domain returns domain of the user
+func (a *AuthenticateMessage) Domain() string {
+	return a.m.DomainName.String()
+}
+
+// User returns user name
+func (a *AuthenticateMessage) User() string {
+	return a.m.UserName.String()
+}
+
+// Workstation returns client's workstation name
+func (a *AuthenticateMessage) Workstation() string {
+	return a.m.Workstation.String()
+}
+
+// NTLMv2 reports whether message carries NTLMv2 response
+func (a *AuthenticateMessage) NTLMv2() bool {
+	return a.v2
+}
+
+// Version returns client's version, ok is false if it wasn't sent
+func (a *AuthenticateMessage) Version() (v Version, ok bool) {
+	return versionOf(a.m.Version)
+}
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// checkMessage checks that b is NTLM message of type t and at least min bytes long
+func checkMessage(b []byte, t uint32, min int) error {
+	if len(b) < min || !bytes.HasPrefix(b, ntlmSignature) {
+		return errors.New("not an NTLM message")
+	}
+	if got := binary.LittleEndian.Uint32(b[8:]); got != t {
+		return fmt.Errorf("NTLM message of type %d, expected %d", got, t)
+	}
+	return nil
+}
+
+// payload returns payload of security buffer at offset of message b, see MS-NLMP 2.2
+func payload(b []byte, offset int) []byte {
+	length := int(binary.LittleEndian.Uint16(b[offset:]))
+	start := int(binary.LittleEndian.Uint32(b[offset+4:]))
+	if length == 0 || start+length > len(b) {
+		return nil
+	}
+	return b[start : start+length]
+}
+
+func fromUTF16LE(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,48 @@
+package httpntlm
+
+import "context"
+
+// names of metrics transport reports
+const (
+	// MetricV1Only counts challenges that leave no room for NTLMv2 authentication
+	MetricV1Only = "ntlm_v1_only_challenges_total"
+	// MetricRetryBudgetExhausted counts handshake retries denied by RetryBudget
+	MetricRetryBudgetExhausted = "ntlm_retry_budget_exhausted_total"
+	// MetricTargetMismatch counts challenges issued by other server than the request host, see TargetPolicy
+	MetricTargetMismatch = "ntlm_target_mismatch_total"
+	// MetricChallengeFlags counts challenges by negotiate flags server set, each flag is a label
+	// with "true" or "false" value, e.g. 128bit, signing or target_info, v2 label tells if NTLMv2 is possible
+	MetricChallengeFlags = "ntlm_challenge_flags_total"
+	// MetricHandshakes counts handshakes started with origin hosts
+	MetricHandshakes = "ntlm_handshakes_total"
+	// MetricHandshakeFailures counts requests that ended with an error or 401 status after the handshake
+	MetricHandshakeFailures = "ntlm_handshake_failures_total"
+	// MetricCacheHits counts requests sent without handshake over connection known to be authenticated
+	MetricCacheHits = "ntlm_cache_hits_total"
+	// MetricCacheMisses counts requests that needed a handshake
+	MetricCacheMisses = "ntlm_cache_misses_total"
+	// MetricRetries counts requests repeated after connection failed once they were authenticated
+	MetricRetries = "ntlm_retries_total"
+)
+
+// Metrics receives counters of notable authentication events,
+// exemplar is correlation ID of the request that caused the event
+type Metrics interface {
+	Inc(name string, labels map[string]string, exemplar string)
+}
+
+// MetricsFunc adapts ordinary function to Metrics
+type MetricsFunc func(name string, labels map[string]string, exemplar string)
+
+// Inc calls f(name, labels, exemplar)
+func (f MetricsFunc) Inc(name string, labels map[string]string, exemplar string) {
+	f(name, labels, exemplar)
+}
+
+// inc increments counter name if Metrics are set
+func (t *NtlmTransport) inc(ctx context.Context, name string, labels map[string]string) {
+	if t.Metrics == nil {
+		return
+	}
+	t.Metrics.Inc(name, labels, correlationIDOf(ctx))
+}
@@ -4,122 +4,908 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sematext/go-ntlm/ntlm"
 )
 
 var errEmptyNtlm = errors.New("empty NTLM challenge")
 
-// NtlmTransport is implementation of http.RoundTripper interface
+const (
+	defaultAuthorizationHeader = "Authorization"
+	defaultChallengeHeader     = "WWW-Authenticate"
+
+	// DefaultEmptyChallengeRetries is the number of retries performed when server sends an empty NTLM challenge
+	DefaultEmptyChallengeRetries = 1
+	// DefaultMaxDrainBytes is the maximum number of bytes read from 401 response body to reuse the connection
+	DefaultMaxDrainBytes = 64 << 10
+
+	// RoundTripsHeader is the response header holding the number of extra requests made
+	// to authenticate the request, see NtlmTransport.AnnotateRoundTrips
+	RoundTripsHeader = "X-Ntlm-RoundTrips"
+)
+
+// Credentials identify the user
+type Credentials struct {
+	Domain      string
+	User        string
+	Password    string
+	Workstation string
+	// NTHash is hex encoded NT hash of the password used instead of Password, e.g. of machine account,
+	// see MachineAccount
+	NTHash string
+}
+
+// NtlmTransport is implementation of http.RoundTripper interface. It keeps state across requests,
+// so it's used by pointer and must not be copied after first use.
 type NtlmTransport struct {
 	Domain      string
 	User        string
 	Password    string
 	Workstation string
+	// NTHash is hex encoded NT hash of the password used instead of Password, e.g. machine accounts
+	// authenticate as NAME$ with the hash of the machine password, see MachineAccount
+	NTHash string
 	http.RoundTripper
 	Jar http.CookieJar
+	// AffinityCookies are names of load balancer sticky session cookies kept per host and sent with
+	// the handshake legs and subsequent requests, so the authenticate message reaches the node which issued
+	// the challenge. Names ending with * match by prefix, see DefaultAffinityCookies. Jar keeps all cookies if set.
+	AffinityCookies []string
+	// AuthorizationHeader is the request header the NTLM tokens are sent in,
+	// defaults to Authorization
+	AuthorizationHeader string
+	// ChallengeHeader is the response header the NTLM challenge is read from,
+	// defaults to WWW-Authenticate
+	ChallengeHeader string
+	// HandshakeUserAgent is User-Agent of the separate negotiate request, caller's User-Agent is used if empty
+	HandshakeUserAgent string
+	// EmptyChallengeRetries is the number of times the handshake is retried when server
+	// responds with an empty NTLM challenge, DefaultEmptyChallengeRetries is used if zero,
+	// negative value disables retries
+	EmptyChallengeRetries int
+	// EmptyChallengeRetryDelay is the pause between empty challenge retries
+	EmptyChallengeRetryDelay time.Duration
+	// MaxRechallenges limits how many times the handshake is re-run when server answers
+	// the authenticate message with a fresh NTLM challenge, zero disables re-challenge handling.
+	// Requests with a body are re-sent only if GetBody is set.
+	MaxRechallenges int
+	// MaxDrainBytes limits how much of a 401 response body is read in order to reuse the connection,
+	// larger bodies are closed unread which forces a new connection. DefaultMaxDrainBytes is used if zero,
+	// negative value means no limit.
+	MaxDrainBytes int64
+	// MaxDownloadResumes is the number of times Download resumes an interrupted transfer,
+	// DefaultMaxDownloadResumes is used if zero, negative value disables resuming
+	MaxDownloadResumes int
+	// MaxViews is the number of views As keeps, idle connections of the least recently used ones
+	// are closed when more are needed. DefaultMaxViews is used if zero.
+	MaxViews int
+	// MaxThrottleRetries is the number of times request is retried when server responds
+	// with 429 or 503 status and Retry-After header, zero disables retries.
+	// Requests with a body are re-sent only if GetBody is set.
+	MaxThrottleRetries int
+	// MaxRetryAfter is the longest Retry-After delay the transport waits for,
+	// responses asking for longer delays are returned to the caller. DefaultMaxRetryAfter is used if zero.
+	MaxRetryAfter time.Duration
+	// MaxRetries is the number of times request is repeated when connection fails after the handshake,
+	// e.g. it's reset by the server, zero disables retries. Only idempotent methods and requests with
+	// IdempotencyKeyHeader are repeated, so retries never duplicate side effects, unless RetryNonIdempotent is set.
+	// Requests with a body are re-sent only if GetBody is set.
+	MaxRetries int
+	// RetryNonIdempotent makes MaxRetries and AddressFailover repeat requests of any method,
+	// e.g. when the server is known to deduplicate them
+	RetryNonIdempotent bool
+	// DisableStaleRetry stops transport from repeating idempotent request over a new connection when
+	// the authenticated connection it was sent over turns out to be closed, e.g. server dropped it while idle
+	DisableStaleRetry bool
+	// PrivateResponses makes transport mark responses to authenticated requests with Cache-Control private,
+	// so a shared cache never serves one user's response to another. Caching RoundTripper has to wrap
+	// the transport, one used as RoundTripper fails handshakes with ErrCachedHandshake.
+	PrivateResponses bool
+	// AnnotateRoundTrips makes transport add RoundTripsHeader to responses with the number of
+	// extra requests made by NTLM authentication
+	AnnotateRoundTrips bool
+	// UploadProgress is called as request body is uploaded, bodies sent more than once
+	// during the handshake are accounted for so reported progress only moves forward
+	UploadProgress func(req *http.Request, p Progress)
+	// RequestHook is called with every request sent on behalf of the caller's one right before it's sent,
+	// e.g. to add tracing or tenant headers or signatures to negotiate and authenticate requests.
+	// The hook gets a copy it may modify, body must be left alone.
+	RequestHook func(stage Stage, req *http.Request)
+	// ResponseHook is called with response to every request sent on behalf of the caller's one before
+	// the transport looks at it, so the hook may observe or fix quirks of middleboxes, e.g. rewrite
+	// unexpected status or headers. Body the hook reads must be replaced.
+	ResponseHook func(stage Stage, resp *http.Response)
+	// Stats is called with latency breakdown of every request once its final response headers arrive
+	Stats func(req *http.Request, s RequestStats)
+	// AddressFailover makes transport repeat the handshake against other addresses of the host if connection
+	// to one of them is refused or breaks, connections to proxies and failures of connectionless hosts aren't retried.
+	// Non-idempotent requests are not repeated once they were authenticated, see RetryNonIdempotent.
+	AddressFailover bool
+	// RejectionErrors makes transport return RejectionError instead of 401 response
+	// when server rejects credentials, the error carries account state hints server gave
+	RejectionErrors bool
+	// AuthorizationErrors makes transport return AuthorizationError instead of 403 response
+	// server sends after it authenticated the request, so the caller can tell it apart from failed authentication
+	AuthorizationErrors bool
+	// VerboseErrors makes transport return HandshakeError wrapping errors of requests which failed after
+	// a challenge was received, its message summarizes negotiated flags, NTLMv2 support and target info
+	// of the challenge. See also RejectionErrors, credentials rejected with 401 response aren't errors otherwise.
+	VerboseErrors bool
+	// RenewSessions makes transport repeat the handshake once when a host which accepted the credentials before
+	// rejects them, e.g. after IIS app pool recycle or load balancer failover
+	RenewSessions bool
+	// Dialer is used to establish connections when RoundTripper is not set,
+	// e.g. SOCKS or other dialer chains built with golang.org/x/net/proxy
+	Dialer Dialer
+	// MinTLSVersion is the lowest TLS version transport created when RoundTripper is not set accepts,
+	// e.g. tls.VersionTLS12, NTLM endpoints are often old and silently negotiate weak TLS
+	MinTLSVersion uint16
+	// CipherSuites restricts TLS 1.2 and older cipher suites of transport created when RoundTripper is not set
+	CipherSuites []uint16
+	// ProxyCredentials are used to authenticate to forward proxy which responds with 407 status
+	// and demands NTLM. Note that requests to https URLs are tunneled through the proxy
+	// by the underlying RoundTripper, so only plain http requests are authenticated to the proxy.
+	ProxyCredentials *Credentials
+	// ProxyScheme is the scheme ProxyCredentials are sent to the proxy with, SchemeNTLM if empty. SchemeBasic
+	// sends them preemptively with every request the proxy forwards or tunnels, including https ones, while
+	// the origin is authenticated with NTLM as usual, e.g. squid in front of IIS. RoundTripper must be
+	// *http.Transport then, its Proxy is wrapped.
+	ProxyScheme string
+	// NTLMRoutes restricts authentication to requests matching any of the routes, other requests are sent
+	// straight to the underlying RoundTripper as with WithoutNTLM, so one client can serve both corporate
+	// and public endpoints. All requests are authenticated if empty.
+	NTLMRoutes []Route
+	// Proxies is ordered list of forward proxies all requests are sent through, request moves to the next one
+	// when the proxy can't be reached and unreachable proxies are skipped for a while. Proxy of RoundTripper,
+	// which must be *http.Transport then, is replaced, see also ProxyCredentials.
+	Proxies []*url.URL
+	// Logger receives debug events emitted during the handshake
+	Logger Logger
+	// AuditSink receives records of authentication attempts
+	AuditSink AuditSink
+	// CorrelationID extracts ID of the request which is included in all events emitted during its handshake,
+	// ID set by WithCorrelationID is used by default, see also CorrelationIDFromHeader
+	CorrelationID func(*http.Request) string
+	// CacheTTL is how long knowledge learned about a host is kept, such as whether it requires NTLM
+	// or keeps authentication on the connection, zero keeps it until InvalidateHost is called
+	CacheTTL time.Duration
+	// CacheStore keeps knowledge learned about hosts in addition to transport's own cache, so it's shared
+	// with other transports and processes using the same store. Store failures only make transport
+	// discover hosts again. InvalidateHost deletes only hosts this transport knows about.
+	CacheStore Store
+	// TargetPolicy tells whether server name in the challenge is compared with the request host
+	// to detect relayed challenges, they are not compared by default. DNS computer name has to equal the host
+	// unless it's among TargetAliases, challenges over TLS are accepted when ExtendedProtection binds them.
+	TargetPolicy TargetPolicy
+	// TargetAliases lists computer names allowed to issue challenges for a host besides the host itself,
+	// keys are host names, e.g. intranet.example.com served by web1.example.com and web2.example.com
+	TargetAliases map[string][]string
+	// HostSchemes fixes authentication scheme of hosts, keys are host names with optional port, which match
+	// any scheme, or URLs, values are SchemeNTLM, SchemeNegotiate or SchemeBasic. Other hosts are probed once
+	// by the first handshake and the scheme chosen out of the offered ones is used until authentication fails.
+	HostSchemes map[string]string
+	// AllowBasic lets transport choose Basic scheme for hosts which offer neither NTLM nor Negotiate,
+	// the password is sent in clear text then, so it should be set only for TLS endpoints
+	AllowBasic bool
+	// ExtendedProtection binds authenticate message to the origin's SPN and TLS certificate, as servers with
+	// Extended Protection for Authentication require. Built-in NTLMv2 implementation is used then,
+	// custom Backend has to bind the messages on its own.
+	ExtendedProtection bool
+	// HostSPNs override service principal names derived from the request host, e.g. HTTP/web.example.com
+	// when host is reached by its alias or address, keys are as in HostSchemes. Derived names include
+	// the port unless it's the default one, HTTP/web.example.com:8443.
+	HostSPNs map[string]string
+	// TokenSource supplies OAuth bearer tokens which are preferred over NTLM, e.g. in hybrid Exchange
+	// environments. Tokens are sent only over https to hosts in BearerHosts and hosts which offered Bearer
+	// scheme in a challenge. Request is authenticated with NTLM when no token is available or the host
+	// rejects it without offering Bearer scheme.
+	TokenSource TokenSource
+	// BearerHosts get bearer tokens from the first request, keys are as in HostSchemes
+	BearerHosts []string
+	// HandshakeLimiter limits how fast handshakes with a host start, handshakes aren't limited if nil
+	HandshakeLimiter *HandshakeLimiter
+	// Heartbeat keeps idle authenticated connections open, heartbeats aren't sent if nil
+	Heartbeat *Heartbeat
+	// RetryBudget limits handshake retries across hosts and transports sharing it, retries are unlimited if nil
+	RetryBudget *RetryBudget
+	// Crypto computes authenticate messages when set, e.g. with a FIPS certified module,
+	// the ntlm dependency's own primitives are used if nil
+	Crypto CryptoProvider
+	// Backend computes NTLM messages instead of the transport, e.g. with SSPI, Crypto and ClockSkew
+	// don't apply to it
+	Backend Backend
+	// ClockSkew is added to local clock when timestamping NTLMv2 responses to servers which don't send
+	// timestamp in the challenge, setting it makes transport compute the messages with DefaultCrypto unless Crypto is set
+	ClockSkew time.Duration
+	// MaxClockSkew makes transport return ClockSkewError instead of rejection if server clock differs this much
+	// from the local one, skew isn't checked if zero
+	MaxClockSkew time.Duration
+	// Faults are failures injected into handshake stages, meant for testing how applications
+	// handle realistic NTLM failures
+	Faults map[Stage]Fault
+	// Metrics receives counters of notable authentication events, such as NTLMv1 only challenges
+	Metrics Metrics
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	cache  *authCache
+	// draining is set by Shutdown, new requests are refused then
+	draining bool
+	// inflight is the number of requests begun and not done yet
+	inflight int
+	// drained is closed once the last in-flight request is done while draining
+	drained chan struct{}
+	// internal is the RoundTripper created by transport itself
+	internal http.RoundTripper
+	// pool holds connections bound to their authentication
+	pool *connPool
+	// onLeg is called with duration of every request sent, see IdentityPool
+	onLeg func(stage Stage, d time.Duration)
+	// beating is set once heartbeats started
+	beating bool
+	// affinity keeps AffinityCookies
+	affinity *affinityJar
+	// proxies keeps track of unreachable Proxies
+	proxies *proxyList
+	// views are transports returned by As
+	views *views
 }
 
 // RoundTrip method send http request and tries to perform NTLM authentication
-func (t NtlmTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
-	client := http.Client{}
-	if t.RoundTripper != nil {
-		client.Transport = t.RoundTripper
+func (t *NtlmTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	// overriding requests are sent by views, so they never share connections authenticated otherwise
+	if v := t.overridden(req.Context()); v != nil {
+		return t.overriddenRoundTrip(v, req)
+	}
+
+	ctx, cancel, err := t.begin(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	ctx = withCorrelationID(ctx, t.correlationID(req))
+
+	release := cancel
+	if skipNTLM(ctx) || !t.routed(req) {
+		res, err = t.base().RoundTrip(req.WithContext(ctx))
+	} else {
+		// common and seekable bodies are replayed without requiring GetBody
+		r, closeBody := replayableBody(req.WithContext(withHandshakeInfo(ctx)))
+		release = func() {
+			closeBody()
+			cancel()
+		}
+		if len(t.Proxies) > 0 {
+			res, err = t.retryRoundTrip(r, t.proxyRoundTrip)
+		} else {
+			res, err = t.retryRoundTrip(r, t.roundTrip)
+		}
+		if err == nil && t.PrivateResponses && authenticated(r) {
+			markPrivate(res.Header)
+		}
+		if err != nil {
+			err = t.verboseError(r, err)
+		}
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	newReleaseBody(res, release)
+	return res, nil
+}
+
+// base returns RoundTripper used to send the requests
+func (t *NtlmTransport) base() http.RoundTripper {
+	if t.RoundTripper != nil && len(t.Proxies) == 0 && !t.proxyBasic() {
+		return t.RoundTripper
+	}
+
+	if t.Dialer == nil && !t.hasTLSPolicy() && len(t.Proxies) == 0 && !t.proxyBasic() {
+		return http.DefaultTransport
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.internal == nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		if rt, ok := t.RoundTripper.(*http.Transport); ok {
+			tr = rt.Clone()
+		}
+		if t.Dialer != nil {
+			tr = dialerTransport(t.Dialer)
+		}
+		applyTLSPolicy(tr, t.MinTLSVersion, t.CipherSuites)
+		if len(t.Proxies) > 0 {
+			tr.Proxy = t.proxy
+		}
+		if t.proxyBasic() {
+			tr.Proxy = basicProxy(tr.Proxy, *t.ProxyCredentials)
+		}
+		t.internal = tr
+	}
+	return t.internal
+}
+
+func (t *NtlmTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base()
+	key := hostKey(req.URL)
+	// connection oriented authentication is assumed until the host proves otherwise
+	if t.authCache().get(key).connectionless {
+		return t.sendRoundTrip(base, req)
+	}
+
+	req = keepConnection(req)
+	tr, ok := base.(*http.Transport)
+	if !ok {
+		// connection can't be pinned, rely on base reusing it
+		return t.sendRoundTrip(base, req)
+	}
+
+	pool := t.connPool(tr)
+	pinned, fresh := pool.get(key)
+	if probeOf(req.Context()) != nil {
+		// probe authenticates a new connection
+		pool.put(key, pinned)
+		pinned, fresh = pool.fresh(), true
+	}
+	// long polls get connection of their own without header timeout, connections shared with other requests keep it
+	var dedicated *http.Transport
+	if longRunning(req.Context()) && pinned.ResponseHeaderTimeout != 0 {
+		pool.put(key, pinned)
+		pinned, fresh = pool.fresh(), true
+		pinned.ResponseHeaderTimeout = 0
+		dedicated = pinned
+	}
+	if fresh {
+		req = req.WithContext(withFreshConnection(req.Context()))
+	}
+	put := func(tr *http.Transport) {
+		if tr == dedicated {
+			tr.CloseIdleConnections()
+			return
+		}
+		pool.put(key, tr)
+	}
+
+	var dialed addrTrace
+	if t.AddressFailover {
+		req = dialed.trace(req)
+	}
+	var reused connTrace
+	if !fresh {
+		req = reused.trace(req)
+	}
+	resp, err := t.sendRoundTrip(pinned, req)
+	if err != nil && !fresh && reused.stale(err) {
+		put(pinned)
+		resp, pinned, err = t.staleRetry(pool, req, err)
+	}
+	if err != nil && t.AddressFailover {
+		if pinned != nil {
+			put(pinned)
+		}
+		resp, pinned, err = t.failover(pool, req, dialed.ip(), err)
+	}
+	if err != nil {
+		if pinned != nil {
+			put(pinned)
+		}
+		return nil, err
+	}
+
+	newReleaseBody(resp, func() {
+		put(pinned)
+	})
+	return resp, nil
+}
+
+// sendRoundTrip sends authenticated req through base
+func (t *NtlmTransport) sendRoundTrip(base http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	legs := &legTransport{t: t, rt: base, progress: t.newUploadProgress(req), stats: t.newLegStats()}
+	client := http.Client{
+		Transport: legs,
 	}
 
 	if t.Jar != nil {
 		client.Jar = t.Jar
 	}
+	if legs.stats != nil {
+		defer func() {
+			t.reportStats(req, legs.stats, err)
+		}()
+	}
+
+	resp, err = t.authRoundTrip(client, req)
+	// server may throttle requests during or after the handshake
+	for i := 0; i < t.MaxThrottleRetries && err == nil; i++ {
+		delay, ok := t.throttleDelay(resp)
+		if !ok {
+			break
+		}
+
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			resp.Body.Close()
+			return nil, replayErr
+		}
+		if !ok {
+			break
+		}
+
+		if err := t.discardBody(resp); err != nil {
+			return nil, err
+		}
+		if err := sleep(req, delay); err != nil {
+			return nil, err
+		}
+		resp, err = t.authRoundTrip(client, r)
+	}
 
-	resp, err := t.ntlmRoundTrip(client, req)
-	// retry once in case of an empty ntlm challenge
-	if err != nil && errors.Is(err, errEmptyNtlm) {
-		return t.ntlmRoundTrip(client, req)
+	if err == nil && t.AnnotateRoundTrips {
+		resp.Header.Set(RoundTripsHeader, strconv.Itoa(legs.extra()))
+	}
+	if err == nil && t.AuthorizationErrors {
+		if denied := t.authorizationDenied(req, resp); denied != nil {
+			return nil, denied
+		}
 	}
 
 	return resp, err
 }
 
-func (t NtlmTransport) ntlmRoundTrip(client http.Client, req *http.Request) (*http.Response, error) {
-	// first send NTLM Negotiate header
-	r, _ := http.NewRequest("GET", req.URL.String(), strings.NewReader(""))
-	r.Header.Add("Authorization", "NTLM "+EncBase64(Negotiate()))
+// authRoundTrip sends authenticated request
+func (t *NtlmTransport) authRoundTrip(client http.Client, req *http.Request) (*http.Response, error) {
+	key := hostKey(req.URL)
+	// fresh connection to NTLM only host is challenged for sure, so the handshake starts right away
+	if info := t.authCache().get(key); info.persistentAuth && probeOf(req.Context()) == nil &&
+		!(info.ntlmOnly && freshConnection(req.Context())) {
+		resp, ok, err := t.persistentRoundTrip(client, req)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if persistent, known := persistence(resp); known && !persistent {
+				t.rememberPersistence(key, false)
+			}
+			t.inc(req.Context(), MetricCacheHits, map[string]string{"host": key})
+			return resp, nil
+		}
+	}
+
+	resp, ok, err := t.bearerRoundTrip(client, req)
+	if err != nil || ok {
+		return resp, err
+	}
+
+	t.inc(req.Context(), MetricCacheMisses, map[string]string{"host": key})
+	resp, err = t.ntlmRoundTrip(client, req)
+	// retry in case of an empty ntlm challenge
+	for i := 0; i < t.emptyChallengeRetries() && errors.Is(err, errEmptyNtlm) && t.allowRetry(req.Context(), key); i++ {
+		if err := sleep(req, t.EmptyChallengeRetryDelay); err != nil {
+			return nil, err
+		}
+		resp, err = t.ntlmRoundTrip(client, req)
+	}
 
-	resp, err := client.Do(r)
+	// server may reject the authenticate message with a new challenge, e.g. after failover
+	for i := 0; i < t.MaxRechallenges && err == nil && t.isRechallenge(resp) && t.allowRetry(req.Context(), key); i++ {
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			resp.Body.Close()
+			return nil, replayErr
+		}
+		if !ok {
+			break
+		}
+
+		if err := t.discardBody(resp); err != nil {
+			return nil, err
+		}
+		resp, err = t.ntlmRoundTrip(client, r)
+	}
+
+	if t.RenewSessions && err == nil && resp.StatusCode == http.StatusUnauthorized &&
+		t.authCache().get(key).authenticated && t.allowRetry(req.Context(), key) {
+		resp, err = t.renewSession(client, req, resp)
+	}
+
+	if err == nil && resp.StatusCode != http.StatusUnauthorized {
+		persistent, _ := persistence(resp)
+		t.rememberPersistence(key, persistent)
+		t.rememberAuthenticated(key, true)
+	} else {
+		if err == nil {
+			t.rememberAuthenticated(key, false)
+		}
+		t.inc(req.Context(), MetricHandshakeFailures, map[string]string{"host": key})
+	}
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && t.RejectionErrors {
+		return nil, t.rejection(req, resp)
+	}
+
+	return resp, err
+}
+
+// persistentRoundTrip sends request without handshake to a host that keeps authentication
+// on the connection, ok is false if the request has to be authenticated
+func (t *NtlmTransport) persistentRoundTrip(client http.Client, req *http.Request) (resp *http.Response, ok bool, err error) {
+	// request is sent one more time if the connection turns out to be unauthenticated
+	r, ok, err := replayRequest(req)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	resp, err = t.do(client, withStage(r, StageDirect))
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	if err == nil && resp.StatusCode == http.StatusUnauthorized {
-		// it's necessary to reuse the same http connection
-		// in order to do that it's required to read Body and close it
+	if resp.StatusCode != http.StatusUnauthorized {
+		handshakeInfoOf(req.Context()).update(func(info *HandshakeInfo) {
+			info.Scheme, info.Cached = "NTLM", true
+		})
+		return resp, true, nil
+	}
+
+	t.learnBearer(hostKey(req.URL), resp.Header.Values(t.challengeHeader()))
+	return nil, false, t.discardBody(resp)
+}
+
+// persistence tells whether authentication persists on the connection according to
+// Persistent-Auth and Proxy-Support response headers, known is false if server didn't say
+func persistence(resp *http.Response) (persistent bool, known bool) {
+	switch strings.ToLower(resp.Header.Get("Persistent-Auth")) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+
+	if strings.EqualFold(resp.Header.Get("Proxy-Support"), "Session-Based-Authentication") {
+		return true, true
+	}
+
+	return false, false
+}
+
+// rememberPersistence records whether authentication persists on connections to the host
+func (t *NtlmTransport) rememberPersistence(key string, persistent bool) {
+	cache := t.authCache()
+	info := cache.get(key)
+	info.persistentAuth = persistent
+	cache.set(key, info)
+}
+
+// isRechallenge reports whether resp rejects authenticate message with a new NTLM challenge
+func (t *NtlmTransport) isRechallenge(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	challenge, _ := ntlmChallenge(resp.Header.Values(t.challengeHeader()))
+	return challenge != ""
+}
+
+// ntlmChallenge picks NTLM challenge out of challenge headers,
+// found reports whether NTLM scheme is present at all
+func ntlmChallenge(headers []string) (challenge string, found bool) {
+	return schemeChallenge(headers, SchemeNTLM)
+}
+
+// schemeChallenge returns token of the first challenge of scheme, NTLM tokens may be wrapped in Negotiate scheme.
+// Scheme names are case insensitive.
+func schemeChallenge(headers []string, scheme string) (challenge string, found bool) {
+	for _, h := range headers {
+		h = strings.TrimSpace(h)
+		if len(h) < len(scheme) || !strings.EqualFold(h[:len(scheme)], scheme) {
+			continue
+		}
+		if rest := h[len(scheme):]; rest == "" || rest[0] == ' ' || rest[0] == '\t' {
+			return strings.TrimSpace(rest), true
+		}
+	}
+
+	return "", false
+}
+
+// discardBody reads body to the end and closes it, this allows reusing the connection.
+// Bodies larger than MaxDrainBytes are closed right away.
+func (t *NtlmTransport) discardBody(resp *http.Response) error {
+	// there is nothing to drain out of bodiless responses
+	if resp.ContentLength == 0 || resp.Body == http.NoBody || resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return resp.Body.Close()
+	}
+
+	var err error
+	if limit := t.maxDrainBytes(); limit < 0 {
 		_, err = io.Copy(io.Discard, resp.Body)
-		if err != nil {
+	} else {
+		_, err = io.CopyN(io.Discard, resp.Body, limit+1)
+	}
+	if err != nil && err != io.EOF {
+		resp.Body.Close()
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (t *NtlmTransport) maxDrainBytes() int64 {
+	if t.MaxDrainBytes == 0 {
+		return DefaultMaxDrainBytes
+	}
+	return t.MaxDrainBytes
+}
+
+func (t *NtlmTransport) emptyChallengeRetries() int {
+	if t.EmptyChallengeRetries == 0 {
+		return DefaultEmptyChallengeRetries
+	}
+	if t.EmptyChallengeRetries < 0 {
+		return 0
+	}
+	return t.EmptyChallengeRetries
+}
+
+// sleep pauses for d or until request context is done
+func sleep(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *NtlmTransport) authorizationHeader() string {
+	if t.AuthorizationHeader != "" {
+		return t.AuthorizationHeader
+	}
+	return defaultAuthorizationHeader
+}
+
+func (t *NtlmTransport) challengeHeader() string {
+	if t.ChallengeHeader != "" {
+		return t.ChallengeHeader
+	}
+	return defaultChallengeHeader
+}
+
+func (t *NtlmTransport) ntlmRoundTrip(client http.Client, req *http.Request) (*http.Response, error) {
+	key := hostKey(req.URL)
+	scheme, configured := t.hostScheme(key)
+	resp, err := t.schemeRoundTrip(client, req, scheme)
+
+	// the first handshake with host probes it, schemes it offers instead of NTLM decide what's used from now on
+	var schemeErr *SchemeError
+	if scheme == "" && errors.As(err, &schemeErr) {
+		chosen := t.chooseScheme(schemeErr.Schemes)
+		if chosen == "" || chosen == SchemeNTLM {
 			return nil, err
 		}
-		err = resp.Body.Close()
-		if err != nil {
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			return nil, replayErr
+		}
+		if !ok {
 			return nil, err
 		}
 
-		// retrieve Www-Authenticate header from response
-		authHeaders := resp.Header.Values("WWW-Authenticate")
-		if len(authHeaders) == 0 {
-			return nil, errors.New("WWW-Authenticate header missing")
+		t.log(req.Context(), "choosing authentication scheme", "host", key, "scheme", chosen)
+		t.rememberScheme(key, chosen)
+		scheme = chosen
+		resp, err = t.schemeRoundTrip(client, r, scheme)
+		if errors.Is(err, errEmptyNtlm) {
+			// Negotiate without token means the server insists on Kerberos
+			err = schemeErr
 		}
+	}
 
-		// there could be multiple WWW-Authenticate headers, so we need to pick the one that starts with NTLM
-		ntlmChallengeFound := false
-		var ntlmChallengeString string
-		for _, h := range authHeaders {
-			if strings.HasPrefix(h, "NTLM") {
-				ntlmChallengeFound = true
-				ntlmChallengeString = strings.TrimSpace(h[4:])
-				break
-			}
+	switch {
+	case configured:
+	case err != nil || resp.StatusCode == http.StatusUnauthorized:
+		// decision is re-evaluated by the next handshake
+		if scheme != "" {
+			t.rememberScheme(key, "")
+		}
+	case scheme == "":
+		t.rememberScheme(key, SchemeNTLM)
+	}
+	return resp, err
+}
+
+// schemeRoundTrip authenticates req with scheme, NTLM if empty
+func (t *NtlmTransport) schemeRoundTrip(client http.Client, req *http.Request, scheme string) (*http.Response, error) {
+	if scheme == SchemeBasic {
+		return t.basicRoundTrip(client, req)
+	}
+	target := t.originTarget()
+	target.scheme = scheme
+	return t.handshake(client, req, target)
+}
+
+// handshake performs NTLM authentication of req against target, the handshake is repeated once
+// if connection the challenge was bound to is lost before the authenticate message is sent
+func (t *NtlmTransport) handshake(client http.Client, req *http.Request, target authTarget) (*http.Response, error) {
+	resp, lost, err := t.handshakeOnce(client, req, target)
+	if err != nil || !lost {
+		return resp, err
+	}
+
+	r, ok, err := replayRequest(req)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !ok || !t.allowRetry(req.Context(), hostKey(req.URL)) {
+		return resp, nil
+	}
+	if err := t.discardBody(resp); err != nil {
+		return nil, err
+	}
+
+	t.log(req.Context(), "connection lost during handshake, authenticating again", "proxy", target.proxy)
+	resp, _, err = t.handshakeOnce(client, r, target)
+	return resp, err
+}
+
+// handshakeOnce performs NTLM authentication of req against target, lost reports that authenticate
+// message was rejected after it had been sent over a different connection than the negotiate one
+func (t *NtlmTransport) handshakeOnce(client http.Client, req *http.Request, target authTarget) (resp *http.Response, lost bool, err error) {
+	// origin legs may need to authenticate to the proxy on their own
+	send := func(r *http.Request) (*http.Response, error) {
+		return t.do(client, r)
+	}
+	negotiateStage, authenticateStage := StageNegotiate, StageAuthenticate
+	if target.proxy {
+		send = client.Do
+		negotiateStage, authenticateStage = StageProxyNegotiate, StageProxyAuthenticate
+	}
+
+	if !target.proxy {
+		if err := t.waitHandshake(req.Context(), hostKey(req.URL)); err != nil {
+			return nil, false, err
 		}
+		t.inc(req.Context(), MetricHandshakes, map[string]string{"host": hostKey(req.URL)})
+	}
+
+	session, err := t.backend().NewSession(target.creds)
+	if err != nil {
+		return nil, false, err
+	}
+	negotiate, err := session.Negotiate()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// first send NTLM Negotiate header
+	r, err := t.negotiateRequest(req, target, negotiate)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// authentication is bound to the connection the challenge was sent over
+	var negotiated, authenticated connTrace
+	resp, err = send(negotiated.trace(withStage(r, negotiateStage)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err == nil && resp.StatusCode == target.status {
+		// it's necessary to reuse the same http connection
+		// in order to do that it's required to read Body and close it
+		err = t.discardBody(resp)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// retrieve challenge header from response
+		authHeaders := resp.Header.Values(target.challengeHeader)
+		if len(authHeaders) == 0 {
+			return nil, false, errors.New(target.challengeHeader + " header missing")
+		}
+		if !target.proxy {
+			t.rememberSchemes(hostKey(req.URL), authHeaders)
+			t.learnBearer(hostKey(req.URL), authHeaders)
+		}
+
+		// there could be multiple challenge headers, so we need to pick the one that starts with NTLM
+		ntlmChallengeString, ntlmChallengeFound := schemeChallenge(authHeaders, target.schemeName())
 		if ntlmChallengeString == "" {
 			if ntlmChallengeFound {
-				return nil, errEmptyNtlm
+				return nil, false, errEmptyNtlm
 			}
 
-			return nil, errors.New("wrong WWW-Authenticate header")
+			return nil, false, &SchemeError{Header: target.challengeHeader, Schemes: parseSchemes(authHeaders)}
 		}
 
 		challengeBytes, err := DecBase64(ntlmChallengeString)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
-		session, err := ntlm.CreateClientSession(ntlm.Version2, ntlm.ConnectionlessMode)
-		if err != nil {
-			return nil, err
-		}
-
-		session.SetUserInfo(t.User, t.Password, t.Domain, t.Workstation)
-
 		// parse NTLM challenge
 		challenge, err := ntlm.ParseChallengeMessage(challengeBytes)
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		t.recordChallengeFlags(req, target, challenge)
+		t.recordChallenge(req, target, challenge, resp)
+		if err := t.checkDowngrade(req, target, challenge); err != nil {
+			t.audit(req, target, nil, err)
+			return nil, false, err
+		}
+		if !target.proxy {
+			if err := t.checkTarget(req, challenge, t.ExtendedProtection && resp.TLS != nil); err != nil {
+				t.audit(req, target, nil, err)
+				return nil, false, err
+			}
+			t.rememberConnectionMode(hostKey(req.URL), challenge)
+			if p := probeOf(req.Context()); p != nil {
+				p.challenge(challenge.NegotiateFlags)
+			}
 		}
 
-		err = session.ProcessChallengeMessage(challenge)
-		if err != nil {
-			return nil, err
+		if s, ok := session.(*transportSession); ok && t.ExtendedProtection && !target.proxy {
+			s.binding = t.channelBinding(req, resp)
 		}
 
 		// authenticate user
-		authenticate, err := session.GenerateAuthenticateMessage()
+		authenticate, err := session.Authenticate(challengeBytes)
 		if err != nil {
-			return nil, err
+			t.audit(req, target, nil, err)
+			return nil, false, err
 		}
 
+		handshakeInfoOf(req.Context()).update(func(info *HandshakeInfo) {
+			if target.proxy {
+				info.ProxyHandshakes++
+				return
+			}
+			info.Scheme, info.Cached, info.Flags = target.schemeName(), false, NegotiateFlags(challenge.NegotiateFlags)
+			info.SPN = t.spn(req)
+			info.Handshakes++
+		})
+
 		// set NTLM Authorization header
-		req.Header.Set("Authorization", "NTLM "+EncBase64(authenticate.Bytes()))
-		return client.Do(req)
+		req.Header.Set(target.authHeader, target.schemeName()+" "+EncBase64(authenticate))
+		resp, err = send(authenticated.trace(withStage(req, authenticateStage)))
+		if err != nil {
+			t.audit(req, target, nil, err)
+			return nil, false, err
+		}
+
+		connectionBound := target.proxy || !t.authCache().get(hostKey(req.URL)).connectionless
+		lost = connectionBound && resp.StatusCode == target.status && negotiated.changed(&authenticated)
+		if !lost && resp.StatusCode == target.status {
+			if err := t.checkClockSkew(req, challenge); err != nil {
+				if discardErr := t.discardBody(resp); discardErr != nil {
+					return nil, false, discardErr
+				}
+				t.audit(req, target, nil, err)
+				return nil, false, err
+			}
+		}
+		if !lost {
+			// lost handshake is repeated over a new connection and audited then
+			t.audit(req, target, resp, nil)
+		}
+		return resp, lost, nil
 	}
 
-	return resp, err
+	return resp, false, err
 }
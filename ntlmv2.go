@@ -0,0 +1,147 @@
+package httpntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// authenticateMessage returns NTLM authenticate message answering challenge with creds,
+// binding is nil unless ExtendedProtection is set
+func (t *NtlmTransport) authenticateMessage(creds Credentials, challenge *ntlm.ChallengeMessage, binding *channelBinding) ([]byte, error) {
+	// go-ntlm timestamps the response with local clock, so adjusted clock needs built-in implementation,
+	// it also can't authenticate with NT hash nor add channel bindings
+	if t.Crypto != nil || t.ClockSkew != 0 || creds.NTHash != "" || binding != nil {
+		return ntlmv2Authenticate(t.crypto(), creds, challenge, t.now(), binding)
+	}
+
+	session, err := ntlm.CreateClientSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	if err != nil {
+		return nil, err
+	}
+	session.SetUserInfo(creds.User, creds.Password, creds.Domain, creds.Workstation)
+	if err := session.ProcessChallengeMessage(challenge); err != nil {
+		return nil, err
+	}
+	authenticate, err := session.GenerateAuthenticateMessage()
+	if err != nil {
+		return nil, err
+	}
+	return authenticate.Bytes(), nil
+}
+
+// ntlmv2Authenticate computes NTLMv2 authenticate message as described in MS-NLMP 3.3.2 with primitives of c,
+// timestamp of the challenge is used if server sent one, now otherwise. Target info is extended with binding
+// unless it's nil.
+func ntlmv2Authenticate(c CryptoProvider, creds Credentials, challenge *ntlm.ChallengeMessage, now time.Time, binding *channelBinding) ([]byte, error) {
+	flags := challenge.NegotiateFlags
+	hash, err := ntHash(c, creds)
+	if err != nil {
+		return nil, err
+	}
+	responseKey := c.HMACMD5(hash, utf16le(strings.ToUpper(creds.User)+creds.Domain))
+
+	clientChallenge := make([]byte, 8)
+	if err := c.Random(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	var targetInfo []byte
+	timestamp := fileTime(now)
+	serverTimestamp := false
+	if challenge.TargetInfoPayloadStruct != nil {
+		targetInfo = challenge.TargetInfoPayloadStruct.Payload
+	}
+	if binding != nil {
+		targetInfo = binding.targetInfo(targetInfo)
+	}
+	if challenge.TargetInfo != nil {
+		if p := challenge.TargetInfo.Find(ntlm.MsvAvTimestamp); p != nil && len(p.Value) == 8 {
+			timestamp, serverTimestamp = p.Value, true
+		}
+	}
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write(make([]byte, 4))
+	temp.Write(targetInfo)
+	temp.Write(make([]byte, 4))
+
+	proof := c.HMACMD5(responseKey, concat(challenge.ServerChallenge, temp.Bytes()))
+	ntResponse := concat(proof, temp.Bytes())
+	// LMv2 response is omitted when server sent timestamp
+	lmResponse := make([]byte, 24)
+	if !serverTimestamp {
+		lmResponse = concat(c.HMACMD5(responseKey, concat(challenge.ServerChallenge, clientChallenge)), clientChallenge)
+	}
+
+	var encryptedKey []byte
+	if ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(flags) {
+		keyExchangeKey := c.HMACMD5(responseKey, proof)
+		exportedKey := make([]byte, 16)
+		if err := c.Random(exportedKey); err != nil {
+			return nil, err
+		}
+		if encryptedKey, err = c.RC4(keyExchangeKey, exportedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	encode := utf16le
+	if !ntlm.NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) {
+		encode = func(s string) []byte { return []byte(s) }
+	}
+	fields := [][]byte{lmResponse, ntResponse, encode(creds.Domain), encode(creds.User), encode(creds.Workstation), encryptedKey}
+
+	// header, negotiate flags and version precede the payload
+	const headerLen = 8 + 4 + 6*8 + 4 + 8
+	msg := make([]byte, headerLen)
+	copy(msg, "NTLMSSP\x00")
+	put32(msg[8:], 3)
+	offset := headerLen
+	for i, f := range fields {
+		field := msg[12+i*8:]
+		put16(field, uint16(len(f)))
+		put16(field[2:], uint16(len(f)))
+		put32(field[4:], uint32(offset))
+		offset += len(f)
+	}
+	put32(msg[60:], flags)
+	put16(msg[64:], 0x0106)
+	put16(msg[66:], 7601)
+	msg[71] = 0x0f
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	return msg, nil
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		put16(b[2*i:], u)
+	}
+	return b
+}
+
+// fileTime returns t as little endian Windows FILETIME, 100ns intervals since 1601
+func fileTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.Unix()*1e7+int64(t.Nanosecond()/100)+116444736000000000))
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,309 @@
+// Package odata is a small OData v4 client on top of NTLM transport, most on-premises Microsoft REST APIs
+// are OData behind Windows authentication. It takes care of headers, error bodies, paging with
+// @odata.nextLink and $batch requests, see packages dynamics and sccm for API specific clients.
+package odata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// Client sends requests to a single OData service
+type Client struct {
+	// BaseURL is the service root, e.g. https://server.example.com/api/v1/
+	BaseURL string
+	// HTTPClient sends the requests, it's expected to authenticate them
+	HTTPClient *http.Client
+	// MaxPageSize is sent as odata.maxpagesize preference, server default is used if zero
+	MaxPageSize int
+}
+
+// New returns client of OData service at baseURL authenticating through t
+func New(baseURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Transport: t},
+	}
+}
+
+// Error is OData error response
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("odata: status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("odata: status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// NewRequest returns request of path relative to BaseURL, body other than nil is sent as JSON
+func (c *Client) NewRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req.Header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	return req, nil
+}
+
+func (c *Client) resolve(path string) (string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (c *Client) setHeaders(h http.Header) {
+	h.Set("Accept", "application/json")
+	h.Set("OData-MaxVersion", "4.0")
+	h.Set("OData-Version", "4.0")
+	if c.MaxPageSize > 0 {
+		h.Set("Prefer", "odata.maxpagesize="+strconv.Itoa(c.MaxPageSize))
+	}
+}
+
+// Do sends req and decodes JSON response into v unless v is nil, error responses are returned as *Error
+func (c *Client) Do(req *http.Request, v interface{}) error {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := CheckResponse(resp); err != nil {
+		return err
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Get decodes JSON resource at path relative to BaseURL into v
+func (c *Client) Get(ctx context.Context, path string, v interface{}) error {
+	req, err := c.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return c.Do(req, v)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// CheckResponse returns *Error for error responses, body is read in that case.
+// Both OData v4 and v3 JSON error formats are decoded.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		V3 struct {
+			Code    string `json:"code"`
+			Message struct {
+				Value string `json:"value"`
+			} `json:"message"`
+		} `json:"odata.error"`
+	}
+	e := &Error{StatusCode: resp.StatusCode}
+	if err := json.Unmarshal(b, &body); err == nil {
+		e.Code, e.Message = body.Error.Code, body.Error.Message
+		if e.Message == "" {
+			e.Code, e.Message = body.V3.Code, body.V3.Message.Value
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
+
+// List calls fn with every item of collection at path, following @odata.nextLink through all pages
+func (c *Client) List(ctx context.Context, path string, fn func(item json.RawMessage) error) error {
+	req, err := c.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"@odata.nextLink"`
+		}
+		if err := c.Do(req, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Value {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		if page.NextLink == "" {
+			return nil
+		}
+
+		// next link may be relative to the request URL
+		next, err := req.URL.Parse(page.NextLink)
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, next.String(), nil)
+		if err != nil {
+			return err
+		}
+		c.setHeaders(req.Header)
+	}
+}
+
+// Batch sends reqs in a single $batch request and returns their responses in the same order,
+// response bodies are buffered. Requests should be created by NewRequest.
+func (c *Client) Batch(ctx context.Context, reqs []*http.Request) ([]*http.Response, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	boundary := "batch_" + w.Boundary()
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for _, r := range reqs {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Write(part); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	b := body.Bytes()
+	req, err := c.NewRequest(ctx, http.MethodPost, "$batch", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	responses, err := ReadBatch(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != len(reqs) {
+		return nil, fmt.Errorf("odata: batch of %d requests got %d responses", len(reqs), len(responses))
+	}
+	for i, r := range responses {
+		r.Request = reqs[i]
+	}
+	return responses, nil
+}
+
+// ReadBatch parses multipart batch response of contentType, change set responses are flattened
+// and bodies are buffered
+func ReadBatch(contentType string, body io.Reader) ([]*http.Response, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("odata: unexpected batch response type %q", contentType)
+	}
+
+	var responses []*http.Response
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if ct := part.Header.Get("Content-Type"); strings.HasPrefix(ct, "multipart/") {
+			changeset, err := ReadBatch(ct, part)
+			if err != nil {
+				return nil, err
+			}
+			responses = append(responses, changeset...)
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		responses = append(responses, resp)
+	}
+}
@@ -0,0 +1,97 @@
+package odata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_List(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("OData-Version") != "4.0" || r.Header.Get("Prefer") != "odata.maxpagesize=1" {
+			t.Errorf("missing OData headers %v", r.Header)
+		}
+		switch r.URL.Query().Get("$skiptoken") {
+		case "":
+			fmt.Fprint(w, `{"value":[{"name":"a"}],"@odata.nextLink":"Items?$skiptoken=1"}`)
+		case "1":
+			fmt.Fprint(w, `{"value":[{"name":"b"}]}`)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL + "/api/v1", MaxPageSize: 1}
+	var names []string
+	err := c.List(context.Background(), "Items", func(item json.RawMessage) error {
+		var v struct{ Name string }
+		json.Unmarshal(item, &v)
+		names = append(names, v.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, "") != "ab" {
+		t.Errorf("expected items of both pages, got %v", names)
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		switch r.URL.Path {
+		case "/v4":
+			fmt.Fprint(w, `{"error":{"code":"BadRequest","message":"invalid filter"}}`)
+		case "/v3":
+			fmt.Fprint(w, `{"odata.error":{"code":"-1","message":{"lang":"en-US","value":"invalid filter"}}}`)
+		default:
+			fmt.Fprint(w, "plain failure")
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL}
+	for path, want := range map[string]string{"v4": "invalid filter", "v3": "invalid filter", "plain": "plain failure"} {
+		var e *Error
+		if err := c.Get(context.Background(), path, nil); !errors.As(err, &e) || e.Message != want || e.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected error of %s: %v", path, err)
+		}
+	}
+}
+
+func Test_Batch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/$batch" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Count(string(body), "GET /") != 2 {
+			t.Errorf("unexpected batch body %s", body)
+		}
+		w.Header().Set("Content-Type", "multipart/mixed; boundary=b")
+		fmt.Fprint(w, "--b\r\nContent-Type: multipart/mixed; boundary=cs\r\n\r\n"+
+			"--cs\r\nContent-Type: application/http\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n{}\r\n"+
+			"--cs--\r\n"+
+			"--b\r\nContent-Type: application/http\r\n\r\nHTTP/1.1 404 Not Found\r\n\r\n\r\n"+
+			"--b--\r\n")
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL}
+	ctx := context.Background()
+	first, _ := c.NewRequest(ctx, http.MethodGet, "Items(1)", nil)
+	second, _ := c.NewRequest(ctx, http.MethodGet, "Items(2)", nil)
+	responses, err := c.Batch(ctx, []*http.Request{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses[0].StatusCode != http.StatusOK || responses[1].StatusCode != http.StatusNotFound || responses[1].Request != second {
+		t.Errorf("unexpected responses %d %d", responses[0].StatusCode, responses[1].StatusCode)
+	}
+}
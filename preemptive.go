@@ -0,0 +1,62 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strings"
+)
+
+// negotiateRequest returns request carrying NTLM negotiate message. Hosts known to accept NTLM only
+// get the message on the caller's bodyless request itself instead of a separate probe, so the response
+// is final if the resource turns out not to require authentication. Bodies are sent only with
+// the authenticate message, they aren't uploaded twice.
+func (t *NtlmTransport) negotiateRequest(req *http.Request, target authTarget, negotiate []byte) (*http.Request, error) {
+	if !target.proxy && (req.Body == nil || req.Body == http.NoBody) && t.authCache().get(hostKey(req.URL)).ntlmOnly {
+		r, ok, err := replayRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r.Header.Set(target.authHeader, target.schemeName()+" "+EncBase64(negotiate))
+			return r, nil
+		}
+	}
+
+	r, err := http.NewRequestWithContext(req.Context(), "GET", req.URL.String(), strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Add(target.authHeader, target.schemeName()+" "+EncBase64(negotiate))
+	// negotiate leg must handle compression the same way caller's request does,
+	// http.Transport decompresses responses only when Accept-Encoding wasn't set explicitly
+	if ae := req.Header.Values("Accept-Encoding"); len(ae) > 0 {
+		r.Header["Accept-Encoding"] = append([]string(nil), ae...)
+	}
+	// server which turns out not to require authentication answers the negotiate request instead of caller's one,
+	// so it must get the validators of conditional GET not to send full response in place of 304
+	if req.Method == http.MethodGet {
+		for _, h := range []string{"If-None-Match", "If-Modified-Since"} {
+			if v := req.Header.Values(h); len(v) > 0 {
+				r.Header[h] = append([]string(nil), v...)
+			}
+		}
+	}
+	// some firewalls reject default Go User-Agent
+	if ua := t.HandshakeUserAgent; ua != "" {
+		r.Header.Set("User-Agent", ua)
+	} else if ua, ok := req.Header["User-Agent"]; ok {
+		r.Header["User-Agent"] = append([]string(nil), ua...)
+	}
+
+	return r, nil
+}
+
+// rememberSchemes records whether host offers NTLM as the only authentication scheme
+func (t *NtlmTransport) rememberSchemes(key string, challenges []string) {
+	schemes := parseSchemes(challenges)
+	ntlmOnly := len(schemes) == 1 && strings.EqualFold(schemes[0], "NTLM")
+
+	cache := t.authCache()
+	info := cache.get(key)
+	info.ntlmOnly = ntlmOnly
+	cache.set(key, info)
+}
@@ -0,0 +1,39 @@
+package httpntlm
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrCachedHandshake is returned when handshake response comes from caching RoundTripper underneath
+// the transport, httpcache and alike mark such responses with X-From-Cache header. Caches have to wrap
+// NtlmTransport instead, so they see responses of caller's requests only, see NtlmTransport.PrivateResponses.
+var ErrCachedHandshake = errors.New("ntlm handshake response came from cache, caching RoundTripper must wrap the transport")
+
+// cachedHandshake reports whether response to handshake leg of stage was served by a cache
+func cachedHandshake(stage Stage, resp *http.Response) bool {
+	switch stage {
+	case StageNegotiate, StageAuthenticate, StageProxyNegotiate, StageProxyAuthenticate:
+		return resp.Header.Get("X-From-Cache") != ""
+	}
+	return false
+}
+
+// markPrivate makes Cache-Control of authenticated response private, directives letting shared caches
+// store it are removed
+func markPrivate(h http.Header) {
+	directives := []string{"private"}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			name := strings.ToLower(strings.TrimSpace(strings.SplitN(d, "=", 2)[0]))
+			switch name {
+			case "", "public", "private", "s-maxage":
+				continue
+			}
+			directives = append(directives, d)
+		}
+	}
+	h.Set("Cache-Control", strings.Join(directives, ", "))
+}
@@ -0,0 +1,113 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProbeResult describes authentication against an endpoint performed by Probe
+type ProbeResult struct {
+	// Success is set when the handshake ended up with a response other than 401 or 407
+	Success bool
+	// StatusCode is the status of the final response, zero if no response was received
+	StatusCode int
+	// Schemes are authentication schemes offered to anonymous request
+	Schemes []string
+	// Flags are negotiate flags of server's NTLM challenge, see ntlm.NegotiateFlag
+	Flags uint32
+	// Legs are requests sent during the handshake in the order they were sent
+	Legs []ProbeLeg
+	// Duration is how long the whole probe took
+	Duration time.Duration
+	// Err is the reason of failure, nil on success
+	Err error
+}
+
+// ProbeLeg describes a single request sent by Probe
+type ProbeLeg struct {
+	Stage      Stage
+	StatusCode int
+	Duration   time.Duration
+	Err        error
+}
+
+// probe collects details of a handshake performed by Probe
+type probe struct {
+	mu     sync.Mutex
+	result ProbeResult
+}
+
+func (p *probe) leg(leg ProbeLeg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.result.Legs = append(p.result.Legs, leg)
+}
+
+func (p *probe) challenge(flags uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.result.Flags = flags
+}
+
+func probeOf(ctx context.Context) *probe {
+	p, _ := ctx.Value(probeKey).(*probe)
+	return p
+}
+
+// Probe performs full handshake against url over a new connection, regardless of what transport knows
+// about the host, and reports how it went. It's meant for readiness checks and monitoring,
+// failures are reported by ProbeResult.Err so err is returned only if url is invalid.
+func (t *NtlmTransport) Probe(ctx context.Context, url string) (*ProbeResult, error) {
+	p := &probe{}
+	ctx = context.WithValue(ctx, probeKey, p)
+	start := time.Now()
+
+	anonymous, err := http.NewRequestWithContext(WithoutNTLM(ctx), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.RoundTrip(anonymous)
+	if err == nil {
+		p.leg(ProbeLeg{Stage: StageAnonymous, StatusCode: resp.StatusCode, Duration: time.Since(start)})
+		p.mu.Lock()
+		p.result.Schemes = t.OfferedSchemes(resp)
+		p.mu.Unlock()
+		err = t.discardBody(resp)
+	}
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	if err == nil && (status == http.StatusUnauthorized || status == http.StatusProxyAuthRequired) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err = t.RoundTrip(req)
+		switch {
+		case err != nil:
+			status = 0
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusProxyAuthRequired:
+			status = resp.StatusCode
+			err = t.rejection(req, resp)
+		default:
+			status = resp.StatusCode
+			err = t.discardBody(resp)
+		}
+	}
+	if status == 0 {
+		var rejection *RejectionError
+		if errors.As(err, &rejection) {
+			status = rejection.Response.StatusCode
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := p.result
+	result.Duration = time.Since(start)
+	result.StatusCode = status
+	result.Err = err
+	result.Success = err == nil && status != http.StatusUnauthorized && status != http.StatusProxyAuthRequired
+	return &result, nil
+}
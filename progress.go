@@ -0,0 +1,80 @@
+package httpntlm
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Progress describes how much of the request body has been uploaded
+type Progress struct {
+	// Stage is the leg currently sending the body
+	Stage Stage
+	// Sent is the number of bytes uploaded, body sent again by a later leg doesn't count twice
+	// so Sent never decreases and never exceeds the body size
+	Sent int64
+	// Total is the body size, -1 if unknown
+	Total int64
+}
+
+// uploadProgress tracks body uploads across all legs of a single caller's request
+type uploadProgress struct {
+	mu     sync.Mutex
+	req    *http.Request
+	report func(*http.Request, Progress)
+	sent   int64
+}
+
+// newUploadProgress returns tracker of req uploads, nil if progress isn't reported
+func (t *NtlmTransport) newUploadProgress(req *http.Request) *uploadProgress {
+	if t.UploadProgress == nil {
+		return nil
+	}
+	return &uploadProgress{req: req, report: t.UploadProgress}
+}
+
+// track returns shallow copy of leg request with body reporting upload progress
+func (p *uploadProgress) track(r *http.Request) *http.Request {
+	if p == nil || r.Body == nil || r.Body == http.NoBody {
+		return r
+	}
+
+	body := &progressBody{ReadCloser: r.Body, p: p, stage: stageOf(r.Context()), total: r.ContentLength}
+	if body.total == 0 {
+		body.total = -1
+	}
+	tracked := *r
+	tracked.Body = body
+	return &tracked
+}
+
+// progressBody counts bytes of a single leg's body
+type progressBody struct {
+	io.ReadCloser
+	p     *uploadProgress
+	stage Stage
+	total int64
+	sent  int64
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.sent += int64(n)
+		b.p.update(b.stage, b.sent, b.total)
+	}
+	return n, err
+}
+
+// update reports progress when leg got further than any leg before it
+func (p *uploadProgress) update(stage Stage, sent, total int64) {
+	p.mu.Lock()
+	if sent <= p.sent {
+		p.mu.Unlock()
+		return
+	}
+	p.sent = sent
+	p.mu.Unlock()
+
+	p.report(p.req, Progress{Stage: stage, Sent: sent, Total: total})
+}
@@ -0,0 +1,104 @@
+package httpntlm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// MetricProxyFailovers counts requests moved to the next of Proxies because a proxy couldn't be reached,
+// labeled by the unreachable proxy
+const MetricProxyFailovers = "ntlm_proxy_failovers_total"
+
+// proxyRecheck is how long unreachable proxy is skipped before it's tried again
+const proxyRecheck = 30 * time.Second
+
+// proxyList keeps track of unreachable Proxies
+type proxyList struct {
+	urls []*url.URL
+	// down are times proxies became unreachable, zero for reachable ones
+	down []time.Time
+}
+
+// proxyList returns state of Proxies of t
+func (t *NtlmTransport) proxyList() *proxyList {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.proxies == nil {
+		t.proxies = &proxyList{
+			urls: append([]*url.URL(nil), t.Proxies...),
+			down: make([]time.Time, len(t.Proxies)),
+		}
+	}
+	return t.proxies
+}
+
+// pickProxy returns index of the first proxy which isn't known to be unreachable,
+// the one which failed the longest time ago if all of them are
+func (t *NtlmTransport) pickProxy(l *proxyList) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	oldest := 0
+	for i, down := range l.down {
+		if down.IsZero() || time.Since(down) >= proxyRecheck {
+			return i
+		}
+		if down.Before(l.down[oldest]) {
+			oldest = i
+		}
+	}
+	return oldest
+}
+
+func (t *NtlmTransport) proxyDown(l *proxyList, i int) {
+	t.mu.Lock()
+	l.down[i] = time.Now()
+	t.mu.Unlock()
+}
+
+// proxy is Proxy function of transport created for Proxies
+func (t *NtlmTransport) proxy(req *http.Request) (*url.URL, error) {
+	l := t.proxyList()
+	i, ok := req.Context().Value(proxyIndexKey).(int)
+	if !ok {
+		i = t.pickProxy(l)
+	}
+	return l.urls[i], nil
+}
+
+// proxyRoundTrip sends req through the first available of Proxies, the whole round trip including proxy
+// authentication is repeated through the next proxy when the current one can't be reached
+func (t *NtlmTransport) proxyRoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.proxyList()
+	for attempt := 1; ; attempt++ {
+		i := t.pickProxy(l)
+		resp, err := t.roundTrip(req.WithContext(context.WithValue(req.Context(), proxyIndexKey, i)))
+		if err == nil || !isProxyUnreachable(err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		t.proxyDown(l, i)
+		if attempt == len(l.urls) {
+			return nil, err
+		}
+
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			return nil, replayErr
+		}
+		if !ok {
+			return nil, err
+		}
+		t.log(req.Context(), "proxy unreachable, failing over", "proxy", l.urls[i].Host, "error", err)
+		t.inc(req.Context(), MetricProxyFailovers, map[string]string{"proxy": l.urls[i].Host})
+		req = r
+	}
+}
+
+// isProxyUnreachable reports whether err means connection to the proxy couldn't be established
+func isProxyUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
@@ -0,0 +1,79 @@
+package httpntlm
+
+import (
+	"net/http"
+)
+
+// authTarget is the party NTLM handshake is performed with
+type authTarget struct {
+	// proxy is set for forward proxy authentication
+	proxy bool
+	// status is the response status code demanding authentication
+	status          int
+	authHeader      string
+	challengeHeader string
+	creds           Credentials
+	// scheme NTLM tokens are sent with, NTLM if empty
+	scheme string
+}
+
+// schemeName returns scheme NTLM tokens are sent with
+func (a authTarget) schemeName() string {
+	if a.scheme == "" {
+		return SchemeNTLM
+	}
+	return a.scheme
+}
+
+func (t *NtlmTransport) originTarget() authTarget {
+	return authTarget{
+		status:          http.StatusUnauthorized,
+		authHeader:      t.authorizationHeader(),
+		challengeHeader: t.challengeHeader(),
+		creds: Credentials{
+			Domain:      t.Domain,
+			User:        t.User,
+			Password:    t.Password,
+			Workstation: t.Workstation,
+			NTHash:      t.NTHash,
+		},
+	}
+}
+
+func (t *NtlmTransport) proxyTarget() authTarget {
+	return authTarget{
+		proxy:           true,
+		status:          http.StatusProxyAuthRequired,
+		authHeader:      "Proxy-Authorization",
+		challengeHeader: "Proxy-Authenticate",
+		creds:           *t.ProxyCredentials,
+	}
+}
+
+// do sends request authenticating to the proxy if it demands NTLM,
+// proxy handshake is independent of the origin one and happens on the same connection
+func (t *NtlmTransport) do(client http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || t.ProxyCredentials == nil || t.proxyBasic() {
+		return resp, err
+	}
+
+	if _, found := ntlmChallenge(resp.Header.Values("Proxy-Authenticate")); !found {
+		return resp, nil
+	}
+
+	r, ok, err := replayRequest(req)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !ok {
+		return resp, nil
+	}
+
+	if err := t.discardBody(resp); err != nil {
+		return nil, err
+	}
+
+	return t.handshake(client, r, t.proxyTarget())
+}
@@ -0,0 +1,38 @@
+package httpntlm
+
+import (
+	"fmt"
+)
+
+const redacted = "[redacted]"
+
+// String implements fmt.Stringer, password is never printed
+func (t *NtlmTransport) String() string {
+	return fmt.Sprintf("NtlmTransport{Domain: %q, User: %q, Password: %q, Workstation: %q}",
+		t.Domain, t.User, redactedPassword(t.Password), t.Workstation)
+}
+
+// GoString implements fmt.GoStringer, password is never printed
+func (t *NtlmTransport) GoString() string {
+	return fmt.Sprintf("&httpntlm.NtlmTransport{Domain:%q, User:%q, Password:%q, Workstation:%q}",
+		t.Domain, t.User, redactedPassword(t.Password), t.Workstation)
+}
+
+func redactedPassword(password string) string {
+	if password == "" {
+		return ""
+	}
+	return redacted
+}
+
+// String implements fmt.Stringer, password is never printed
+func (c Credentials) String() string {
+	return fmt.Sprintf("Credentials{Domain: %q, User: %q, Password: %q, Workstation: %q}",
+		c.Domain, c.User, redactedPassword(c.Password), c.Workstation)
+}
+
+// GoString implements fmt.GoStringer, password is never printed
+func (c Credentials) GoString() string {
+	return fmt.Sprintf("httpntlm.Credentials{Domain:%q, User:%q, Password:%q, Workstation:%q}",
+		c.Domain, c.User, redactedPassword(c.Password), c.Workstation)
+}
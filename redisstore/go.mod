@@ -0,0 +1,16 @@
+module github.com/sematext/go-http-ntlm/redisstore
+
+go 1.18
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/redis/go-redis/v9 v9.7.3
+	github.com/sematext/go-http-ntlm/v2 v2.0.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/sematext/go-ntlm v0.0.0-20230817113007-b05d65ad37bf // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+)
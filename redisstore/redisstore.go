@@ -0,0 +1,77 @@
+// Package redisstore keeps knowledge NTLM transport learns about hosts in Redis, so that
+// horizontally scaled processes discover every host once instead of each of them doing so after a deploy.
+// It's a separate module so the transport doesn't depend on Redis client.
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+const (
+	// DefaultPrefix is prepended to keys when Store.Prefix is empty
+	DefaultPrefix = "ntlm:host:"
+	// DefaultTimeout limits single Redis command when Store.Timeout is zero
+	DefaultTimeout = time.Second
+)
+
+// Store is httpntlm.Store keeping values in Redis
+type Store struct {
+	// Client sends commands to Redis
+	Client redis.UniversalClient
+	// Prefix is prepended to keys so the store can share database with other data
+	Prefix string
+	// Timeout limits every command, transport waits for the store while sending requests
+	Timeout time.Duration
+}
+
+// New returns store keeping values through client
+func New(client redis.UniversalClient) *Store {
+	return &Store{Client: client}
+}
+
+var _ httpntlm.Store = (*Store)(nil)
+
+// Get returns value of key, httpntlm.ErrNotStored if there's none
+func (s *Store) Get(key string) ([]byte, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	b, err := s.Client.Get(ctx, s.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, httpntlm.ErrNotStored
+	}
+	return b, err
+}
+
+// Set stores value of key which expires after ttl, it never expires if ttl is zero
+func (s *Store) Set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.Client.Set(ctx, s.key(key), value, ttl).Err()
+}
+
+// Delete removes value of key
+func (s *Store) Delete(key string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.Client.Del(ctx, s.key(key)).Err()
+}
+
+func (s *Store) key(key string) string {
+	if s.Prefix == "" {
+		return DefaultPrefix + key
+	}
+	return s.Prefix + key
+}
+
+func (s *Store) context() (context.Context, context.CancelFunc) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,36 @@
+package redisstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Store(t *testing.T) {
+	server := miniredis.RunT(t)
+	s := New(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+
+	if _, err := s.Get("http://ntlm.test:80"); err != httpntlm.ErrNotStored {
+		t.Errorf("expected missing key, got %v", err)
+	}
+	if err := s.Set("http://ntlm.test:80", []byte(`{"ntlmOnly":true}`), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL(DefaultPrefix + "http://ntlm.test:80"); ttl != time.Minute {
+		t.Errorf("unexpected ttl %v", ttl)
+	}
+	b, err := s.Get("http://ntlm.test:80")
+	if err != nil || string(b) != `{"ntlmOnly":true}` {
+		t.Errorf("unexpected value %s %v", b, err)
+	}
+
+	if err := s.Delete("http://ntlm.test:80"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("http://ntlm.test:80"); err != httpntlm.ErrNotStored {
+		t.Errorf("expected deleted key, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package httpntlm
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AccountState is server's hint on why credentials were rejected
+type AccountState int
+
+// account states servers are known to hint at
+const (
+	// AccountUnknown means server gave no recognizable hint
+	AccountUnknown AccountState = iota
+	// AccountWrongPassword means user name or password is wrong
+	AccountWrongPassword
+	// AccountLocked means account is locked out
+	AccountLocked
+	// AccountDisabled means account is disabled
+	AccountDisabled
+	// AccountExpired means account has expired
+	AccountExpired
+	// AccountPasswordExpired means password has expired
+	AccountPasswordExpired
+	// AccountPasswordMustChange means password has to be changed before logging in
+	AccountPasswordMustChange
+)
+
+var accountStateNames = map[AccountState]string{
+	AccountUnknown:            "unknown",
+	AccountWrongPassword:      "wrong password",
+	AccountLocked:             "account locked",
+	AccountDisabled:           "account disabled",
+	AccountExpired:            "account expired",
+	AccountPasswordExpired:    "password expired",
+	AccountPasswordMustChange: "password must change",
+}
+
+func (s AccountState) String() string {
+	if name, ok := accountStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// accountHints maps lowercase NTSTATUS codes and messages IIS and Exchange put in rejection
+// responses to account states, more specific hints come first
+var accountHints = []struct {
+	state AccountState
+	hints []string
+}{
+	{AccountLocked, []string{"0xc0000234", "account is locked", "account has been locked", "locked out"}},
+	{AccountDisabled, []string{"0xc0000072", "account is disabled", "account has been disabled"}},
+	{AccountExpired, []string{"0xc0000193", "account has expired", "account is expired"}},
+	{AccountPasswordExpired, []string{"0xc0000071", "password has expired", "password is expired"}},
+	{AccountPasswordMustChange, []string{"0xc0000224", "password must be changed", "must change password"}},
+	{AccountWrongPassword, []string{"0xc000006a", "0xc000006d", "401.1", "logon failed", "unknown user name or bad password"}},
+}
+
+// diagnosticHeaders are response headers that may carry rejection reason
+var diagnosticHeaders = []string{"X-MS-Diagnostics", "X-MS-Diagnostics-Public", "X-Auth-Error", "X-Error"}
+
+// RejectionError is returned instead of 401 response when server rejects credentials
+// and NtlmTransport.RejectionErrors is set
+type RejectionError struct {
+	// State is account state server hinted at
+	State AccountState
+	// Hint is the text state was recognized by
+	Hint string
+	// Response is the rejection, its body is buffered up to MaxDrainBytes and can be read after the error is returned
+	Response *http.Response
+}
+
+func (e *RejectionError) Error() string {
+	if e.State == AccountUnknown {
+		return "credentials rejected"
+	}
+	return "credentials rejected: " + e.State.String()
+}
+
+// rejection returns RejectionError for resp, connection is released by buffering the body
+func (t *NtlmTransport) rejection(req *http.Request, resp *http.Response) error {
+	b, err := t.bufferBody(resp)
+	if err != nil {
+		return err
+	}
+
+	var texts []string
+	for _, name := range diagnosticHeaders {
+		texts = append(texts, resp.Header.Values(name)...)
+	}
+	state, hint := accountState(append(texts, string(b)))
+	t.log(req.Context(), "credentials rejected", "state", state.String())
+
+	return &RejectionError{State: state, Hint: hint, Response: resp}
+}
+
+// bufferBody replaces body of resp with its first MaxDrainBytes read into memory, so that the connection
+// is released while the response can still be read
+func (t *NtlmTransport) bufferBody(resp *http.Response) ([]byte, error) {
+	var body io.Reader = resp.Body
+	if limit := t.maxDrainBytes(); limit >= 0 {
+		body = io.LimitReader(resp.Body, limit)
+	}
+	b, err := io.ReadAll(body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// accountState looks for account state hints in texts
+func accountState(texts []string) (AccountState, string) {
+	for _, h := range accountHints {
+		for _, text := range texts {
+			lower := strings.ToLower(text)
+			for _, hint := range h.hints {
+				if strings.Contains(lower, hint) {
+					return h.state, hint
+				}
+			}
+		}
+	}
+
+	return AccountUnknown, ""
+}
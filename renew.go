@@ -0,0 +1,41 @@
+package httpntlm
+
+import (
+	"net/http"
+)
+
+// MetricSessionRenewals counts handshakes repeated because a host rejected credentials it had accepted before,
+// labeled by host
+const MetricSessionRenewals = "ntlm_session_renewals_total"
+
+// renewSession repeats handshake of req rejected with resp by a host which accepted the credentials before,
+// server likely lost the session, e.g. after IIS app pool recycle or load balancer failover
+func (t *NtlmTransport) renewSession(client http.Client, req *http.Request, resp *http.Response) (*http.Response, error) {
+	r, ok, err := replayRequest(req)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !ok {
+		return resp, nil
+	}
+	if err := t.discardBody(resp); err != nil {
+		return nil, err
+	}
+
+	key := hostKey(req.URL)
+	t.log(req.Context(), "renewing session", "host", key)
+	t.inc(req.Context(), MetricSessionRenewals, map[string]string{"host": key})
+	return t.ntlmRoundTrip(client, r)
+}
+
+// rememberAuthenticated records whether host accepted the credentials last time
+func (t *NtlmTransport) rememberAuthenticated(key string, authenticated bool) {
+	cache := t.authCache()
+	info := cache.get(key)
+	if info.authenticated == authenticated {
+		return
+	}
+	info.authenticated = authenticated
+	cache.set(key, info)
+}
@@ -0,0 +1,211 @@
+package httpntlm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// CloneRequestWithBody returns a copy of req which can be sent independently of it, the same way the transport
+// replays requests during the handshake. Headers are deep copied and GetBody is installed on the copy.
+// Body of a request without GetBody is read into memory, req then gets GetBody and a fresh Body of its own
+// so it can still be sent.
+func CloneRequestWithBody(req *http.Request) (*http.Request, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	r, _, err := replayRequest(req)
+	return r, err
+}
+
+// replayRequest returns a copy of req with a fresh body suitable for sending it once more,
+// ok is false if request body can't be replayed. Body bytes and representation headers such as
+// Content-Encoding are replayed as they are, so pre-compressed uploads aren't encoded again.
+func replayRequest(req *http.Request) (r *http.Request, ok bool, err error) {
+	r = req.Clone(req.Context())
+	// trailer values may be set by the body while it's being read,
+	// so the copy shares trailers with the original request
+	r.Trailer = req.Trailer
+	if req.TransferEncoding != nil {
+		r.TransferEncoding = append([]string(nil), req.TransferEncoding...)
+	}
+	r.ContentLength = req.ContentLength
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, true, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, false, nil
+	}
+
+	r.Body, err = req.GetBody()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return r, true, nil
+}
+
+// errBodyReplaced is returned by reads of a rewound body after a later leg started reading it
+var errBodyReplaced = errors.New("request body was replayed")
+
+// replayableBody returns shallow copy of req with GetBody installed when the body can be replayed
+// without caller's help, returned func closes the body once transport is done with the request
+func replayableBody(req *http.Request) (*http.Request, func()) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, func() {}
+	}
+
+	body := unwrapNopCloser(req.Body)
+	// same body types http.NewRequest installs GetBody for
+	var getBody func() (io.ReadCloser, error)
+	switch v := body.(type) {
+	case *bytes.Buffer:
+		buf := v.Bytes()
+		getBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	case *bytes.Reader:
+		snapshot := *v
+		getBody = func() (io.ReadCloser, error) {
+			r := snapshot
+			return io.NopCloser(&r), nil
+		}
+	case *strings.Reader:
+		snapshot := *v
+		getBody = func() (io.ReadCloser, error) {
+			r := snapshot
+			return io.NopCloser(&r), nil
+		}
+	}
+	if getBody != nil {
+		r := *req
+		r.GetBody = getBody
+		return &r, func() {}
+	}
+
+	// seekable bodies are rewound
+	rs, ok := body.(io.ReadSeeker)
+	if !ok {
+		return req, func() {}
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// e.g. pipes can't seek
+		return req, func() {}
+	}
+
+	b := &seekerBody{rs: rs, closer: req.Body, start: start}
+	r := *req
+	r.GetBody = b.reader
+	r.Body, _ = b.reader()
+	// some IIS modules reject chunked requests, size of seekable body is known upfront
+	if r.ContentLength == 0 && r.TransferEncoding == nil {
+		if end, err := rs.Seek(0, io.SeekEnd); err == nil {
+			r.ContentLength = end - start
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return req, func() {}
+		}
+	}
+	return &r, b.close
+}
+
+// nopCloserTypes are types io.NopCloser returns
+var nopCloserTypes = []reflect.Type{
+	reflect.TypeOf(io.NopCloser(nil)),
+	reflect.TypeOf(io.NopCloser(strings.NewReader(""))),
+}
+
+// unwrapNopCloser returns reader wrapped by io.NopCloser, body itself if it's not wrapped
+func unwrapNopCloser(body io.ReadCloser) io.Reader {
+	v := reflect.ValueOf(body)
+	for _, typ := range nopCloserTypes {
+		if v.Type() == typ && v.NumField() == 1 {
+			if r, ok := v.Field(0).Interface().(io.Reader); ok && r != nil {
+				return r
+			}
+		}
+	}
+	return body
+}
+
+// seekerBody rewinds seekable body for every leg, legs share the underlying reader
+// so the body belongs to the leg which started reading it last
+type seekerBody struct {
+	mu     sync.Mutex
+	rs     io.ReadSeeker
+	closer io.Closer
+	start  int64
+	// gen is the number of readers handed out, active is the one reading now
+	gen    int
+	active int
+	closed bool
+}
+
+func (b *seekerBody) reader() (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBodyReplaced
+	}
+	b.gen++
+	return &seekerReader{b: b, gen: b.gen}, nil
+}
+
+func (b *seekerBody) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.closer.Close()
+	}
+}
+
+// seekerReader is a single leg's view of seekerBody, closing it leaves the body open for later legs
+type seekerReader struct {
+	b       *seekerBody
+	gen     int
+	started bool
+}
+
+func (r *seekerReader) Read(p []byte) (int, error) {
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errBodyReplaced
+	}
+	if b.active != r.gen {
+		if r.started {
+			return 0, errBodyReplaced
+		}
+		if b.active != 0 {
+			if _, err := b.rs.Seek(b.start, io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+		b.active = r.gen
+	}
+	r.started = true
+	return b.rs.Read(p)
+}
+
+func (r *seekerReader) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package httpntlm
+
+import (
+	"net/http"
+)
+
+// IdempotencyKeyHeader marks request which server deduplicates, such request is retried whatever its method
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotent reports whether req can be repeated without duplicating its side effects,
+// methods RFC 7231 defines idempotent are and so are requests carrying IdempotencyKeyHeader
+func (t *NtlmTransport) idempotent(req *http.Request) bool {
+	if t.RetryNonIdempotent || req.Header.Get(IdempotencyKeyHeader) != "" {
+		return true
+	}
+
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// authenticated reports whether req got past the handshake, so its failure came from the request itself
+func authenticated(req *http.Request) bool {
+	return handshakeInfoOf(req.Context()).get().Scheme != ""
+}
+
+// staleRetry repeats idempotent req over a new connection of pool after it failed with err over
+// the authenticated connection the server closed, transport it was sent through is returned with the response
+func (t *NtlmTransport) staleRetry(pool *connPool, req *http.Request, err error) (*http.Response, *http.Transport, error) {
+	if t.DisableStaleRetry || req.Context().Err() != nil || !t.idempotent(req) {
+		return nil, nil, err
+	}
+	r, ok, replayErr := replayRequest(req)
+	if replayErr != nil {
+		return nil, nil, replayErr
+	}
+	if !ok {
+		return nil, nil, err
+	}
+
+	key := hostKey(req.URL)
+	t.log(req.Context(), "retrying request over new connection", "host", key, "method", req.Method, "error", err)
+	t.inc(req.Context(), MetricRetries, map[string]string{"host": key})
+	pinned := pool.fresh()
+	resp, err := t.sendRoundTrip(pinned, r.WithContext(withFreshConnection(r.Context())))
+	return resp, pinned, err
+}
+
+// retryRoundTrip sends req through send and repeats it up to MaxRetries times when connection fails
+// after the handshake, only idempotent requests are repeated
+func (t *NtlmTransport) retryRoundTrip(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	resp, err := send(req)
+	for i := 0; i < t.MaxRetries && err != nil; i++ {
+		if !isConnError(err) || req.Context().Err() != nil || !authenticated(req) || !t.idempotent(req) {
+			break
+		}
+		key := hostKey(req.URL)
+		if !t.allowRetry(req.Context(), key) {
+			break
+		}
+
+		r, ok, replayErr := replayRequest(req)
+		if replayErr != nil {
+			return nil, replayErr
+		}
+		if !ok {
+			break
+		}
+
+		t.log(req.Context(), "retrying request", "host", key, "method", req.Method, "error", err)
+		t.inc(req.Context(), MetricRetries, map[string]string{"host": key})
+		resp, err = send(r)
+	}
+	return resp, err
+}
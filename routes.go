@@ -0,0 +1,39 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Route matches requests by host and path, see NtlmTransport.NTLMRoutes
+type Route struct {
+	// HostSuffix matches the host and its subdomains, e.g. corp.example.com matches intranet.corp.example.com,
+	// any host matches if it's empty
+	HostSuffix string `json:"hostSuffix,omitempty" yaml:"hostSuffix,omitempty"`
+	// PathPrefix matches paths starting with it, any path matches if it's empty
+	PathPrefix string `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+}
+
+// Match reports whether req matches the route
+func (r Route) Match(req *http.Request) bool {
+	if suffix := strings.ToLower(strings.TrimPrefix(r.HostSuffix, ".")); suffix != "" {
+		host := hostName(req.URL.Host)
+		if host != suffix && !strings.HasSuffix(host, "."+suffix) {
+			return false
+		}
+	}
+	return strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// routed reports whether req gets NTLM treatment according to NTLMRoutes
+func (t *NtlmTransport) routed(req *http.Request) bool {
+	if len(t.NTLMRoutes) == 0 {
+		return true
+	}
+	for _, r := range t.NTLMRoutes {
+		if r.Match(req) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+// Package rpch opens RPC over HTTP v2 channels through RPC proxy (rpcproxy.dll) over NTLM transport,
+// as used by legacy Outlook Anywhere and DCOM over HTTP tooling. Every IN and OUT channel goes over
+// its own connection with its own handshake. RTS and RPC PDUs sent over the channels are left to the caller.
+package rpch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// methods of IN and OUT channel requests
+const (
+	MethodIn  = "RPC_IN_DATA"
+	MethodOut = "RPC_OUT_DATA"
+)
+
+// DefaultChannelLength is Content-Length of IN channel and OUT channel response Windows clients use,
+// the channel is recycled once that many bytes went through it
+const DefaultChannelLength = 1 << 30
+
+// NewTransport returns NTLM transport suited for RPC over HTTP, IN channel response comes only when
+// the channel ends and RPC proxy doesn't authenticate HTTP/2 connections
+func NewTransport(domain, user, password string) *httpntlm.NtlmTransport {
+	tr := httpntlm.NewBaseTransport()
+	tr.ResponseHeaderTimeout = 0
+
+	return &httpntlm.NtlmTransport{
+		Domain:       domain,
+		User:         user,
+		Password:     password,
+		RoundTripper: tr,
+	}
+}
+
+// Client opens channels to RPC servers behind RPC proxy
+type Client struct {
+	// ProxyURL is the RPC proxy, e.g. https://mail.example.com/rpc/rpcproxy.dll
+	ProxyURL string
+	// Transport authenticates the channels, every channel uses its clone
+	Transport *httpntlm.NtlmTransport
+	// InChannelLength is Content-Length of IN channel requests, DefaultChannelLength is used if zero
+	InChannelLength int64
+}
+
+// New returns client of RPC proxy at proxyURL authenticating through t
+func New(proxyURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{ProxyURL: strings.TrimSuffix(proxyURL, "?"), Transport: t}
+}
+
+// channelURL returns URL of channel to port of server behind the proxy
+func (c *Client) channelURL(server string, port int) string {
+	return c.ProxyURL + "?" + server + ":" + strconv.Itoa(port)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader, length int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Accept", "application/rpc")
+	req.Header.Set("Content-Type", "application/rpc")
+	req.Header.Set("User-Agent", "MSRPC")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	return req, nil
+}
+
+// InChannel is the client to server half of virtual connection, PDUs are written to it
+type InChannel struct {
+	w         *io.PipeWriter
+	transport *httpntlm.NtlmTransport
+	done      chan struct{}
+	mu        sync.Mutex
+	resp      *http.Response
+	err       error
+}
+
+// OpenIn opens IN channel to port of server, the channel body can't be replayed, so the handshake
+// is performed by the transport with body-less legs before the body starts streaming
+func (c *Client) OpenIn(ctx context.Context, server string, port int) (*InChannel, error) {
+	length := c.InChannelLength
+	if length == 0 {
+		length = DefaultChannelLength
+	}
+
+	r, w := io.Pipe()
+	req, err := c.newRequest(ctx, MethodIn, c.channelURL(server, port), r, length)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &InChannel{w: w, transport: c.Transport.Clone(), done: make(chan struct{})}
+	go func() {
+		defer close(ch.done)
+		// server responds only once the channel ends
+		resp, err := ch.transport.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("rpch: IN channel failed: %s", resp.Status)
+		}
+		if err != nil {
+			r.CloseWithError(err)
+		}
+		ch.mu.Lock()
+		ch.resp, ch.err = resp, err
+		ch.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+// Write sends p over the channel
+func (ch *InChannel) Write(p []byte) (int, error) {
+	return ch.w.Write(p)
+}
+
+// Close ends the channel, it waits for server's response and closes the connection
+func (ch *InChannel) Close() error {
+	ch.w.Close()
+	<-ch.done
+	defer ch.transport.Close()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.resp != nil {
+		io.Copy(io.Discard, ch.resp.Body)
+		ch.resp.Body.Close()
+	}
+	return ch.err
+}
+
+// OutChannel is the server to client half of virtual connection, PDUs are read from it
+type OutChannel struct {
+	io.ReadCloser
+	transport *httpntlm.NtlmTransport
+}
+
+// OpenOut opens OUT channel to port of server, body is the request, usually CONN/A1 RTS PDU.
+// Server's PDUs stream in the response body as long as the channel lives.
+func (c *Client) OpenOut(ctx context.Context, server string, port int, body []byte) (*OutChannel, error) {
+	req, err := c.newRequest(ctx, MethodOut, c.channelURL(server, port), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	transport := c.Transport.Clone()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		transport.Close()
+		return nil, fmt.Errorf("rpch: OUT channel failed: %s", resp.Status)
+	}
+	return &OutChannel{ReadCloser: resp.Body, transport: transport}, nil
+}
+
+// Close ends the channel and closes its connection
+func (ch *OutChannel) Close() error {
+	err := ch.ReadCloser.Close()
+	ch.transport.Close()
+	return err
+}
@@ -0,0 +1,69 @@
+package rpch
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Channels(t *testing.T) {
+	var mu sync.Mutex
+	remotes := map[string]string{}
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.Method] = r.RemoteAddr
+		mu.Unlock()
+		if r.URL.RawQuery != "exchange.example.com:6001" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		b, _ := io.ReadAll(r.Body)
+		switch r.Method {
+		case MethodIn:
+			received <- string(b)
+		case MethodOut:
+			if string(b) != "A1" {
+				t.Errorf("unexpected OUT channel request %q", b)
+			}
+			w.Write([]byte("A3C2"))
+		}
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL+"/rpc/rpcproxy.dll", NewTransport("dt", "testuser", "fish"))
+	c.InChannelLength = 4
+	ctx := httpntlm.WithoutNTLM(context.Background())
+
+	in, err := c.OpenIn(ctx, "exchange.example.com", 6001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.OpenOut(ctx, "exchange.example.com", 6001, []byte("A1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Write([]byte("B1B2")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(out); string(b) != "A3C2" {
+		t.Errorf("unexpected OUT channel data %q", b)
+	}
+	if got := <-received; got != "B1B2" {
+		t.Errorf("unexpected IN channel data %q", got)
+	}
+	if err := in.Close(); err != nil {
+		t.Error(err)
+	}
+	out.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if remotes[MethodIn] == remotes[MethodOut] {
+		t.Error("expected channels over distinct connections")
+	}
+}
@@ -0,0 +1,141 @@
+// Package sccm is a thin client of Configuration Manager AdminService, OData REST API of the SMS Provider
+// behind Windows authentication. Many sites additionally require client certificate, see NewTransport.
+package sccm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// NewTransport returns NTLM transport presenting client certificate of tlsConfig if it has one,
+// tlsConfig may be nil when the site doesn't use PKI client authentication
+func NewTransport(domain, user, password string, tlsConfig *tls.Config) *httpntlm.NtlmTransport {
+	tr := httpntlm.NewBaseTransport()
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig.Clone()
+	}
+
+	return &httpntlm.NtlmTransport{
+		Domain:       domain,
+		User:         user,
+		Password:     password,
+		RoundTripper: tr,
+	}
+}
+
+// LoadTLSConfig returns TLS configuration with client certificate from PEM files, caFile is optional
+// and replaces system roots, SMS Providers often use certificates of internal CA
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("sccm: no certificates found in " + caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// Client sends requests to AdminService
+type Client struct {
+	// BaseURL is AdminService root, e.g. https://provider.example.com/AdminService
+	BaseURL string
+	// HTTPClient sends the requests, it's expected to authenticate them
+	HTTPClient *http.Client
+}
+
+// New returns client of AdminService at baseURL authenticating through t
+func New(baseURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Transport: t},
+	}
+}
+
+// Error is AdminService error response
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sccm: status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Get decodes JSON resource at path relative to BaseURL into v, e.g. "wmi/SMS_Site" or "v1.0/Device"
+func (c *Client) Get(ctx context.Context, path string, v interface{}) error {
+	return c.get(ctx, c.BaseURL+"/"+strings.TrimPrefix(path, "/"), v)
+}
+
+// List calls fn with every item of collection at path, following @odata.nextLink through all pages
+func (c *Client) List(ctx context.Context, path string, fn func(item json.RawMessage) error) error {
+	next := c.BaseURL + "/" + strings.TrimPrefix(path, "/")
+	for next != "" {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"@odata.nextLink"`
+		}
+		if err := c.get(ctx, next, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Value {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		next = page.NextLink
+	}
+	return nil
+}
+
+func (c *Client) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		var body struct {
+			Error Error `json:"error"`
+		}
+		if err := json.Unmarshal(b, &body); err != nil || body.Error.Message == "" {
+			body.Error.Message = strings.TrimSpace(string(b))
+		}
+		body.Error.StatusCode = resp.StatusCode
+		return &body.Error
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
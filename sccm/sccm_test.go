@@ -0,0 +1,37 @@
+package sccm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_List(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"value":[{"Name":"a"}],"@odata.nextLink":"%s/AdminService/wmi/SMS_R_System?page=2"}`, ts.URL)
+			return
+		}
+		fmt.Fprint(w, `{"value":[{"Name":"b"}]}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL + "/AdminService"}
+	var names string
+	err := c.List(context.Background(), "wmi/SMS_R_System", func(item json.RawMessage) error {
+		var v struct{ Name string }
+		json.Unmarshal(item, &v)
+		names += v.Name
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names != "ab" {
+		t.Errorf("expected items of both pages, got %q", names)
+	}
+}
@@ -0,0 +1,138 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SchemeError is returned when server doesn't offer NTLM authentication,
+// callers can pick their own fallback based on the schemes server did offer
+type SchemeError struct {
+	// Header is the challenge header schemes were read from
+	Header string
+	// Schemes are offered authentication schemes in the order server listed them
+	Schemes []string
+}
+
+func (e *SchemeError) Error() string {
+	if len(e.Schemes) == 0 {
+		return "wrong " + e.Header + " header"
+	}
+	return "wrong " + e.Header + " header, offered schemes: " + strings.Join(e.Schemes, ", ")
+}
+
+// OfferedSchemes returns authentication schemes offered in 401 or 407 response, such as Negotiate, NTLM, Basic or Bearer
+func (t *NtlmTransport) OfferedSchemes(resp *http.Response) []string {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return parseSchemes(resp.Header.Values(t.challengeHeader()))
+	case http.StatusProxyAuthRequired:
+		return parseSchemes(resp.Header.Values("Proxy-Authenticate"))
+	}
+	return nil
+}
+
+// parseSchemes returns distinct scheme names of challenges in headers, a single header may hold
+// several comma separated challenges, each one followed by either token68 or auth-params
+func parseSchemes(headers []string) []string {
+	var schemes []string
+	seen := map[string]bool{}
+	for _, h := range headers {
+		for _, item := range splitChallenges(h) {
+			item = strings.TrimSpace(item)
+			name := item
+			if i := strings.IndexAny(item, " \t"); i >= 0 {
+				name = item[:i]
+			}
+			// auth-param of preceding challenge
+			if name == "" || strings.Contains(name, "=") {
+				continue
+			}
+			if key := strings.ToLower(name); !seen[key] {
+				seen[key] = true
+				schemes = append(schemes, name)
+			}
+		}
+	}
+
+	return schemes
+}
+
+// splitChallenges splits header on commas outside of quoted strings
+func splitChallenges(h string) []string {
+	var items []string
+	quoted, escaped, start := false, false, 0
+	for i, c := range h {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, h[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(items, h[start:])
+}
+
+const (
+	// SchemeNTLM sends NTLM tokens with NTLM scheme
+	SchemeNTLM = "NTLM"
+	// SchemeNegotiate sends NTLM tokens with Negotiate scheme, servers offering only Negotiate accept them
+	// as long as they don't insist on Kerberos
+	SchemeNegotiate = "Negotiate"
+	// SchemeBasic sends user name and password in clear text, see NtlmTransport.AllowBasic
+	SchemeBasic = "Basic"
+)
+
+// canonicalScheme returns name of scheme as transport spells it, empty if transport doesn't support it
+func canonicalScheme(scheme string) string {
+	for _, s := range []string{SchemeNTLM, SchemeNegotiate, SchemeBasic} {
+		if strings.EqualFold(scheme, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+// hostScheme returns scheme requests to host of key are authenticated with, empty if host wasn't probed yet,
+// configured is set when the scheme comes from HostSchemes
+func (t *NtlmTransport) hostScheme(key string) (scheme string, configured bool) {
+	for host, scheme := range t.HostSchemes {
+		if hostMatcher(host)(key) {
+			return canonicalScheme(scheme), true
+		}
+	}
+	return t.authCache().get(key).scheme, false
+}
+
+// chooseScheme picks one of offered schemes, NTLM is preferred over Negotiate and Basic is chosen
+// only if it's allowed and there's a password to send
+func (t *NtlmTransport) chooseScheme(offered []string) string {
+	chosen := ""
+	for _, s := range offered {
+		switch canonicalScheme(s) {
+		case SchemeNTLM:
+			return SchemeNTLM
+		case SchemeNegotiate:
+			chosen = SchemeNegotiate
+		case SchemeBasic:
+			if chosen == "" && t.AllowBasic && t.Password != "" {
+				chosen = SchemeBasic
+			}
+		}
+	}
+	return chosen
+}
+
+// rememberScheme records scheme chosen for the host, empty scheme makes the next handshake probe it again
+func (t *NtlmTransport) rememberScheme(key, scheme string) {
+	cache := t.authCache()
+	info := cache.get(key)
+	info.scheme = scheme
+	cache.set(key, info)
+}
@@ -0,0 +1,64 @@
+package httpntlm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// MetricClockSkew counts rejected handshakes attributed to clock skew, labeled by host
+const MetricClockSkew = "ntlm_clock_skew_total"
+
+// ClockSkewError is returned when server rejects the authenticate message and its clock,
+// as reported by the challenge timestamp, differs from the local one more than NtlmTransport.MaxClockSkew
+type ClockSkewError struct {
+	Host string
+	// Skew is server time minus local time adjusted by NtlmTransport.ClockSkew
+	Skew time.Duration
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("credentials rejected by %s, its clock is %s off, synchronize clocks or set ClockSkew", e.Host, e.Skew)
+}
+
+// now returns local time adjusted by ClockSkew
+func (t *NtlmTransport) now() time.Time {
+	return time.Now().Add(t.ClockSkew)
+}
+
+// checkClockSkew returns ClockSkewError if rejected handshake of req answered challenge whose timestamp
+// is too far from the local clock
+func (t *NtlmTransport) checkClockSkew(req *http.Request, challenge *ntlm.ChallengeMessage) error {
+	if t.MaxClockSkew <= 0 {
+		return nil
+	}
+	server, ok := challengeTime(challenge)
+	if !ok {
+		return nil
+	}
+
+	skew := server.Sub(t.now()).Round(time.Second)
+	if skew <= t.MaxClockSkew && skew >= -t.MaxClockSkew {
+		return nil
+	}
+	host := hostKey(req.URL)
+	t.log(req.Context(), "clock skew", "host", host, "skew", skew.String())
+	t.inc(req.Context(), MetricClockSkew, map[string]string{"host": host})
+	return &ClockSkewError{Host: host, Skew: skew}
+}
+
+// challengeTime returns MsvAvTimestamp of challenge
+func challengeTime(challenge *ntlm.ChallengeMessage) (time.Time, bool) {
+	if challenge.TargetInfo == nil {
+		return time.Time{}, false
+	}
+	p := challenge.TargetInfo.Find(ntlm.MsvAvTimestamp)
+	if p == nil || len(p.Value) != 8 {
+		return time.Time{}, false
+	}
+	ft := int64(binary.LittleEndian.Uint64(p.Value)) - 116444736000000000
+	return time.Unix(ft/1e7, ft%1e7*100), true
+}
@@ -0,0 +1,68 @@
+package httpntlm
+
+import (
+	"net/url"
+	"time"
+)
+
+// HostKnowledge is what transport learned about authentication on a host, it holds no secrets
+type HostKnowledge struct {
+	// PersistentAuth is set when authentication persists on the connection
+	PersistentAuth bool `json:"persistentAuth,omitempty" yaml:"persistentAuth,omitempty"`
+	// Connectionless is set when the host issues challenges in connectionless mode
+	Connectionless bool `json:"connectionless,omitempty" yaml:"connectionless,omitempty"`
+	// NTLMOnly is set when NTLM is the only authentication scheme the host offers
+	NTLMOnly bool `json:"ntlmOnly,omitempty" yaml:"ntlmOnly,omitempty"`
+	// Scheme is the authentication scheme chosen for the host, such as NTLM, Negotiate or Basic
+	Scheme string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	// Learned is when the knowledge was last updated, CacheTTL applies to imported knowledge too
+	Learned time.Time `json:"learned" yaml:"learned"`
+}
+
+// CacheSnapshot is serializable per host knowledge keyed by scheme://host:port,
+// it lets short-lived processes skip discovery on every start
+type CacheSnapshot map[string]HostKnowledge
+
+// ExportCache returns snapshot of per host knowledge, expired knowledge is left out
+func (t *NtlmTransport) ExportCache() CacheSnapshot {
+	c := t.authCache()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := CacheSnapshot{}
+	for key, info := range c.hosts {
+		if c.ttl > 0 && time.Since(info.learned) >= c.ttl {
+			continue
+		}
+		snapshot[key] = HostKnowledge{
+			PersistentAuth: info.persistentAuth,
+			Connectionless: info.connectionless,
+			NTLMOnly:       info.ntlmOnly,
+			Scheme:         info.scheme,
+			Learned:        info.learned,
+		}
+	}
+	return snapshot
+}
+
+// ImportCache merges snapshot obtained by ExportCache into per host knowledge,
+// entries with keys that aren't URLs are ignored
+func (t *NtlmTransport) ImportCache(snapshot CacheSnapshot) {
+	c := t.authCache()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, k := range snapshot {
+		u, err := url.Parse(key)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		c.hosts[hostKey(u)] = hostInfo{
+			persistentAuth: k.PersistentAuth,
+			connectionless: k.Connectionless,
+			ntlmOnly:       k.NTLMOnly,
+			scheme:         canonicalScheme(k.Scheme),
+			learned:        k.Learned,
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package sse consumes Server-Sent Events streams over NTLM transport. Streams are read as events arrive,
+// they are exempt from response header timeout of the transport and dropped streams are reopened,
+// with a new handshake if the connection is gone, resuming after the last event received.
+package sse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+// DefaultReconnectDelay is how long Subscribe waits before reopening dropped stream
+// until server sets retry field
+const DefaultReconnectDelay = 3 * time.Second
+
+// ErrStopped is returned by Subscribe when server ends the stream with 204 status
+var ErrStopped = errors.New("sse: server stopped the stream")
+
+// Event is a single event of the stream
+type Event struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// Client subscribes to event streams
+type Client struct {
+	// HTTPClient sends the requests, it's expected to authenticate them and not to have Timeout set
+	HTTPClient *http.Client
+	// ReconnectDelay is used until server sets retry field, DefaultReconnectDelay is used if zero
+	ReconnectDelay time.Duration
+}
+
+// New returns client authenticating through t
+func New(t *httpntlm.NtlmTransport) *Client {
+	return &Client{HTTPClient: &http.Client{Transport: t}}
+}
+
+// Subscribe calls fn with every event of stream at url until ctx is done, fn fails or server refuses the stream.
+// Dropped stream is reopened with Last-Event-ID of the last event received.
+func (c *Client) Subscribe(ctx context.Context, url string, fn func(Event) error) error {
+	s := &stream{delay: c.ReconnectDelay}
+	if s.delay == 0 {
+		s.delay = DefaultReconnectDelay
+	}
+
+	for {
+		err := c.open(ctx, url, s, fn)
+		var stop *stopError
+		switch {
+		case errors.As(err, &stop):
+			return stop.err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, ErrStopped) || errors.As(err, new(*StatusError)):
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.delay):
+		}
+	}
+}
+
+// StatusError is returned by Subscribe when server responds with status other than 200
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sse: unexpected status %d", e.StatusCode)
+}
+
+// stopError ends Subscribe with err, e.g. error returned by the subscriber
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string {
+	return e.err.Error()
+}
+
+// stream is state kept across reconnections
+type stream struct {
+	lastID string
+	delay  time.Duration
+}
+
+// open reads stream once, it returns when the stream drops
+func (c *Client) open(ctx context.Context, url string, s *stream, fn func(Event) error) error {
+	req, err := http.NewRequestWithContext(httpntlm.WithLongRunning(ctx), http.MethodGet, url, nil)
+	if err != nil {
+		return &stopError{err}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if s.lastID != "" {
+		req.Header.Set("Last-Event-ID", s.lastID)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return ErrStopped
+	case resp.StatusCode != http.StatusOK:
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return read(resp.Body, s, fn)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// read dispatches events of body as they arrive
+func read(body io.Reader, s *stream, fn func(Event) error) error {
+	r := bufio.NewReader(body)
+	ev := Event{ID: s.lastID}
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// incomplete event is discarded
+			return err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			if data != nil {
+				ev.Data = strings.Join(data, "\n")
+				if ev.Type == "" {
+					ev.Type = "message"
+				}
+				if err := fn(ev); err != nil {
+					return &stopError{err}
+				}
+			}
+			ev, data = Event{ID: s.lastID}, nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			ev.Type = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				ev.ID, s.lastID = value, value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				s.delay = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Subscribe(t *testing.T) {
+	var mu sync.Mutex
+	var lastIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		n := len(lastIDs)
+		mu.Unlock()
+		if n > 2 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, ": connected\nretry: 10\n\nid: %d\nevent: update\ndata: first\ndata: line\n\n", n)
+		w.(http.Flusher).Flush()
+		// event must be delivered before the stream ends
+		time.Sleep(20 * time.Millisecond)
+		// stream drops in the middle of an event
+		fmt.Fprint(w, "data: lost")
+	}))
+	defer ts.Close()
+
+	c := New(&httpntlm.NtlmTransport{Domain: "dt", User: "testuser", Password: "fish"})
+	var events []Event
+	start := time.Now()
+	err := c.Subscribe(httpntlm.WithoutNTLM(context.Background()), ts.URL, func(ev Event) error {
+		if time.Since(start) > 15*time.Millisecond && len(events) == 0 {
+			t.Error("event was buffered")
+		}
+		events = append(events, ev)
+		return nil
+	})
+	if !errors.Is(err, ErrStopped) {
+		t.Errorf("expected stream to be stopped, got %v", err)
+	}
+	if len(events) != 2 || events[0] != (Event{ID: "1", Type: "update", Data: "first\nline"}) || events[1].ID != "2" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if strings.Join(lastIDs, ",") != ",1,2" {
+		t.Errorf("expected reconnections to resume after the last event, got %v", lastIDs)
+	}
+}
@@ -0,0 +1,62 @@
+package httpntlm
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestStats is latency breakdown of a caller's request, see NtlmTransport.Stats
+type RequestStats struct {
+	// Legs is time spent in requests of every stage sent, e.g. negotiate leg is how long the challenge took
+	// to arrive, stages sent more than once such as after rechallenges are summed
+	Legs map[Stage]time.Duration
+	// Requests is the number of requests sent
+	Requests int
+	// Total is the time until the final response headers arrived
+	Total time.Duration
+	// Overhead is Total without the final request, i.e. what authentication cost including retries and delays
+	Overhead time.Duration
+	// Err is the error request failed with, nil if response was received
+	Err error
+}
+
+// legStats collects timings of requests sent on behalf of a single caller's request
+type legStats struct {
+	mu       sync.Mutex
+	start    time.Time
+	legs     map[Stage]time.Duration
+	requests int
+	last     time.Duration
+}
+
+// newLegStats returns collector of request timings, nil if stats aren't reported
+func (t *NtlmTransport) newLegStats() *legStats {
+	if t.Stats == nil {
+		return nil
+	}
+	return &legStats{start: time.Now(), legs: map[Stage]time.Duration{}}
+}
+
+func (s *legStats) leg(stage Stage, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.legs[stage] += d
+	s.requests++
+	s.last = d
+}
+
+// reportStats passes stats of req which ended with err to Stats callback
+func (t *NtlmTransport) reportStats(req *http.Request, s *legStats, err error) {
+	if s == nil {
+		return
+	}
+	total := time.Since(s.start)
+	s.mu.Lock()
+	stats := RequestStats{Legs: s.legs, Requests: s.requests, Total: total, Overhead: total - s.last, Err: err}
+	s.mu.Unlock()
+	t.Stats(req, stats)
+}
@@ -0,0 +1,63 @@
+package httpntlm
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrNotStored is returned by Store.Get when there's no value under the key or it expired
+var ErrNotStored = errors.New("ntlm: not stored")
+
+// Store keeps per host knowledge outside of the transport, e.g. in a shared database so that
+// processes don't rediscover every host, see NtlmTransport.CacheStore. Values hold no secrets.
+// Store must be safe for concurrent use.
+type Store interface {
+	// Get returns value stored under key, ErrNotStored if there's none
+	Get(key string) ([]byte, error)
+	// Set stores value under key for ttl, forever if zero
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes value stored under key, missing key is not an error
+	Delete(key string) error
+}
+
+// loadHostInfo returns knowledge of key kept in store, ok is false when store has none or fails
+func loadHostInfo(store Store, key string) (info hostInfo, ok bool) {
+	b, err := store.Get(key)
+	if err != nil {
+		return hostInfo{}, false
+	}
+	var k HostKnowledge
+	if err := json.Unmarshal(b, &k); err != nil {
+		return hostInfo{}, false
+	}
+	return hostInfo{
+		persistentAuth: k.PersistentAuth,
+		connectionless: k.Connectionless,
+		ntlmOnly:       k.NTLMOnly,
+		scheme:         canonicalScheme(k.Scheme),
+		learned:        k.Learned,
+	}, true
+}
+
+// saveHostInfo puts knowledge of key into store for ttl
+func saveHostInfo(store Store, key string, info hostInfo, ttl time.Duration) {
+	b, err := json.Marshal(HostKnowledge{
+		PersistentAuth: info.persistentAuth,
+		Connectionless: info.connectionless,
+		NTLMOnly:       info.ntlmOnly,
+		Scheme:         info.scheme,
+		Learned:        info.learned,
+	})
+	if err != nil {
+		return
+	}
+	// failed writes only make other processes discover the host on their own
+	_ = store.Set(key, b, ttl)
+}
+
+// shared reports whether a and b differ in knowledge kept in store
+func shared(a, b hostInfo) bool {
+	return a.persistentAuth != b.persistentAuth || a.connectionless != b.connectionless || a.ntlmOnly != b.ntlmOnly ||
+		a.scheme != b.scheme
+}
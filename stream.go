@@ -0,0 +1,70 @@
+package httpntlm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// NewStreamingRequest returns request with body of unknown length written by produce, the body is sent chunked.
+// produce is called again every time the body is sent during the handshake, so it must be able to regenerate
+// the stream from the beginning. It runs in its own goroutine and should stop once writing fails.
+func NewStreamingRequest(ctx context.Context, method, url string, produce func(w io.Writer) error) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return &streamBody{produce: produce}, nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return req, nil
+}
+
+// streamBody runs the producer once the body is read for the first time,
+// bodies which are never sent don't start producers
+type streamBody struct {
+	produce func(w io.Writer) error
+	mu      sync.Mutex
+	r       *io.PipeReader
+	closed  bool
+}
+
+// reader returns pipe the producer writes to, starting it on first call, nil once the body is closed
+func (b *streamBody) reader() *io.PipeReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	if b.r == nil {
+		r, w := io.Pipe()
+		b.r = r
+		go func() {
+			w.CloseWithError(b.produce(w))
+		}()
+	}
+	return b.r
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	r := b.reader()
+	if r == nil {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	return r.Read(p)
+}
+
+func (b *streamBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.r == nil {
+		return nil
+	}
+	return b.r.Close()
+}
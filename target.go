@@ -0,0 +1,99 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// TargetPolicy tells what transport does when server name in NTLM challenge doesn't match the request host,
+// which may mean the challenge is relayed from another server
+type TargetPolicy int
+
+const (
+	// TargetIgnore doesn't compare challenge target with the request host
+	TargetIgnore TargetPolicy = iota
+	// TargetWarn logs and counts mismatches, see MetricTargetMismatch, but authenticates anyway
+	TargetWarn
+	// TargetRefuse returns TargetMismatchError instead of authenticating
+	TargetRefuse
+)
+
+// TargetMismatchError is returned when server name in the challenge isn't the request host nor its alias
+type TargetMismatchError struct {
+	// Host is the request host
+	Host string
+	// ComputerName and DomainName are DNS names from the challenge, NetBIOS ones if DNS names are missing
+	ComputerName string
+	DomainName   string
+}
+
+func (e *TargetMismatchError) Error() string {
+	return "NTLM challenge for " + e.Host + " was issued by " + e.ComputerName + " of domain " + e.DomainName
+}
+
+// checkTarget applies TargetPolicy to challenge of request to req host, bound is set when authenticate message
+// is bound to the TLS connection with ExtendedProtection, so it can't be relayed anyway
+func (t *NtlmTransport) checkTarget(req *http.Request, challenge *ntlm.ChallengeMessage, bound bool) error {
+	if t.TargetPolicy == TargetIgnore || challenge.TargetInfo == nil || bound {
+		return nil
+	}
+
+	host := requestHost(req)
+	if ipLiteral(host) {
+		// addresses can't be compared with names
+		return nil
+	}
+
+	info := challenge.TargetInfo
+	dnsComputer := strings.ToLower(info.StringValue(ntlm.MsvAvDnsComputerName))
+	dnsDomain := strings.ToLower(info.StringValue(ntlm.MsvAvDnsDomainName))
+	nbComputer := strings.ToLower(info.StringValue(ntlm.MsvAvNbComputerName))
+	nbDomain := strings.ToLower(info.StringValue(ntlm.MsvAvNbDomainName))
+	var aliases []string
+	for name, a := range t.TargetAliases {
+		if hostName(name) == host {
+			aliases = append(aliases, a...)
+		}
+	}
+	if targetMatches(host, dnsComputer, nbComputer, aliases) {
+		return nil
+	}
+
+	err := &TargetMismatchError{Host: host, ComputerName: dnsComputer, DomainName: dnsDomain}
+	if err.ComputerName == "" {
+		err.ComputerName = nbComputer
+	}
+	if err.DomainName == "" {
+		err.DomainName = nbDomain
+	}
+	t.log(req.Context(), "challenge target mismatch", "host", host, "computer", err.ComputerName, "domain", err.DomainName)
+	t.inc(req.Context(), MetricTargetMismatch, map[string]string{"host": hostKey(req.URL)})
+	if t.TargetPolicy == TargetRefuse {
+		return err
+	}
+	return nil
+}
+
+// targetMatches reports whether host is the challenging computer, single label host is compared with
+// NetBIOS name when server didn't send DNS one. Names behind load balancers and aliases have to be listed
+// among aliases, e.g. computers of the farm.
+func targetMatches(host, dnsComputer, nbComputer string, aliases []string) bool {
+	computer := dnsComputer
+	if computer == "" && !strings.Contains(host, ".") {
+		computer = nbComputer
+	}
+	if computer == "" {
+		return false
+	}
+	if host == computer {
+		return true
+	}
+	for _, alias := range aliases {
+		if strings.EqualFold(strings.TrimSuffix(alias, "."), computer) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+#!/bin/sh
+# joins the domain, creates the test user and serves authenticated requests
+set -e
+
+cat > /etc/samba/smb.conf <<CONF
+[global]
+    workgroup = ${WORKGROUP}
+    realm = ${REALM}
+    security = ads
+    winbind use default domain = yes
+CONF
+
+until net ads join -U "Administrator%${ADMIN_PASSWORD}"; do
+    echo "waiting for domain controller"
+    sleep 5
+done
+net ads user add "${TEST_USER}" "${TEST_PASSWORD}" -U "Administrator%${ADMIN_PASSWORD}" || true
+
+winbindd -D
+usermod -a -G winbindd_priv www-data
+echo "authenticated" > /var/www/html/index.html
+exec apache2ctl -D FOREGROUND
@@ -0,0 +1,58 @@
+package httpntlm
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxRetryAfter is the longest Retry-After delay honored by default
+const DefaultMaxRetryAfter = 30 * time.Second
+
+// throttleDelay returns how long to wait before retrying throttled request,
+// ok is false if the response is not throttled or the delay is over the limit
+func (t *NtlmTransport) throttleDelay(resp *http.Response) (d time.Duration, ok bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	d, ok = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return 0, false
+	}
+
+	max := t.MaxRetryAfter
+	if max == 0 {
+		max = DefaultMaxRetryAfter
+	}
+
+	return d, d <= max
+}
+
+// parseRetryAfter parses Retry-After header value which is either delay in seconds or HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	date, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	d := date.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+
+	return d, true
+}
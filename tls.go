@@ -0,0 +1,69 @@
+package httpntlm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// hasTLSPolicy reports whether TLS of internally created transport is restricted
+func (t *NtlmTransport) hasTLSPolicy() bool {
+	return t.MinTLSVersion != 0 || len(t.CipherSuites) > 0
+}
+
+// applyTLSPolicy restricts TLS configuration of tr to minVersion and cipherSuites, zero values keep it as is
+func applyTLSPolicy(tr *http.Transport, minVersion uint16, cipherSuites []uint16) {
+	if minVersion == 0 && len(cipherSuites) == 0 {
+		return
+	}
+
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	} else {
+		tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+	}
+	if minVersion > tr.TLSClientConfig.MinVersion {
+		tr.TLSClientConfig.MinVersion = minVersion
+	}
+	if len(cipherSuites) > 0 {
+		tr.TLSClientConfig.CipherSuites = append([]uint16(nil), cipherSuites...)
+	}
+}
+
+// tlsVersions are names of TLS versions accepted in Config
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return v, nil
+}
+
+// parseCipherSuites returns IDs of cipher suites named as in crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+// insecure suites are refused
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,142 @@
+package httpntlm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// tunnelDialer dials proxies DialTunnel connects through unless Dialer is set
+var tunnelDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// DialTunnel opens tunnel to addr through HTTP proxy at proxyURL with CONNECT request, NTLM handshake
+// with ProxyCredentials is performed on the tunnel connection when proxy demands it. Proxy connection
+// is dialed with Dialer if it's set.
+func (t *NtlmTransport) DialTunnel(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	dial := tunnelDialer.DialContext
+	if t.Dialer != nil {
+		dial = dialContext(t.Dialer)
+	}
+	conn, err := dial(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	// deadline of ctx bounds the handshake only, tunnel outlives it
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := t.connect(ctx, conn, br, proxyURL, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy answered CONNECT with %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// connect sends CONNECT request for addr over conn authenticating to the proxy if it demands NTLM
+func (t *NtlmTransport) connect(ctx context.Context, conn net.Conn, br *bufio.Reader, proxyURL *url.URL, addr string) (*http.Response, error) {
+	resp, err := connectLeg(conn, br, addr, "")
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || t.ProxyCredentials == nil || !offersNTLM(t.OfferedSchemes(resp)) {
+		return resp, err
+	}
+
+	target := t.proxyTarget()
+	session, err := t.backend().NewSession(target.creds)
+	if err != nil {
+		return nil, err
+	}
+	negotiate, err := session.Negotiate()
+	if err != nil {
+		return nil, err
+	}
+	resp, err = connectLeg(conn, br, addr, SchemeNTLM+" "+EncBase64(negotiate))
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+
+	token, found := ntlmChallenge(resp.Header.Values(target.challengeHeader))
+	if token == "" {
+		if found {
+			return nil, errEmptyNtlm
+		}
+		return nil, &SchemeError{Header: target.challengeHeader, Schemes: t.OfferedSchemes(resp)}
+	}
+	challengeBytes, err := DecBase64(token)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := ntlm.ParseChallengeMessage(challengeBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkDowngrade((&http.Request{URL: proxyURL}).WithContext(ctx), target, challenge); err != nil {
+		return nil, err
+	}
+	authenticate, err := session.Authenticate(challengeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return connectLeg(conn, br, addr, SchemeNTLM+" "+EncBase64(authenticate))
+}
+
+// connectLeg sends CONNECT request with Proxy-Authorization header unless it's empty and reads the response,
+// body of the response is discarded unless it's the tunnel
+func connectLeg(conn net.Conn, br *bufio.Reader, addr, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return resp, nil
+}
+
+// offersNTLM reports whether NTLM is among schemes
+func offersNTLM(schemes []string) bool {
+	for _, s := range schemes {
+		if strings.EqualFold(s, SchemeNTLM) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn reads data proxy sent right after the CONNECT response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
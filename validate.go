@@ -0,0 +1,114 @@
+package httpntlm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Validate checks transport configuration and returns an error describing the first problem found
+func (t *NtlmTransport) Validate() error {
+	if t.User == "" {
+		return errors.New("User must be set")
+	}
+
+	if strings.ContainsRune(t.User, '\\') {
+		if t.Domain == "" {
+			return fmt.Errorf(`User %q is in DOMAIN\user form, put domain part into Domain field`, t.User)
+		}
+		return fmt.Errorf("User %q contains domain while Domain is set to %q, use only one of them", t.User, t.Domain)
+	}
+
+	if t.NTHash != "" {
+		if t.Password != "" {
+			return errors.New("Password and NTHash are mutually exclusive, use only one of them")
+		}
+		if _, err := decodeNTHash(t.NTHash); err != nil {
+			return err
+		}
+	}
+
+	if err := validHeaderName("AuthorizationHeader", t.AuthorizationHeader); err != nil {
+		return err
+	}
+	if err := validHeaderName("ChallengeHeader", t.ChallengeHeader); err != nil {
+		return err
+	}
+
+	if t.ProxyCredentials != nil && t.ProxyCredentials.User == "" {
+		return errors.New("ProxyCredentials.User must be set")
+	}
+
+	if s := canonicalScheme(t.ProxyScheme); t.ProxyScheme != "" && s != SchemeNTLM && s != SchemeBasic {
+		return fmt.Errorf("ProxyScheme is %q, use NTLM or Basic", t.ProxyScheme)
+	}
+	if _, ok := t.RoundTripper.(*http.Transport); t.proxyBasic() && t.RoundTripper != nil && !ok {
+		return errors.New("Basic ProxyScheme requires RoundTripper to be *http.Transport")
+	}
+
+	if t.Dialer != nil && t.RoundTripper != nil {
+		return errors.New("Dialer is used only when RoundTripper is not set, configure dialing on RoundTripper instead")
+	}
+
+	if t.hasTLSPolicy() && t.RoundTripper != nil {
+		return errors.New("MinTLSVersion and CipherSuites are used only when RoundTripper is not set, configure TLS on RoundTripper instead")
+	}
+
+	if len(t.Proxies) > 0 {
+		if _, ok := t.RoundTripper.(*http.Transport); t.RoundTripper != nil && !ok {
+			return errors.New("Proxies require RoundTripper to be *http.Transport")
+		}
+		if t.Dialer != nil {
+			return errors.New("Proxies can't be combined with Dialer, chain proxies in the Dialer instead")
+		}
+		for _, u := range t.Proxies {
+			if u == nil || u.Host == "" {
+				return errors.New("Proxies must be absolute URLs")
+			}
+		}
+	}
+
+	for host, scheme := range t.HostSchemes {
+		if canonicalScheme(scheme) == "" {
+			return fmt.Errorf("HostSchemes of %s is %q, use NTLM, Negotiate or Basic", host, scheme)
+		}
+	}
+	for host, spn := range t.HostSPNs {
+		if i := strings.IndexByte(spn, '/'); i <= 0 || i == len(spn)-1 {
+			return fmt.Errorf("HostSPNs of %s is %q, use service/host form, e.g. HTTP/web.example.com", host, spn)
+		}
+	}
+
+	switch {
+	case t.MaxRechallenges < 0:
+		return errors.New("MaxRechallenges must not be negative")
+	case t.MaxThrottleRetries < 0:
+		return errors.New("MaxThrottleRetries must not be negative")
+	case t.MaxRetryAfter < 0:
+		return errors.New("MaxRetryAfter must not be negative")
+	case t.MaxViews < 0:
+		return errors.New("MaxViews must not be negative")
+	case t.MaxRetries < 0:
+		return errors.New("MaxRetries must not be negative")
+	case t.EmptyChallengeRetryDelay < 0:
+		return errors.New("EmptyChallengeRetryDelay must not be negative")
+	case t.CacheTTL < 0:
+		return errors.New("CacheTTL must not be negative")
+	case t.MaxClockSkew < 0:
+		return errors.New("MaxClockSkew must not be negative")
+	case t.Heartbeat != nil && t.Heartbeat.Interval <= 0:
+		return errors.New("Heartbeat.Interval must be positive")
+	case t.HandshakeLimiter != nil && (t.HandshakeLimiter.Rate < 0 || t.HandshakeLimiter.Burst < 0):
+		return errors.New("HandshakeLimiter Rate and Burst must not be negative")
+	}
+
+	return nil
+}
+
+func validHeaderName(field, name string) error {
+	if strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("%s %q is not a valid header name", field, name)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package vcr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf16"
+)
+
+// Placeholders replacing credentials in golden fixtures, see Recorder.Golden
+const (
+	StubUser        = "<user>"
+	StubDomain      = "<domain>"
+	StubWorkstation = "<workstation>"
+	StubPassword    = "<password>"
+	StubCookie      = "<cookie>"
+)
+
+// flagUnicode is NTLMSSP_NEGOTIATE_UNICODE, names are UTF-16 when it's set and OEM otherwise
+const flagUnicode = 0x00000001
+
+// sanitizeGolden returns copy of h with NTLM messages scrubbed of secrets and other tokens and cookies stubbed
+func sanitizeGolden(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range authHeaders {
+		for i, v := range h[name] {
+			h[name][i] = scrub(v)
+		}
+	}
+	for i, v := range h["Cookie"] {
+		h["Cookie"][i] = stubCookies(v, "; ", false)
+	}
+	for i, v := range h["Set-Cookie"] {
+		h["Set-Cookie"][i] = stubCookies(v, ";", true)
+	}
+	return h
+}
+
+// scrub replaces secrets of NTLM message in scheme and token header value keeping its structure,
+// other tokens are stubbed as by stub
+func scrub(v string) string {
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return v
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[i+1:]))
+	if err != nil || len(b) < 12 || !bytes.HasPrefix(b, []byte("NTLMSSP\x00")) {
+		return stub(v)
+	}
+
+	var scrubbed []byte
+	switch binary.LittleEndian.Uint32(b[8:]) {
+	case 1:
+		scrubbed = scrubNegotiate(b)
+	case 2:
+		scrubbed = scrubChallenge(b)
+	case 3:
+		scrubbed = scrubAuthenticate(b)
+	}
+	if scrubbed == nil {
+		return stub(v)
+	}
+	return v[:i] + " " + base64.StdEncoding.EncodeToString(scrubbed)
+}
+
+// scrubNegotiate replaces domain and workstation names client supplied
+func scrubNegotiate(b []byte) []byte {
+	if len(b) < 32 {
+		return nil
+	}
+	return rewrite(b, []int{16, 24}, func(i int, p []byte) []byte {
+		return []byte([]string{StubDomain, StubWorkstation}[i])
+	})
+}
+
+// scrubChallenge zeroes server challenge, names and target info are kept as they describe the server
+func scrubChallenge(b []byte) []byte {
+	if len(b) < 32 {
+		return nil
+	}
+	b = append([]byte(nil), b...)
+	copy(b[24:32], make([]byte, 8))
+	return b
+}
+
+// scrubAuthenticate replaces names, zeroes responses, session key and MIC, NTLMv2 response keeps its blob
+// except client challenge, so timestamp and target info client echoed, including SPN and channel bindings, stay
+func scrubAuthenticate(b []byte) []byte {
+	if len(b) < 64 {
+		return nil
+	}
+	unicode := binary.LittleEndian.Uint32(b[60:])&flagUnicode != 0
+	names := []string{StubDomain, StubUser, StubWorkstation}
+	b = rewrite(b, []int{12, 20, 28, 36, 44, 52}, func(i int, p []byte) []byte {
+		switch i {
+		case 2, 3, 4:
+			if unicode {
+				return utf16le(names[i-2])
+			}
+			return []byte(names[i-2])
+		case 1:
+			if len(p) > 24 {
+				// proof and client challenge of NTLMv2 response
+				p = append([]byte(nil), p...)
+				copy(p[:16], make([]byte, 16))
+				copy(p[32:40], make([]byte, 8))
+				return p
+			}
+		}
+		return make([]byte, len(p))
+	})
+	// MIC follows version when payload starts after it
+	if start := payloadStart(b, []int{12, 20, 28, 36, 44, 52}); start >= 88 {
+		copy(b[72:88], make([]byte, 16))
+	}
+	return b
+}
+
+// rewrite returns copy of NTLM message b whose non-empty security buffers at offsets are replaced by replace,
+// payload is laid out again right after the fixed part
+func rewrite(b []byte, offsets []int, replace func(i int, payload []byte) []byte) []byte {
+	start := payloadStart(b, offsets)
+	msg := append([]byte(nil), b[:start]...)
+	for i, offset := range offsets {
+		p := bufferPayload(b, offset)
+		if p == nil {
+			continue
+		}
+		p = replace(i, p)
+		binary.LittleEndian.PutUint16(msg[offset:], uint16(len(p)))
+		binary.LittleEndian.PutUint16(msg[offset+2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(msg[offset+4:], uint32(len(msg)))
+		msg = append(msg, p...)
+	}
+	return msg
+}
+
+// payloadStart returns where payload of security buffers at offsets starts, which is the end of fixed part
+func payloadStart(b []byte, offsets []int) int {
+	start := len(b)
+	for _, offset := range offsets {
+		if bufferPayload(b, offset) != nil {
+			if s := int(binary.LittleEndian.Uint32(b[offset+4:])); s < start {
+				start = s
+			}
+		}
+	}
+	return start
+}
+
+// bufferPayload returns payload of security buffer at offset, nil if it's empty or malformed
+func bufferPayload(b []byte, offset int) []byte {
+	length := int(binary.LittleEndian.Uint16(b[offset:]))
+	start := int(binary.LittleEndian.Uint32(b[offset+4:]))
+	if length == 0 || start < offset+8 || start+length > len(b) {
+		return nil
+	}
+	return b[start : start+length]
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// stubCookies replaces values of cookies in header value v separated by sep, only the first pair
+// is a cookie in Set-Cookie, the rest are its attributes
+func stubCookies(v, sep string, setCookie bool) string {
+	pairs := strings.Split(v, sep)
+	for i, p := range pairs {
+		if setCookie && i > 0 {
+			break
+		}
+		if j := strings.IndexByte(p, '='); j >= 0 {
+			pairs[i] = p[:j+1] + StubCookie
+		}
+	}
+	return strings.Join(pairs, sep)
+}
+
+// sanitizeURL replaces password of URL user info
+func sanitizeURL(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		c := *u
+		c.User = url.UserPassword(u.User.Username(), StubPassword)
+		return c.String()
+	}
+	return u.String()
+}
@@ -0,0 +1,297 @@
+// Package vcr records HTTP exchanges including NTLM handshakes to fixtures and replays them in tests.
+// Recorder sits under NTLM transport and stubs authentication tokens before they are saved, so fixtures
+// hold no credentials or session keys. Replayer answers requests from the fixture, stubbed challenges
+// are replaced with freshly generated ones so NTLM transport can complete the handshake. Golden recorder
+// keeps NTLM messages with secrets scrubbed instead, see Recorder.Golden.
+//
+//	rec := &vcr.Recorder{RoundTripper: http.DefaultTransport}
+//	client := &http.Client{Transport: &httpntlm.NtlmTransport{..., RoundTripper: rec}}
+//	// run requests against the real server
+//	rec.Cassette().Save("testdata/dynamics.json")
+//
+//	cassette, _ := vcr.Load("testdata/dynamics.json")
+//	client := &http.Client{Transport: &httpntlm.NtlmTransport{..., RoundTripper: vcr.NewReplayer(cassette)}}
+package vcr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// Stubs replacing tokens of authentication headers
+const (
+	StubNegotiate    = "<negotiate>"
+	StubChallenge    = "<challenge>"
+	StubAuthenticate = "<authenticate>"
+	StubToken        = "<token>"
+)
+
+// authHeaders carry authentication tokens, the names are canonical
+var authHeaders = []string{"Authorization", "Proxy-Authorization", "Www-Authenticate", "Proxy-Authenticate"}
+
+// Cassette is a sequence of recorded exchanges
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded request and its response
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Load reads cassette saved to path
+func Load(path string) (*Cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("vcr: invalid cassette %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes cassette to path
+func (c *Cassette) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// Recorder is http.RoundTripper which records exchanges sent through RoundTripper
+type Recorder struct {
+	// RoundTripper sends the requests, http.DefaultTransport is used if nil
+	RoundTripper http.RoundTripper
+	// Golden keeps NTLM messages in the fixture with only their secrets replaced, user, domain and workstation
+	// names by placeholders and challenges, responses and keys by zeros, so flags, versions and target info
+	// of the handshake can be inspected. Other tokens, cookies and URL passwords are stubbed.
+	// Such fixtures are meant for bug reports and replay as well.
+	Golden bool
+	// Path is where the cassette is saved after every exchange when set, request fails if it can't be written
+	Path string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// RoundTrip sends req and records the exchange with stubbed tokens
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := r.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	clean := sanitize
+	if r.Golden {
+		clean = sanitizeGolden
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    sanitizeURL(req.URL),
+			Header: clean(req.Header),
+			Body:   body,
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     clean(resp.Header),
+			Body:       respBody,
+		},
+	})
+	if r.Path != "" {
+		if err := r.cassette.Save(r.Path); err != nil {
+			return nil, fmt.Errorf("vcr: can't save cassette: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+func (r *Recorder) base() http.RoundTripper {
+	if r.RoundTripper != nil {
+		return r.RoundTripper
+	}
+	return http.DefaultTransport
+}
+
+// Cassette returns copy of exchanges recorded so far
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+}
+
+// sanitize returns copy of h with tokens of authentication headers stubbed
+func sanitize(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range authHeaders {
+		for i, v := range h[name] {
+			h[name][i] = stub(v)
+		}
+	}
+	return h
+}
+
+// stub replaces token of scheme and token header value, NTLM tokens are replaced by their message type
+func stub(v string) string {
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return v
+	}
+	scheme, token := v[:i], strings.TrimSpace(v[i+1:])
+	if strings.HasPrefix(token, "<") || strings.Contains(strings.TrimRight(token, "="), "=") {
+		// already stubbed or challenge parameters, e.g. realm, base64 has padding only at the end
+		return v
+	}
+
+	if b, err := base64.StdEncoding.DecodeString(token); err == nil && len(b) > 8 && bytes.HasPrefix(b, []byte("NTLMSSP\x00")) {
+		switch b[8] {
+		case 1:
+			return scheme + " " + StubNegotiate
+		case 2:
+			return scheme + " " + StubChallenge
+		case 3:
+			return scheme + " " + StubAuthenticate
+		}
+	}
+	return scheme + " " + StubToken
+}
+
+// Replayer is http.RoundTripper which answers requests with responses of a cassette. Request
+// matches interaction of the same method, URL, body and stubbed Authorization header, interactions
+// are used in recorded order and each only once.
+type Replayer struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+// NewReplayer returns Replayer of c
+func NewReplayer(c *Cassette) *Replayer {
+	return &Replayer{cassette: c, used: make([]bool, len(c.Interactions))}
+}
+
+// RoundTrip returns recorded response of req, error is returned if there's none
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	auth := stubbed(req.Header, "Authorization")
+	proxyAuth := stubbed(req.Header, "Proxy-Authorization")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.cassette.Interactions {
+		rec := in.Request
+		if r.used[i] || rec.Method != req.Method || rec.URL != sanitizeURL(req.URL) || !bytes.Equal(rec.Body, body) ||
+			stubbed(rec.Header, "Authorization") != auth || stubbed(rec.Header, "Proxy-Authorization") != proxyAuth {
+			continue
+		}
+		r.used[i] = true
+		return response(req, in.Response)
+	}
+	return nil, fmt.Errorf("vcr: no recorded response to %s %s", req.Method, req.URL)
+}
+
+func stubbed(h http.Header, name string) string {
+	if v := h.Get(name); v != "" {
+		return stub(v)
+	}
+	return ""
+}
+
+// response builds response of recorded one, stubbed challenges are replaced with generated ones
+func response(req *http.Request, rec Response) (*http.Response, error) {
+	header := rec.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for _, name := range authHeaders {
+		for i, v := range header[name] {
+			if !strings.HasSuffix(v, " "+StubChallenge) {
+				continue
+			}
+			challenge, err := generateChallenge()
+			if err != nil {
+				return nil, err
+			}
+			header[name][i] = strings.TrimSuffix(v, StubChallenge) + challenge
+		}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
+
+func generateChallenge() (string, error) {
+	session, err := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	if err != nil {
+		return "", err
+	}
+	challenge, err := session.GenerateChallengeMessage()
+	if err != nil {
+		return "", err
+	}
+	return httpntlm.EncBase64(challenge.Bytes()), nil
+}
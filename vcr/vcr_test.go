@@ -0,0 +1,127 @@
+package vcr
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+func ntlmServer(t *testing.T) *httptest.Server {
+	session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	session.SetUserInfo("testuser", "fish", "dt", "")
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM ")
+		b, _ := httpntlm.DecBase64(token)
+		switch {
+		case len(b) > 8 && b[8] == 1:
+			challenge, _ := session.GenerateChallengeMessage()
+			w.Header().Set("WWW-Authenticate", "NTLM "+httpntlm.EncBase64(challenge.Bytes()))
+			w.WriteHeader(http.StatusUnauthorized)
+		case len(b) > 8 && b[8] == 3:
+			auth, err := ntlm.ParseAuthenticateMessage(b, 2)
+			if err != nil || session.ProcessAuthenticateMessage(auth) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Write(append([]byte("hello "), body...))
+		default:
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+}
+
+func post(t *testing.T, rt http.RoundTripper, url string) string {
+	client := &http.Client{Transport: &httpntlm.NtlmTransport{Domain: "dt", User: "testuser", Password: "fish", RoundTripper: rt}}
+	resp, err := client.Post(url, "text/plain", strings.NewReader("vcr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	return string(b)
+}
+
+func Test_RecordReplay(t *testing.T) {
+	ts := ntlmServer(t)
+	rec := &Recorder{}
+	if body := post(t, rec, ts.URL+"/greet"); body != "hello vcr" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	ts.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Cassette().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+	if strings.Contains(string(saved), "TlRMTVNT") {
+		t.Errorf("cassette contains NTLM tokens: %s", saved)
+	}
+
+	cassette, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer := NewReplayer(cassette)
+	if body := post(t, replayer, ts.URL+"/greet"); body != "hello vcr" {
+		t.Errorf("unexpected replayed body %q", body)
+	}
+	if _, err := replayer.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL+"/other", nil)); err == nil {
+		t.Error("expected error for unrecorded request")
+	}
+}
+
+func Test_GoldenRecorder(t *testing.T) {
+	ts := ntlmServer(t)
+	path := filepath.Join(t.TempDir(), "golden.json")
+	rec := &Recorder{Golden: true, Path: path}
+	if body := post(t, rec, ts.URL+"/greet"); body != "hello vcr" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	ts.Close()
+
+	cassette, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var challenge *httpntlm.ChallengeMessage
+	var authenticate *httpntlm.AuthenticateMessage
+	for _, in := range cassette.Interactions {
+		if b, err := httpntlm.DecBase64(strings.TrimPrefix(in.Response.Header.Get("Www-Authenticate"), "NTLM ")); err == nil && len(b) > 0 {
+			challenge, _ = httpntlm.ParseChallengeMessage(b)
+		}
+		if b, err := httpntlm.DecBase64(strings.TrimPrefix(in.Request.Header.Get("Authorization"), "NTLM ")); err == nil && len(b) > 8 && b[8] == 3 {
+			authenticate, _ = httpntlm.ParseAuthenticateMessage(b)
+		}
+	}
+	if challenge == nil || authenticate == nil {
+		t.Fatalf("handshake wasn't recorded as NTLM messages: %+v", cassette)
+	}
+	if string(challenge.ServerChallenge()) != string(make([]byte, 8)) || !challenge.Flags().Has(httpntlm.FlagNTLM) {
+		t.Errorf("unexpected challenge flags=%s nonce=%x", challenge.Flags(), challenge.ServerChallenge())
+	}
+	if authenticate.User() != StubUser || authenticate.Domain() != StubDomain || !authenticate.NTLMv2() {
+		t.Errorf("unexpected authenticate user=%q domain=%q", authenticate.User(), authenticate.Domain())
+	}
+
+	if body := post(t, NewReplayer(cassette), ts.URL+"/greet"); body != "hello vcr" {
+		t.Errorf("unexpected replayed body %q", body)
+	}
+
+	h := sanitizeGolden(http.Header{"Cookie": {"a=1; b=2"}, "Set-Cookie": {"sid=secret; Path=/; HttpOnly"}, "Authorization": {"Basic dXNlcjpwYXNz"}})
+	if h.Get("Cookie") != "a=<cookie>; b=<cookie>" || h.Get("Set-Cookie") != "sid=<cookie>; Path=/; HttpOnly" || h.Get("Authorization") != "Basic "+StubToken {
+		t.Errorf("unexpected sanitized headers %v", h)
+	}
+}
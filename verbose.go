@@ -0,0 +1,82 @@
+package httpntlm
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sematext/go-ntlm/ntlm"
+)
+
+// HandshakeError is returned instead of error of failed handshake when NtlmTransport.VerboseErrors is set,
+// it tells what the last challenge offered, so NTLMv1 only servers and Extended Protection mismatches
+// can be told from logs alone
+type HandshakeError struct {
+	// Err is the original error
+	Err error
+	// Challenge is decoded summary of the last challenge, e.g. flags=unicode|ntlm|... ntlmv2=true target="CORP"
+	Challenge string
+}
+
+func (e *HandshakeError) Error() string {
+	return e.Err.Error() + " (" + e.Challenge + ")"
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// summarizeChallenge returns flags, target name, target info and version of m
+func summarizeChallenge(m *ChallengeMessage) string {
+	s := fmt.Sprintf("flags=%s target=%q", m.Flags(), m.TargetName())
+	if info, ok := m.TargetInfo(); ok {
+		s += fmt.Sprintf(" computer=%q domain=%q", info.DNSComputerName, info.DNSDomainName)
+	}
+	if v, ok := m.Version(); ok {
+		s += " version=" + v.String()
+	}
+	return s
+}
+
+// recordChallenge keeps summary of challenge req got from target for HandshakeError, NTLMv2 support,
+// server timestamp and for origins the bindings sent with ExtendedProtection are added to it
+func (t *NtlmTransport) recordChallenge(req *http.Request, target authTarget, challenge *ntlm.ChallengeMessage, resp *http.Response) {
+	if !t.VerboseErrors {
+		return
+	}
+
+	m := &ChallengeMessage{m: challenge}
+	s := "origin challenge "
+	if target.proxy {
+		s = "proxy challenge "
+	}
+	s += fmt.Sprintf("ntlmv2=%t ", !v1Only(challenge)) + summarizeChallenge(m)
+	if info, ok := m.TargetInfo(); ok {
+		s += fmt.Sprintf(" timestamp=%t", !info.Timestamp.IsZero())
+	}
+	if !target.proxy {
+		s += fmt.Sprintf(" tls=%t", resp.TLS != nil)
+		if t.ExtendedProtection {
+			s += fmt.Sprintf(" spn=%q", t.spn(req))
+		}
+	}
+	if h := handshakeInfoOf(req.Context()); h != nil {
+		h.mu.Lock()
+		h.challenge = s
+		h.mu.Unlock()
+	}
+}
+
+// verboseError wraps err of req in HandshakeError if challenge was received before it failed
+func (t *NtlmTransport) verboseError(req *http.Request, err error) error {
+	h := handshakeInfoOf(req.Context())
+	if !t.VerboseErrors || h == nil {
+		return err
+	}
+	h.mu.Lock()
+	challenge := h.challenge
+	h.mu.Unlock()
+	if challenge == "" {
+		return err
+	}
+	return &HandshakeError{Err: err, Challenge: challenge}
+}
@@ -0,0 +1,65 @@
+package httpntlm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Warmup establishes and authenticates n connections to the host of url concurrently,
+// so that first requests don't pay the handshake latency. Responses other than 2xx and 3xx fail it.
+// Transport keeps at least n idle authenticated connections of the host afterwards, unless
+// the underlying RoundTripper isn't *http.Transport, it decides how many idle connections are kept then,
+// see http.Transport.MaxIdleConnsPerHost.
+func (t *NtlmTransport) Warmup(ctx context.Context, url string, n int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	if tr, ok := t.base().(*http.Transport); ok {
+		t.connPool(tr).raiseLimit(hostKey(req.URL), n)
+	}
+
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- t.warmupConn(ctx, url)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *NtlmTransport) warmupConn(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	if err := t.discardBody(resp); err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("warmup of %s failed: %s", url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package wsus is a thin client of WSUS administration web services, which rely on Windows authentication.
+// It sends SOAP calls to the API remoting service and downloads long-running reports.
+package wsus
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+const (
+	// Namespace is the namespace of API remoting service messages
+	Namespace = "http://www.microsoft.com/SoftwareDistribution/Server/ApiRemotingWebService"
+	// APIPath is the path of API remoting service
+	APIPath = "/ApiRemoting30/WebService.asmx"
+)
+
+// NewTransport returns NTLM transport tuned for WSUS, reports take minutes to be generated
+// and large downloads are resumed when connection drops
+func NewTransport(domain, user, password string) *httpntlm.NtlmTransport {
+	tr := httpntlm.NewBaseTransport()
+	tr.ResponseHeaderTimeout = 10 * time.Minute
+	tr.IdleConnTimeout = 5 * time.Minute
+
+	return &httpntlm.NtlmTransport{
+		Domain:             domain,
+		User:               user,
+		Password:           password,
+		RoundTripper:       tr,
+		MaxDownloadResumes: 10,
+		MaxThrottleRetries: 3,
+	}
+}
+
+// Client calls WSUS server
+type Client struct {
+	// BaseURL is the server root, e.g. https://wsus.example.com:8531
+	BaseURL string
+	// Transport authenticates the requests
+	Transport *httpntlm.NtlmTransport
+}
+
+// New returns client of WSUS server at baseURL authenticating through t
+func New(baseURL string, t *httpntlm.NtlmTransport) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Transport: t}
+}
+
+// Fault is SOAP fault returned by the server
+type Fault struct {
+	Code   string `xml:"faultcode"`
+	String string `xml:"faultstring"`
+}
+
+func (f *Fault) Error() string {
+	return "wsus: " + f.Code + ": " + f.String
+}
+
+type envelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    body     `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+type body struct {
+	Content []byte `xml:",innerxml"`
+	Fault   *Fault `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault"`
+}
+
+// Call invokes action of API remoting service, request is marshaled into SOAP body and response element
+// is unmarshaled into response unless it's nil. Request element should be in Namespace.
+func (c *Client) Call(ctx context.Context, action string, request, response interface{}) error {
+	content, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	b, err := xml.Marshal(envelope{Body: body{Content: content}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+APIPath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", `"`+Namespace+"/"+action+`"`)
+
+	resp, err := (&http.Client{Transport: c.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var env envelope
+	if err := xml.NewDecoder(resp.Body).Decode(&env); err != nil {
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("wsus: %s", resp.Status)
+		}
+		return err
+	}
+	if env.Body.Fault != nil {
+		return env.Body.Fault
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("wsus: %s", resp.Status)
+	}
+	if response == nil {
+		return nil
+	}
+	return xml.Unmarshal(env.Body.Content, response)
+}
+
+// DownloadReport downloads report or content at path into w resuming interrupted transfers,
+// it returns the number of bytes written
+func (c *Client) DownloadReport(ctx context.Context, path string, w io.Writer) (int64, error) {
+	return c.Transport.Download(ctx, c.BaseURL+"/"+strings.TrimPrefix(path, "/"), w)
+}
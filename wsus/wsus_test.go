@@ -0,0 +1,56 @@
+package wsus
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+)
+
+func Test_Call(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		if strings.Contains(string(body), "Broken") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>`+
+				`<soap:Fault><faultcode>soap:Server</faultcode><faultstring>boom</faultstring></soap:Fault></soap:Body></soap:Envelope>`)
+			return
+		}
+		if r.Header.Get("SOAPAction") != `"`+Namespace+`/GetServerVersion"` {
+			t.Errorf("unexpected SOAPAction %s", r.Header.Get("SOAPAction"))
+		}
+		fmt.Fprint(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>`+
+			`<GetServerVersionResponse xmlns="`+Namespace+`"><GetServerVersionResult>10.0</GetServerVersionResult></GetServerVersionResponse>`+
+			`</soap:Body></soap:Envelope>`)
+	}))
+	defer ts.Close()
+
+	type request struct {
+		XMLName xml.Name
+	}
+	var response struct {
+		Result string `xml:"GetServerVersionResult"`
+	}
+	c := New(ts.URL, NewTransport("dt", "testuser", "fish"))
+	ctx := httpntlm.WithoutNTLM(context.Background())
+	if err := c.Call(ctx, "GetServerVersion", request{XMLName: xml.Name{Space: Namespace, Local: "GetServerVersion"}}, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Result != "10.0" {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	var fault *Fault
+	err := c.Call(ctx, "Broken", request{XMLName: xml.Name{Space: Namespace, Local: "Broken"}}, nil)
+	if !errors.As(err, &fault) || fault.String != "boom" {
+		t.Errorf("expected fault, got %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/sematext/go-http-ntlm/zapadapter
+
+go 1.14
+
+require (
+	github.com/sematext/go-http-ntlm/v2 v2.0.0
+	go.uber.org/zap v1.27.0
+)
@@ -0,0 +1,16 @@
+// Package zapadapter plugs zap loggers into NTLM transport logging hook.
+// It's a separate module so the transport doesn't depend on zap.
+package zapadapter
+
+import (
+	httpntlm "github.com/sematext/go-http-ntlm/v2"
+	"go.uber.org/zap"
+)
+
+// New returns Logger emitting transport events at debug level of l, keyvals become fields
+func New(l *zap.Logger) httpntlm.Logger {
+	s := l.WithOptions(zap.AddCallerSkip(2)).Sugar()
+	return httpntlm.LoggerFunc(func(msg string, keyvals ...interface{}) {
+		s.Debugw(msg, keyvals...)
+	})
+}
@@ -0,0 +1,22 @@
+package zapadapter
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_New(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	New(zap.New(core)).Log("sending request", "stage", "negotiate", "status", 401)
+
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].Message != "sending request" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	fields := entries[0].ContextMap()
+	if fields["stage"] != "negotiate" || fields["status"] != int64(401) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}